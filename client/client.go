@@ -5,19 +5,36 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/highxshell/crypto-exchange/marketdata"
 	"github.com/highxshell/crypto-exchange/orderbook"
 	"github.com/highxshell/crypto-exchange/server"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/highxshell/crypto-exchange/userstats"
 )
 
 const ENDPOINT="http://localhost:3000"
 
 type Client struct {
 	*http.Client
+	// APIKey authenticates the requests for the private data and the orders
+	// of its user.
+	APIKey 		string
 }
 
 func NewClient() *Client {
-	return &Client{http.DefaultClient}
+	return &Client{Client: http.DefaultClient}
+}
+
+// setAPIKey authenticates the request as the user of the API key, requests
+// without a key are rate limited per IP.
+func (c *Client) setAPIKey(req *http.Request) {
+	if c.APIKey != "" {
+		req.Header.Set(server.HeaderAPIKey, c.APIKey)
+	}
 }
 
 type PlaceOrderParams struct {
@@ -25,10 +42,56 @@ type PlaceOrderParams struct {
 	Bid 		bool
 	//price only needed for LIMIT
 	Price, Size float64
+	// ClientOrderID makes retries of the same order idempotent
+	ClientOrderID string
+	// PostOnly is only valid for LIMIT
+	PostOnly 	orderbook.PostOnly
+	ReduceOnly 	bool
+	// StopPrice holds the order until a trade reaches it
+	StopPrice 	float64
+	// TrailAmount or TrailPercent make the stop price follow the trades
+	TrailAmount 	float64
+	TrailPercent 	float64
+	// Peg makes a LIMIT order follow the top of the book
+	Peg 		*orderbook.Peg
+}
+
+// TradesParams filters a trade history request. Zero values are left to the
+// exchange defaults.
+type TradesParams struct {
+	Cursor 		int64
+	From, To 	int64
+	Limit 		int
+}
+
+type FillsParams struct {
+	Cursor 		string
+	From, To 	int64
+	Limit 		int
+}
+
+func timeRangeQuery(from, to int64, limit int) url.Values {
+	query := url.Values{}
+	if from > 0 {
+		query.Set("from", strconv.FormatInt(from, 10))
+	}
+	if to > 0 {
+		query.Set("to", strconv.FormatInt(to, 10))
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	return query
 }
 
-func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
-	endpoint := fmt.Sprintf("%s/trades/%s", ENDPOINT, market)
+func (c *Client) GetTrades(market string, params TradesParams) (*server.TradesResponse, error) {
+	query := timeRangeQuery(params.From, params.To, params.Limit)
+	if params.Cursor > 0 {
+		query.Set("cursor", strconv.FormatInt(params.Cursor, 10))
+	}
+
+	endpoint := fmt.Sprintf("%s/trades/%s?%s", ENDPOINT, market, query.Encode())
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
 		return nil, err
@@ -38,21 +101,282 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	trades := []*orderbook.Trade{}
-	if err := json.NewDecoder(resp.Body).Decode(&trades); err != nil{
+	trades := &server.TradesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(trades); err != nil{
 		return nil, err
 	}
 
 	return trades, nil
 }
 
+func (c *Client) GetFills(userID int64, params FillsParams) (*server.FillsResponse, error) {
+	query := timeRangeQuery(params.From, params.To, params.Limit)
+	if params.Cursor != "" {
+		query.Set("cursor", params.Cursor)
+	}
+
+	endpoint := fmt.Sprintf("%s/fills/%d?%s", ENDPOINT, userID, query.Encode())
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	fills := &server.FillsResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(fills); err != nil{
+		return nil, err
+	}
+
+	return fills, nil
+}
+
+func (c *Client) GetOrder(id int64) (*store.OrderRecord, error) {
+	endpoint := fmt.Sprintf("%s/orders/%d", ENDPOINT, id)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("order %d: status %d", id, resp.StatusCode)
+	}
+
+	order := &store.OrderRecord{}
+	if err := json.NewDecoder(resp.Body).Decode(order); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+// GetOrderHistory returns the orders of a user, open and closed. An empty
+// status returns every order.
+func (c *Client) GetOrderHistory(userID int64, status orderbook.OrderStatus) ([]store.OrderRecord, error) {
+	query := url.Values{}
+	query.Set("userID", strconv.FormatInt(userID, 10))
+	if status != "" {
+		query.Set("status", string(status))
+	}
+
+	endpoint := fmt.Sprintf("%s/orders?%s", ENDPOINT, query.Encode())
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	orders := []store.OrderRecord{}
+	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+func (c *Client) GetDepth(market string, levels int, grouping float64) (*server.DepthResponse, error) {
+	query := url.Values{}
+	if levels > 0 {
+		query.Set("levels", strconv.Itoa(levels))
+	}
+	if grouping > 0 {
+		query.Set("grouping", strconv.FormatFloat(grouping, 'f', -1, 64))
+	}
+
+	endpoint := fmt.Sprintf("%s/depth/%s?%s", ENDPOINT, market, query.Encode())
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	depth := &server.DepthResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(depth); err != nil {
+		return nil, err
+	}
+
+	return depth, nil
+}
+
+func (c *Client) GetTicker(market string) (*marketdata.Ticker, error) {
+	endpoint := fmt.Sprintf("%s/ticker/%s", ENDPOINT, market)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ticker := &marketdata.Ticker{}
+	if err := json.NewDecoder(resp.Body).Decode(ticker); err != nil {
+		return nil, err
+	}
+
+	return ticker, nil
+}
+
+func (c *Client) GetFees(userID int64) (*server.FeesResponse, error) {
+	endpoint := fmt.Sprintf("%s/fees/%d", ENDPOINT, userID)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get fees of user %d: status %d", userID, resp.StatusCode)
+	}
+
+	fees := &server.FeesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(fees); err != nil {
+		return nil, err
+	}
+
+	return fees, nil
+}
+
+func (c *Client) GetUserStats(userID int64) (*userstats.Summary, error) {
+	endpoint := fmt.Sprintf("%s/users/%d/stats", ENDPOINT, userID)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get stats of user %d: status %d", userID, resp.StatusCode)
+	}
+
+	stats := &userstats.Summary{}
+	if err := json.NewDecoder(resp.Body).Decode(stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func (c *Client) GetMarketStatus(market string) (*server.MarketState, error) {
+	endpoint := fmt.Sprintf("%s/markets/%s/status", ENDPOINT, market)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get status of market %s: status %d", market, resp.StatusCode)
+	}
+
+	state := &server.MarketState{}
+	if err := json.NewDecoder(resp.Body).Decode(state); err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func (c *Client) GetAuction(market string) (*server.AuctionResponse, error) {
+	endpoint := fmt.Sprintf("%s/auction/%s", ENDPOINT, market)
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get auction of market %s: status %d", market, resp.StatusCode)
+	}
+
+	auction := &server.AuctionResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(auction); err != nil {
+		return nil, err
+	}
+
+	return auction, nil
+}
+
+func (c *Client) GetCandles(market string, interval marketdata.Interval, from, to int64, limit int) (*server.CandlesResponse, error) {
+	query := timeRangeQuery(from, to, limit)
+	query.Set("interval", string(interval))
+
+	endpoint := fmt.Sprintf("%s/candles/%s?%s", ENDPOINT, market, query.Encode())
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	candles := &server.CandlesResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(candles); err != nil {
+		return nil, err
+	}
+
+	return candles, nil
+}
+
 func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 	endpoint := fmt.Sprintf("%s/order/%d", ENDPOINT, userID)
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil{
 		return nil, err
 	}
+	c.setAPIKey(req)
 
 	resp, err := c.Do(req)
 	if err != nil{
@@ -73,6 +397,7 @@ func (c *Client) CancelOrder(orderID int64) error {
 	if err != nil{
 		return err
 	} 
+	c.setAPIKey(req)
 
 	_, err = c.Do(req)
 	if err != nil{
@@ -82,6 +407,126 @@ func (c *Client) CancelOrder(orderID int64) error {
 	return nil
 }
 
+// CancelAll cancels the open orders of a user. An empty market or side
+// ("BID" or "ASK") cancels the orders of every market or side.
+func (c *Client) CancelAll(userID int64, market string, side string) ([]int64, error) {
+	query := url.Values{}
+	query.Set("userID", strconv.FormatInt(userID, 10))
+	if market != "" {
+		query.Set("market", market)
+	}
+	if side != "" {
+		query.Set("side", side)
+	}
+
+	endpoint := fmt.Sprintf("%s/orders?%s", ENDPOINT, query.Encode())
+	req, err := http.NewRequest(http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to cancel orders of user %d: status %d", userID, resp.StatusCode)
+	}
+
+	cancelResp := &server.CancelAllResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(cancelResp); err != nil {
+		return nil, err
+	}
+
+	return cancelResp.Canceled, nil
+}
+
+// CancelAfter arms the dead man's switch of the user: every order of the user
+// is canceled unless CancelAfter is called again within timeout. A zero
+// timeout disarms it.
+func (c *Client) CancelAfter(userID int64, timeout time.Duration) (*server.CancelAfterResponse, error) {
+	body, err := json.Marshal(&server.CancelAfterRequest{
+		UserID:  userID,
+		Timeout: timeout.Milliseconds(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ENDPOINT+"/cancel-after", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to arm cancel after for user %d: status %d", userID, resp.StatusCode)
+	}
+
+	cancelAfterResp := &server.CancelAfterResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(cancelAfterResp); err != nil {
+		return nil, err
+	}
+
+	return cancelAfterResp, nil
+}
+
+func (c *Client) CancelOrderByClientID(userID int64, clientOrderID string) error {
+	endpoint := fmt.Sprintf("%s/order/client/%d/%s", ENDPOINT, userID, url.PathEscape(clientOrderID))
+	req, err := http.NewRequest(http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to cancel order %s: status %d", clientOrderID, resp.StatusCode)
+	}
+
+	return nil
+}
+
+func (c *Client) GetOrderByClientID(userID int64, clientOrderID string) (*store.OrderRecord, error) {
+	endpoint := fmt.Sprintf("%s/orders/client/%d/%s", ENDPOINT, userID, url.PathEscape(clientOrderID))
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("order %s not found", clientOrderID)
+	}
+
+	order := &store.OrderRecord{}
+	if err := json.NewDecoder(resp.Body).Decode(order); err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
 func (c *Client) GetBestBid() (*server.Order, error) {
 	endpoint := fmt.Sprintf("%s/book/ETH/bid", ENDPOINT)
 	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
@@ -129,6 +574,11 @@ func (c *Client) PlaceMarketOrder(params *PlaceOrderParams) (*server.PlaceOrderR
 		Bid: 		params.Bid,
 		Size: 		params.Size,
 		Market: 	server.MarketETH,
+		ClientOrderID: params.ClientOrderID,
+		ReduceOnly: params.ReduceOnly,
+		StopPrice: 	params.StopPrice,
+		TrailAmount: params.TrailAmount,
+		TrailPercent: params.TrailPercent,
 	}
 	body, err :=json.Marshal(p)
 	if err != nil{
@@ -140,6 +590,7 @@ func (c *Client) PlaceMarketOrder(params *PlaceOrderParams) (*server.PlaceOrderR
 	if err != nil{
 		return nil, err
 	} 
+	c.setAPIKey(req)
 
 	resp, err := c.Do(req)
 	if err != nil{
@@ -167,6 +618,13 @@ func (c *Client) PlaceLimitOrder(params *PlaceOrderParams) (*server.PlaceOrderRe
 		Size: 		params.Size,
 		Price: 		params.Price,
 		Market: 	server.MarketETH,
+		ClientOrderID: params.ClientOrderID,
+		PostOnly: 	params.PostOnly,
+		ReduceOnly: params.ReduceOnly,
+		StopPrice: 	params.StopPrice,
+		TrailAmount: params.TrailAmount,
+		TrailPercent: params.TrailPercent,
+		Peg: 		params.Peg,
 	}
 	body, err :=json.Marshal(p)
 	if err != nil{
@@ -178,6 +636,7 @@ func (c *Client) PlaceLimitOrder(params *PlaceOrderParams) (*server.PlaceOrderRe
 	if err != nil{
 		return nil, err
 	} 
+	c.setAPIKey(req)
 
 	resp, err := c.Do(req)
 	if err != nil{
@@ -191,4 +650,71 @@ func (c *Client) PlaceLimitOrder(params *PlaceOrderParams) (*server.PlaceOrderRe
 	defer resp.Body.Close()
 	
 	return placeOrderResponse, nil
-}
\ No newline at end of file
+}
+
+// PlaceGroup places an OCO group or a bracket.
+func (c *Client) PlaceGroup(params *server.PlaceGroupRequest) (*store.OrderGroupRecord, error) {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ENDPOINT+"/groups", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to place order group: status %d", resp.StatusCode)
+	}
+
+	group := &store.OrderGroupRecord{}
+	if err := json.NewDecoder(resp.Body).Decode(group); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// GetGroup returns the latest state of an order group.
+func (c *Client) GetGroup(id int64) (*store.OrderGroupRecord, error) {
+	return c.groupRequest(http.MethodGet, id)
+}
+
+// CancelGroup cancels an order group and its working orders.
+func (c *Client) CancelGroup(id int64) (*store.OrderGroupRecord, error) {
+	return c.groupRequest(http.MethodDelete, id)
+}
+
+func (c *Client) groupRequest(method string, id int64) (*store.OrderGroupRecord, error) {
+	endpoint := fmt.Sprintf("%s/groups/%d", ENDPOINT, id)
+	req, err := http.NewRequest(method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.setAPIKey(req)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("order group %d: status %d", id, resp.StatusCode)
+	}
+
+	group := &store.OrderGroupRecord{}
+	if err := json.NewDecoder(resp.Body).Decode(group); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
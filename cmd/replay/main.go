@@ -0,0 +1,447 @@
+// replay runs a recorded stream of order commands through the matching
+// engine and prints the resulting fills and final book in a canonical
+// format. Given a baseline it reports every difference, which makes it a
+// regression test for changes to the engine.
+//
+// The stream holds one server.RecordedRequest per line, as captured by the
+// exchange when CAPTURE_FILE is set. Only the order book is replayed, with
+// the allocation policies and tick sizes of the config. Requests that
+// depend on the rest of the exchange, such as stop, pegged and reduce-only
+// orders, order groups, admin requests and orders the exchange rejected
+// before they reached the book, print a skip line instead. The output after
+// a skip line may differ from what the exchange did.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/server"
+)
+
+func main() {
+	var (
+		input    = flag.String("input", "", "recorded stream of order commands")
+		baseline = flag.String("baseline", "", "baseline output to diff against")
+		update   = flag.Bool("update", false, "write the output to the baseline instead of diffing")
+		config   = flag.String("config", "", "JSON file with the Allocations and TickSizes of the markets")
+	)
+	flag.Parse()
+
+	cfg := marketConfig{}
+	if *config != "" {
+		b, err := os.ReadFile(*config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(b, &cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	output, err := replay(f, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *baseline == "" {
+		fmt.Println(strings.Join(output, "\n"))
+		return
+	}
+
+	if *update {
+		if err := os.WriteFile(*baseline, []byte(strings.Join(output, "\n")+"\n"), 0644); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	b, err := os.ReadFile(*baseline)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if d := diff(strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"), output); len(d) > 0 {
+		fmt.Println(strings.Join(d, "\n"))
+		os.Exit(1)
+	}
+	fmt.Println("no differences")
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func side(bid bool) string {
+	if bid {
+		return "BID"
+	}
+	return "ASK"
+}
+
+// marketConfig holds the fields of server.ExchangeConfig the books are
+// configured with.
+type marketConfig struct {
+	Allocations map[server.Market]orderbook.Allocation
+	TickSizes   map[server.Market]float64
+}
+
+type replayer struct {
+	cfg        marketConfig
+	orderbooks map[server.Market]*orderbook.Orderbook
+	// ids maps the order IDs of the recording to the IDs of the replay
+	ids map[int64]int64
+	// clientIDs maps the client order IDs of every user to the IDs of the
+	// replay
+	clientIDs map[string]int64
+	// labels numbers the order IDs of the replay in the order they are
+	// first printed, IDs themselves depend on the clock
+	labels map[int64]int64
+	output []string
+}
+
+// replay applies the recorded requests and returns the canonical output.
+// Timestamps are left out since they differ between runs.
+func replay(r io.Reader, cfg marketConfig) ([]string, error) {
+	rp := &replayer{
+		cfg:        cfg,
+		orderbooks: make(map[server.Market]*orderbook.Orderbook),
+		ids:        make(map[int64]int64),
+		clientIDs:  make(map[string]int64),
+		labels:     make(map[int64]int64),
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var req server.RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := rp.apply(req); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	rp.writeBooks()
+
+	return rp.output, nil
+}
+
+func (rp *replayer) label(id int64) int64 {
+	label, ok := rp.labels[id]
+	if !ok {
+		label = int64(len(rp.labels) + 1)
+		rp.labels[id] = label
+	}
+
+	return label
+}
+
+// orderbook returns the book of the market, configured like the exchange
+// configures it.
+func (rp *replayer) orderbook(market server.Market) (*orderbook.Orderbook, error) {
+	if ob, ok := rp.orderbooks[market]; ok {
+		return ob, nil
+	}
+
+	ob := orderbook.NewOrderBook()
+	if err := ob.SetAllocation(rp.cfg.Allocations[market]); err != nil {
+		return nil, fmt.Errorf("market %s: %w", market, err)
+	}
+	tick, ok := rp.cfg.TickSizes[market]
+	if !ok {
+		tick = server.DefaultTickSize
+	}
+	if err := ob.SetTickSize(tick); err != nil {
+		return nil, fmt.Errorf("market %s: %w", market, err)
+	}
+	rp.orderbooks[market] = ob
+
+	return ob, nil
+}
+
+func (rp *replayer) skip(req server.RecordedRequest, reason string) {
+	rp.output = append(rp.output, fmt.Sprintf("skip %s %s: %s", req.Method, req.Path, reason))
+}
+
+// unsupported returns why the order cannot be replayed on the book alone,
+// empty when it can.
+func unsupported(data server.PlaceOrderRequest) string {
+	switch {
+	case data.StopPrice > 0 || data.TrailAmount > 0 || data.TrailPercent > 0:
+		return "stop order"
+	case data.Peg != nil:
+		return "pegged order"
+	case data.ReduceOnly:
+		return "reduce-only order"
+	}
+
+	return ""
+}
+
+// rejected returns the error the exchange rejected the order with before
+// it reached the book, empty when the book placed or rejected it itself.
+func rejected(req server.RecordedRequest) string {
+	var resp server.APIError
+	if len(req.Response) == 0 || json.Unmarshal(req.Response, &resp) != nil || resp.Error == "" {
+		return ""
+	}
+	if resp.Error == server.ErrPostOnly.Error() || strings.Contains(resp.Error, "not enough volume") {
+		return ""
+	}
+
+	return resp.Error
+}
+
+func (rp *replayer) apply(req server.RecordedRequest) error {
+	switch {
+	case req.Method == "POST" && req.Path == "/order":
+		return rp.placeOrder(req)
+	case req.Method == "DELETE" && req.Path == "/orders":
+		return rp.cancelAll(req)
+	case req.Method == "DELETE" && strings.HasPrefix(req.Path, "/order/client/"):
+		return rp.cancelClientOrder(req)
+	case req.Method == "DELETE" && strings.HasPrefix(req.Path, "/order/"):
+		return rp.cancelOrder(req)
+	}
+
+	rp.skip(req, "not replayed")
+	return nil
+}
+
+func (rp *replayer) placeOrder(req server.RecordedRequest) error {
+	var data server.PlaceOrderRequest
+	if err := json.Unmarshal(req.Body, &data); err != nil {
+		return err
+	}
+	if reason := unsupported(data); reason != "" {
+		rp.skip(req, reason)
+		return nil
+	}
+	if reason := rejected(req); reason != "" {
+		rp.skip(req, "rejected by the exchange: "+reason)
+		return nil
+	}
+
+	clientKey := fmt.Sprintf("%d/%s", data.UserID, data.ClientOrderID)
+	if data.ClientOrderID != "" {
+		if id, ok := rp.clientIDs[clientKey]; ok {
+			rp.output = append(rp.output, fmt.Sprintf("duplicate id=%d user=%d client_id=%s", rp.label(id), data.UserID, data.ClientOrderID))
+			return nil
+		}
+	}
+
+	ob, err := rp.orderbook(data.Market)
+	if err != nil {
+		return err
+	}
+	order := orderbook.NewOrder(data.Bid, data.Size, data.UserID)
+	order.ClientOrderID = data.ClientOrderID
+	order.PostOnly = data.PostOnly
+	defer func() {
+		if data.ClientOrderID != "" && order.ID != 0 {
+			rp.clientIDs[clientKey] = order.ID
+		}
+	}()
+
+	switch data.Type {
+	case server.LimitOrder:
+		ob.PlaceLimitOrder(data.Price, order)
+		if data.PostOnly == "" {
+			rp.output = append(rp.output, fmt.Sprintf("limit id=%d user=%d side=%s price=%s size=%s",
+				rp.label(order.ID), order.UserID, side(order.Bid), formatFloat(data.Price), formatFloat(data.Size)))
+			break
+		}
+		if order.Status == orderbook.StatusRejected {
+			rp.output = append(rp.output, fmt.Sprintf("reject limit id=%d user=%d side=%s price=%s size=%s post_only=%s",
+				rp.label(order.ID), order.UserID, side(order.Bid), formatFloat(data.Price), formatFloat(data.Size), data.PostOnly))
+			return nil
+		}
+		// sliding orders may rest at another price
+		rp.output = append(rp.output, fmt.Sprintf("limit id=%d user=%d side=%s price=%s size=%s post_only=%s",
+			rp.label(order.ID), order.UserID, side(order.Bid), formatFloat(order.Limit.Price), formatFloat(data.Size), data.PostOnly))
+	case server.MarketOrder:
+		available := ob.BidTotalVolume()
+		if data.Bid {
+			available = ob.AskTotalVolume()
+		}
+
+		matches := ob.PlaceMarketOrder(order)
+		if order.Status == orderbook.StatusRejected {
+			rp.output = append(rp.output, fmt.Sprintf("reject market id=%d user=%d side=%s size=%s available=%s",
+				rp.label(order.ID), data.UserID, side(data.Bid), formatFloat(data.Size), formatFloat(available)))
+			return nil
+		}
+		rp.output = append(rp.output, fmt.Sprintf("market id=%d user=%d side=%s size=%s",
+			rp.label(order.ID), order.UserID, side(order.Bid), formatFloat(data.Size)))
+		for _, match := range matches {
+			maker := match.Bid
+			if order.Bid {
+				maker = match.Ask
+			}
+			rp.output = append(rp.output, fmt.Sprintf("  fill maker=%d maker_user=%d price=%s size=%s maker_left=%s",
+				rp.label(maker.ID), maker.UserID, formatFloat(match.Price), formatFloat(match.SizeFilled), formatFloat(maker.Size)))
+		}
+	default:
+		return fmt.Errorf("unknown order type: %s", data.Type)
+	}
+
+	var resp server.PlaceOrderResponse
+	if len(req.Response) > 0 && json.Unmarshal(req.Response, &resp) == nil && resp.OrderID != 0 {
+		rp.ids[resp.OrderID] = order.ID
+	}
+
+	return nil
+}
+
+func (rp *replayer) cancelOrder(req server.RecordedRequest) error {
+	recordedID, err := strconv.ParseInt(strings.TrimPrefix(req.Path, "/order/"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	id, ok := rp.ids[recordedID]
+	if !ok {
+		id = recordedID
+	}
+
+	return rp.cancel(id)
+}
+
+// cancelClientOrder cancels an order by the client order ID of its user,
+// recorded as /order/client/:userID/:clientOrderID.
+func (rp *replayer) cancelClientOrder(req server.RecordedRequest) error {
+	clientKey := strings.TrimPrefix(req.Path, "/order/client/")
+	id, ok := rp.clientIDs[clientKey]
+	if !ok {
+		rp.output = append(rp.output, fmt.Sprintf("cancel client_id=%s not found", clientKey))
+		return nil
+	}
+
+	return rp.cancel(id)
+}
+
+// cancelAll cancels the open orders of a user the way DELETE /orders does,
+// market by market in order ID order.
+func (rp *replayer) cancelAll(req server.RecordedRequest) error {
+	query, err := url.ParseQuery(req.Query)
+	if err != nil {
+		return err
+	}
+	userID, err := strconv.ParseInt(query.Get("userID"), 10, 64)
+	if err != nil {
+		return err
+	}
+	side := query.Get("side")
+
+	rp.output = append(rp.output, fmt.Sprintf("cancel_all user=%d market=%s side=%s", userID, query.Get("market"), side))
+	for _, market := range rp.markets() {
+		if m := query.Get("market"); m != "" && server.Market(m) != market {
+			continue
+		}
+
+		ob := rp.orderbooks[market]
+		orders := []*orderbook.Order{}
+		for _, order := range ob.Orders {
+			if order.UserID == userID && (side == "" || side == order.Type()) {
+				orders = append(orders, order)
+			}
+		}
+		sort.Slice(orders, func(i, k int) bool { return orders[i].ID < orders[k].ID })
+
+		for _, order := range orders {
+			ob.CancelOrder(order)
+			rp.output = append(rp.output, fmt.Sprintf("  cancel id=%d", rp.label(order.ID)))
+		}
+	}
+
+	return nil
+}
+
+func (rp *replayer) cancel(id int64) error {
+	for _, market := range rp.markets() {
+		ob := rp.orderbooks[market]
+		if order, ok := ob.Orders[id]; ok {
+			ob.CancelOrder(order)
+			rp.output = append(rp.output, fmt.Sprintf("cancel id=%d", rp.label(id)))
+			return nil
+		}
+	}
+
+	rp.output = append(rp.output, fmt.Sprintf("cancel id=%d not found", rp.label(id)))
+	return nil
+}
+
+func (rp *replayer) markets() []server.Market {
+	markets := []server.Market{}
+	for market := range rp.orderbooks {
+		markets = append(markets, market)
+	}
+	sort.Slice(markets, func(i, k int) bool { return markets[i] < markets[k] })
+
+	return markets
+}
+
+// writeBooks prints every level of the final books best first with its
+// orders in queue order.
+func (rp *replayer) writeBooks() {
+	for _, market := range rp.markets() {
+		ob := rp.orderbooks[market]
+		rp.output = append(rp.output, fmt.Sprintf("book %s bid_volume=%s ask_volume=%s trades=%d",
+			market, formatFloat(ob.BidTotalVolume()), formatFloat(ob.AskTotalVolume()), len(ob.Trades)))
+
+		for _, limit := range ob.Asks() {
+			rp.writeLimit("ask", limit)
+		}
+		for _, limit := range ob.Bids() {
+			rp.writeLimit("bid", limit)
+		}
+	}
+}
+
+func (rp *replayer) writeLimit(side string, limit *orderbook.Limit) {
+	rp.output = append(rp.output, fmt.Sprintf("  %s price=%s volume=%s", side, formatFloat(limit.Price), formatFloat(limit.TotalVolume)))
+	for _, order := range limit.Orders {
+		rp.output = append(rp.output, fmt.Sprintf("    order id=%d user=%d size=%s", rp.label(order.ID), order.UserID, formatFloat(order.Size)))
+	}
+}
+
+// diff returns the lines that differ between the baseline and the output.
+func diff(baseline, output []string) []string {
+	d := []string{}
+	for i := 0; i < len(baseline) || i < len(output); i++ {
+		switch {
+		case i >= len(output):
+			d = append(d, fmt.Sprintf("%d - %s", i+1, baseline[i]))
+		case i >= len(baseline):
+			d = append(d, fmt.Sprintf("%d + %s", i+1, output[i]))
+		case baseline[i] != output[i]:
+			d = append(d, fmt.Sprintf("%d - %s", i+1, baseline[i]), fmt.Sprintf("%d + %s", i+1, output[i]))
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/server"
+)
+
+// TestReplayBaseline guards the matching engine against behavioral
+// regressions. Update the baseline with
+//
+//	go run ./cmd/replay -input testdata/stream.jsonl -baseline testdata/baseline.txt -update
+//
+// only when a change in behavior is intended.
+func TestReplayBaseline(t *testing.T) {
+	f, err := os.Open("testdata/stream.jsonl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	output, err := replay(f, marketConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile("testdata/baseline.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := diff(strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"), output); len(d) > 0 {
+		t.Errorf("replay differs from baseline:\n%s", strings.Join(d, "\n"))
+	}
+}
+
+func TestReplayMarketConfigAndSkips(t *testing.T) {
+	stream := strings.Join([]string{
+		`{"Method":"POST","Path":"/order","Body":{"UserID":1,"Type":"LIMIT","Size":1,"Price":100,"Market":"ETH"},"Response":{"OrderID":1}}`,
+		`{"Method":"POST","Path":"/order","Body":{"UserID":2,"Type":"LIMIT","Size":3,"Price":100,"Market":"ETH"},"Response":{"OrderID":2}}`,
+		`{"Method":"POST","Path":"/order","Body":{"UserID":3,"Type":"MARKET","Bid":true,"Size":2,"Market":"ETH"},"Response":{"OrderID":3}}`,
+		`{"Method":"POST","Path":"/order","Body":{"UserID":4,"Type":"LIMIT","Bid":true,"Size":1,"Price":100,"Market":"ETH","PostOnly":"SLIDE"},"Response":{"OrderID":4}}`,
+		`{"Method":"POST","Path":"/order","Body":{"UserID":4,"Type":"LIMIT","Size":1,"Price":99,"Market":"ETH","PostOnly":"REJECT"},"Response":{"Error":"post-only order would cross the spread"}}`,
+		`{"Method":"POST","Path":"/order","Body":{"UserID":5,"Type":"MARKET","Size":1,"StopPrice":90,"Market":"ETH"},"Response":{"OrderID":6}}`,
+		`{"Method":"POST","Path":"/order","Body":{"UserID":5,"Type":"LIMIT","Size":1,"Price":99,"Market":"ETH"},"Response":{"Error":"market is halted"}}`,
+		`{"Method":"POST","Path":"/groups","Body":{"UserID":5},"Response":{"GroupID":8}}`,
+	}, "\n")
+	cfg := marketConfig{
+		Allocations: map[server.Market]orderbook.Allocation{server.MarketETH: {Kind: orderbook.AllocationProRata}},
+		TickSizes:   map[server.Market]float64{server.MarketETH: 0.5},
+	}
+
+	output, err := replay(strings.NewReader(stream), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"limit id=1 user=1 side=ASK price=100 size=1",
+		"limit id=2 user=2 side=ASK price=100 size=3",
+		"market id=3 user=3 side=BID size=2",
+		// the taker is split pro rata
+		"  fill maker=1 maker_user=1 price=100 size=0.5 maker_left=0.5",
+		"  fill maker=2 maker_user=2 price=100 size=1.5 maker_left=1.5",
+		// and post-only orders slide by the tick size of the market
+		"limit id=4 user=4 side=BID price=99.5 size=1 post_only=SLIDE",
+		"reject limit id=5 user=4 side=ASK price=99 size=1 post_only=REJECT",
+		"skip POST /order: stop order",
+		"skip POST /order: rejected by the exchange: market is halted",
+		"skip POST /groups: not replayed",
+		"book ETH bid_volume=1 ask_volume=2 trades=2",
+		"  ask price=100 volume=2",
+		"    order id=1 user=1 size=0.5",
+		"    order id=2 user=2 size=1.5",
+		"  bid price=99.5 volume=1",
+		"    order id=4 user=4 size=1",
+	}
+	if d := diff(want, output); len(d) > 0 {
+		t.Errorf("replay differs:\n%s", strings.Join(d, "\n"))
+	}
+}
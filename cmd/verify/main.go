@@ -0,0 +1,54 @@
+// verify checks that the latest snapshot of a market plus the replay of its
+// journal tail results in the same book as the live exchange.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/server"
+)
+
+func main() {
+	var (
+		dir      = flag.String("dir", "data/journal", "journal directory of the exchange (JOURNAL_DIR)")
+		market   = flag.String("market", string(server.MarketETH), "market to verify")
+		endpoint = flag.String("endpoint", "http://localhost:3000", "exchange to fetch the live book hash from")
+		seq      = flag.Int64("seq", 0, "verify against this sequence number instead of the live book")
+		hash     = flag.String("hash", "", "verify against this hash instead of the live book")
+	)
+	flag.Parse()
+
+	live := server.BookHashResponse{Seq: *seq, Hash: *hash}
+	if live.Hash == "" {
+		resp, err := http.Get(fmt.Sprintf("%s/book/%s/hash", *endpoint, *market))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&live); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	snap, err := orderbook.LatestSnapshot(filepath.Join(*dir, *market, "snapshots"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	journal := orderbook.OpenFileJournalReadOnly(filepath.Join(*dir, *market, "journal"))
+
+	snapSeq := int64(0)
+	if snap != nil {
+		snapSeq = snap.LastSeq
+	}
+	if err := orderbook.VerifySnapshot(snap, journal, live.Seq, live.Hash); err != nil {
+		log.Fatalf("verification failed [snapshot seq: %d]: %v", snapSeq, err)
+	}
+
+	fmt.Printf("ok: snapshot seq %d + journal replay matches live book at seq %d [%s]\n", snapSeq, live.Seq, live.Hash)
+}
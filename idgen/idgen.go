@@ -0,0 +1,105 @@
+// Package idgen generates unique, monotonic 63 bit IDs in the style of
+// Snowflake. An ID is made of the milliseconds since Epoch, the node that
+// generated it and a sequence number within the millisecond:
+//
+//	| 41 bits time | 10 bits node | 12 bits sequence |
+//
+// Every market of the exchange is a node, so IDs never collide across
+// markets, and IDs of a node are strictly increasing.
+package idgen
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	NodeBits = 10
+	SeqBits  = 12
+	MaxNode  = 1<<NodeBits - 1
+	MaxSeq   = 1<<SeqBits - 1
+)
+
+// Epoch is the start of the ID clock, 2024-01-01 UTC in milliseconds.
+var Epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMilli()
+
+// Compose builds the ID of a node for a timestamp in nanoseconds.
+func Compose(timestamp int64, node, seq int64) int64 {
+	ms := timestamp/int64(time.Millisecond) - Epoch
+	if ms < 0 {
+		ms = 0
+	}
+
+	return compose(ms, node, seq)
+}
+
+func compose(ms, node, seq int64) int64 {
+	return ms<<(NodeBits+SeqBits) | node<<SeqBits | seq
+}
+
+// Decompose splits an ID into the time it was generated at, its node and its
+// sequence number.
+func Decompose(id int64) (time.Time, int64, int64) {
+	ms := id >> (NodeBits + SeqBits)
+	node := id >> SeqBits & MaxNode
+	seq := id & MaxSeq
+
+	return time.UnixMilli(ms + Epoch).UTC(), node, seq
+}
+
+// Generator generates the IDs of a node. The next ID only depends on the
+// timestamp it is generated for and the last ID, so generating IDs for the
+// same timestamps after observing the same IDs yields the same IDs.
+type Generator struct {
+	mu   sync.Mutex
+	node int64
+	last int64
+}
+
+func New(node int64) *Generator {
+	if node < 0 || node > MaxNode {
+		panic(fmt.Errorf("invalid ID node [%d], must be between 0 and %d", node, MaxNode))
+	}
+
+	return &Generator{node: node}
+}
+
+// Next returns an ID greater than every ID generated or observed so far. When
+// the sequence of a millisecond is exhausted, or the clock went backwards,
+// the ID is taken from the millisecond after the last ID.
+func (g *Generator) Next(timestamp int64) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := Compose(timestamp, g.node, 0)
+	if id <= g.last {
+		ms := g.last >> (NodeBits + SeqBits)
+		seq := g.last&MaxSeq + 1
+		id = compose(ms, g.node, seq)
+		if seq > MaxSeq || id <= g.last {
+			id = compose(ms+1, g.node, 0)
+		}
+	}
+	g.last = id
+
+	return id
+}
+
+// Observe moves the generator past an ID, e.g. one restored after a restart.
+func (g *Generator) Observe(id int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if id > g.last {
+		g.last = id
+	}
+}
+
+// Last returns the high-water mark of the generator.
+func (g *Generator) Last() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.last
+}
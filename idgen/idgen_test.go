@@ -0,0 +1,62 @@
+package idgen
+
+import (
+	"testing"
+	"time"
+)
+
+func TestComposeDecompose(t *testing.T) {
+	at := time.Date(2026, 3, 4, 5, 6, 7, 8_000_000, time.UTC)
+	id := Compose(at.UnixNano(), 42, 7)
+
+	ts, node, seq := Decompose(id)
+	if !ts.Equal(at) || node != 42 || seq != 7 {
+		t.Fatalf("decomposed %d into %s %d %d", id, ts, node, seq)
+	}
+}
+
+// TestNoCollisions generates millions of IDs for two nodes sharing the same
+// clock. The clock barely moves and goes backwards, forcing the generators
+// to exhaust the sequence of a millisecond and borrow from the next one.
+func TestNoCollisions(t *testing.T) {
+	const n = 2_000_000
+
+	var (
+		nodes = []*Generator{New(1), New(2)}
+		seen  = make(map[int64]struct{}, n*len(nodes))
+		last  = make([]int64, len(nodes))
+		now   = time.Now().UnixNano()
+	)
+	for i := 0; i < n; i++ {
+		if i%10_000 == 0 {
+			now -= int64(time.Second)
+		}
+		now += int64(time.Microsecond)
+
+		for k, gen := range nodes {
+			id := gen.Next(now)
+			if _, ok := seen[id]; ok {
+				t.Fatalf("ID %d generated twice", id)
+			}
+			seen[id] = struct{}{}
+
+			if id <= last[k] {
+				t.Fatalf("ID %d of node %d is not greater than %d", id, k, last[k])
+			}
+			last[k] = id
+		}
+	}
+}
+
+func TestObserveRestoresHighWaterMark(t *testing.T) {
+	now := time.Now().UnixNano()
+	gen := New(1)
+	id := gen.Next(now)
+
+	// a restarted generator with a clock that went backwards
+	restarted := New(1)
+	restarted.Observe(id)
+	if next := restarted.Next(now - int64(time.Minute)); next <= id {
+		t.Fatalf("ID %d reused after restart, last was %d", next, id)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"math/rand"
+	"os"
 	"time"
 
 	"github.com/highxshell/crypto-exchange/client"
@@ -13,7 +14,12 @@ func main() {
 	go server.StartServer()
 	time.Sleep(1 * time.Second)
 
+	// orders are placed with the API key of the user placing them
 	c := client.NewClient()
+	c.APIKey = os.Getenv("TRADER_API_KEY")
+	// the maker authenticates for the rate limits of its tier
+	makerClient := client.NewClient()
+	makerClient.APIKey = os.Getenv("MAKER_API_KEY")
 
 	cfg := marketmaker.Config{
 		UserID: 		8888,
@@ -21,7 +27,7 @@ func main() {
 		MinSpread: 		20,
 		MakeInterval: 	1 * time.Second,
 		SeedOffset: 	40,
-		ExchangeClient: c,	
+		ExchangeClient: makerClient,
 		PriceOffset: 	10,
 	}
 	maker := marketmaker.NewMarketMaker(cfg)
@@ -0,0 +1,195 @@
+package marketdata
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+)
+
+const (
+	Interval1m Interval = "1m"
+	Interval5m Interval = "5m"
+	Interval1h Interval = "1h"
+	Interval1d Interval = "1d"
+)
+
+type Interval string
+
+var intervalDurations = map[Interval]time.Duration{
+	Interval1m: 1 * time.Minute,
+	Interval5m: 5 * time.Minute,
+	Interval1h: 1 * time.Hour,
+	Interval1d: 24 * time.Hour,
+}
+
+// DefaultIntervals are the intervals aggregated for every market.
+var DefaultIntervals = []Interval{Interval1m, Interval5m, Interval1h, Interval1d}
+
+func ParseInterval(s string) (Interval, error) {
+	interval := Interval(s)
+	if _, ok := intervalDurations[interval]; !ok {
+		return "", fmt.Errorf("invalid interval: %s", s)
+	}
+
+	return interval, nil
+}
+
+func (i Interval) Duration() time.Duration {
+	return intervalDurations[i]
+}
+
+// Candle holds the OHLCV of the trades in [OpenTime, OpenTime+interval).
+// Times are unix nanoseconds like the timestamps of the trades.
+type Candle struct {
+	Interval Interval
+	OpenTime int64
+	Open     float64
+	High     float64
+	Low      float64
+	Close    float64
+	Volume   float64
+	Trades   int64
+	Closed   bool
+}
+
+func (c *Candle) add(trade *orderbook.Trade) {
+	if trade.Price > c.High {
+		c.High = trade.Price
+	}
+	if trade.Price < c.Low {
+		c.Low = trade.Price
+	}
+	c.Close = trade.Price
+	c.Volume += trade.Size
+	c.Trades++
+}
+
+type candleSeries struct {
+	closed  []Candle
+	current *Candle
+}
+
+// lastOpenTime returns the open time of the latest candle of the series.
+func (s *candleSeries) lastOpenTime() int64 {
+	if s.current != nil {
+		return s.current.OpenTime
+	}
+	if len(s.closed) > 0 {
+		return s.closed[len(s.closed)-1].OpenTime
+	}
+
+	return -1
+}
+
+// CandleAggregator builds the candles of a market from its trades. Trades
+// must be added in time order, trades older than the latest candle are
+// ignored so a backfill never counts a trade twice.
+type CandleAggregator struct {
+	mu      sync.RWMutex
+	series  map[Interval]*candleSeries
+	onClose func(Candle)
+}
+
+// NewCandleAggregator aggregates the intervals. onClose is called with
+// every candle that closes, e.g. to persist it.
+func NewCandleAggregator(intervals []Interval, onClose func(Candle)) *CandleAggregator {
+	series := make(map[Interval]*candleSeries)
+	for _, interval := range intervals {
+		series[interval] = &candleSeries{}
+	}
+
+	return &CandleAggregator{
+		series:  series,
+		onClose: onClose,
+	}
+}
+
+// Load adds closed candles, e.g. read back from the store, to the series.
+func (a *CandleAggregator) Load(candles []Candle) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, candle := range candles {
+		series, ok := a.series[candle.Interval]
+		if !ok || candle.OpenTime <= series.lastOpenTime() {
+			continue
+		}
+		candle.Closed = true
+		series.closed = append(series.closed, candle)
+	}
+}
+
+func (a *CandleAggregator) AddTrade(trade *orderbook.Trade) {
+	closed := []Candle{}
+
+	a.mu.Lock()
+	for interval, series := range a.series {
+		d := int64(interval.Duration())
+		openTime := trade.Timestamp - trade.Timestamp%d
+		if openTime < series.lastOpenTime() {
+			continue
+		}
+		if series.current != nil && series.current.OpenTime == openTime {
+			series.current.add(trade)
+			continue
+		}
+		if openTime == series.lastOpenTime() {
+			// the candle was loaded closed already
+			continue
+		}
+
+		if series.current != nil {
+			series.current.Closed = true
+			series.closed = append(series.closed, *series.current)
+			closed = append(closed, *series.current)
+		}
+		series.current = &Candle{
+			Interval: interval,
+			OpenTime: openTime,
+			Open:     trade.Price,
+			High:     trade.Price,
+			Low:      trade.Price,
+		}
+		series.current.add(trade)
+	}
+	a.mu.Unlock()
+
+	if a.onClose == nil {
+		return
+	}
+	for _, candle := range closed {
+		a.onClose(candle)
+	}
+}
+
+// Candles returns at most limit candles of the interval opened in
+// [from, to), oldest first, including the candle that is still open. When
+// there are more candles it also returns the open time to continue from.
+func (a *CandleAggregator) Candles(interval Interval, from, to int64, limit int) ([]Candle, int64, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	series, ok := a.series[interval]
+	if !ok {
+		return nil, 0, fmt.Errorf("interval not aggregated: %s", interval)
+	}
+
+	all := series.closed
+	if series.current != nil {
+		all = append(all[:len(all):len(all)], *series.current)
+	}
+
+	start := sort.Search(len(all), func(i int) bool { return all[i].OpenTime >= from })
+	candles := []Candle{}
+	for i := start; i < len(all) && all[i].OpenTime < to; i++ {
+		if len(candles) == limit {
+			return candles, all[i].OpenTime, nil
+		}
+		candles = append(candles, all[i])
+	}
+
+	return candles, 0, nil
+}
@@ -0,0 +1,90 @@
+package marketdata
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func trade(at time.Duration, price, size float64) *orderbook.Trade {
+	return &orderbook.Trade{
+		Price:     price,
+		Size:      size,
+		Timestamp: int64(at),
+	}
+}
+
+func TestCandleAggregation(t *testing.T) {
+	closed := []Candle{}
+	agg := NewCandleAggregator([]Interval{Interval1m, Interval5m}, func(c Candle) {
+		closed = append(closed, c)
+	})
+
+	agg.AddTrade(trade(10*time.Second, 100, 1))
+	agg.AddTrade(trade(20*time.Second, 110, 2))
+	agg.AddTrade(trade(30*time.Second, 90, 1))
+	agg.AddTrade(trade(50*time.Second, 95, 1))
+	agg.AddTrade(trade(3*time.Minute, 120, 4))
+
+	assert(t, len(closed), 1)
+	assert(t, closed[0], Candle{
+		Interval: Interval1m,
+		OpenTime: 0,
+		Open:     100,
+		High:     110,
+		Low:      90,
+		Close:    95,
+		Volume:   5,
+		Trades:   4,
+		Closed:   true,
+	})
+
+	candles, next, err := agg.Candles(Interval1m, 0, math.MaxInt64, 10)
+	assert(t, err, nil)
+	assert(t, next, int64(0))
+	assert(t, len(candles), 2)
+	assert(t, candles[1].OpenTime, int64(3*time.Minute))
+	assert(t, candles[1].Closed, false)
+
+	candles, _, _ = agg.Candles(Interval5m, 0, math.MaxInt64, 10)
+	assert(t, len(candles), 1)
+	assert(t, candles[0].Volume, 9.0)
+	assert(t, candles[0].High, 120.0)
+
+	// pagination
+	candles, next, _ = agg.Candles(Interval1m, 0, math.MaxInt64, 1)
+	assert(t, len(candles), 1)
+	assert(t, next, int64(3*time.Minute))
+	candles, next, _ = agg.Candles(Interval1m, next, math.MaxInt64, 1)
+	assert(t, candles[0].Open, 120.0)
+	assert(t, next, int64(0))
+
+	_, _, err = agg.Candles(Interval1h, 0, math.MaxInt64, 1)
+	assert(t, err != nil, true)
+}
+
+func TestCandleBackfillSkipsPersistedCandles(t *testing.T) {
+	persisted := Candle{Interval: Interval1m, OpenTime: 0, Open: 1, High: 1, Low: 1, Close: 1, Volume: 1, Trades: 1}
+	agg := NewCandleAggregator([]Interval{Interval1m}, nil)
+	agg.Load([]Candle{persisted})
+
+	// the first trade is already part of the persisted candle
+	agg.AddTrade(trade(10*time.Second, 1, 1))
+	agg.AddTrade(trade(70*time.Second, 2, 3))
+
+	candles, _, _ := agg.Candles(Interval1m, 0, math.MaxInt64, 10)
+	assert(t, len(candles), 2)
+	assert(t, candles[0].Volume, 1.0)
+	assert(t, candles[0].Closed, true)
+	assert(t, candles[1].Volume, 3.0)
+}
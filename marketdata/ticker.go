@@ -0,0 +1,116 @@
+package marketdata
+
+import (
+	"sync"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+)
+
+const TickerWindow = 24 * time.Hour
+
+// Ticker holds the statistics of the trades of a market in the rolling
+// window. Best bid and ask are filled in by the exchange from the book.
+type Ticker struct {
+	Market        string
+	LastPrice     float64
+	Change        float64
+	ChangePercent float64
+	High          float64
+	Low           float64
+	BaseVolume    float64
+	QuoteVolume   float64
+	VWAP          float64
+	Trades        int64
+	BestBid       float64
+	BestBidSize   float64
+	BestAsk       float64
+	BestAskSize   float64
+	Timestamp     int64
+}
+
+// TickerStats keeps the trades of a market in a rolling window. Volumes are
+// kept as running sums, trades leaving the window are subtracted.
+type TickerStats struct {
+	mu          sync.Mutex
+	window      int64
+	trades      []*orderbook.Trade
+	lastPrice   float64
+	baseVolume  float64
+	quoteVolume float64
+	now         func() int64
+}
+
+func NewTickerStats(window time.Duration) *TickerStats {
+	return &TickerStats{
+		window: int64(window),
+		trades: []*orderbook.Trade{},
+		now:    func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+func (s *TickerStats) AddTrade(trade *orderbook.Trade) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastPrice = trade.Price
+	s.trades = append(s.trades, trade)
+	s.baseVolume += trade.Size
+	s.quoteVolume += trade.Size * trade.Price
+	s.evict()
+}
+
+// evict drops the trades that left the window.
+func (s *TickerStats) evict() {
+	cutoff := s.now() - s.window
+	i := 0
+	for ; i < len(s.trades) && s.trades[i].Timestamp < cutoff; i++ {
+		s.baseVolume -= s.trades[i].Size
+		s.quoteVolume -= s.trades[i].Size * s.trades[i].Price
+	}
+	s.trades = s.trades[i:]
+	if len(s.trades) == 0 {
+		s.baseVolume = 0
+		s.quoteVolume = 0
+	}
+}
+
+// Ticker returns the statistics of the window ending now. The last price is
+// kept even when no trade happened in the window.
+func (s *TickerStats) Ticker(market string) Ticker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evict()
+
+	ticker := Ticker{
+		Market:      market,
+		LastPrice:   s.lastPrice,
+		BaseVolume:  s.baseVolume,
+		QuoteVolume: s.quoteVolume,
+		Trades:      int64(len(s.trades)),
+		Timestamp:   s.now(),
+	}
+	if len(s.trades) == 0 {
+		return ticker
+	}
+
+	open := s.trades[0].Price
+	ticker.Change = s.lastPrice - open
+	ticker.ChangePercent = ticker.Change / open * 100
+	ticker.High = open
+	ticker.Low = open
+	for _, trade := range s.trades {
+		if trade.Price > ticker.High {
+			ticker.High = trade.Price
+		}
+		if trade.Price < ticker.Low {
+			ticker.Low = trade.Price
+		}
+	}
+	if s.baseVolume > 0 {
+		ticker.VWAP = s.quoteVolume / s.baseVolume
+	}
+
+	return ticker
+}
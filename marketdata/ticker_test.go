@@ -0,0 +1,46 @@
+package marketdata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTickerRollingWindow(t *testing.T) {
+	now := int64(0)
+	stats := NewTickerStats(TickerWindow)
+	stats.now = func() int64 { return now }
+
+	now = int64(time.Hour)
+	stats.AddTrade(trade(time.Hour, 100, 1))
+	now = int64(2 * time.Hour)
+	stats.AddTrade(trade(2*time.Hour, 120, 3))
+	now = int64(3 * time.Hour)
+	stats.AddTrade(trade(3*time.Hour, 90, 1))
+
+	ticker := stats.Ticker("ETH")
+	assert(t, ticker.LastPrice, 90.0)
+	assert(t, ticker.Change, -10.0)
+	assert(t, ticker.ChangePercent, -10.0)
+	assert(t, ticker.High, 120.0)
+	assert(t, ticker.Low, 90.0)
+	assert(t, ticker.BaseVolume, 5.0)
+	assert(t, ticker.QuoteVolume, 550.0)
+	assert(t, ticker.VWAP, 110.0)
+	assert(t, ticker.Trades, int64(3))
+
+	// the first trade leaves the window
+	now = int64(25*time.Hour + time.Minute)
+	ticker = stats.Ticker("ETH")
+	assert(t, ticker.Change, -30.0)
+	assert(t, ticker.High, 120.0)
+	assert(t, ticker.BaseVolume, 4.0)
+	assert(t, ticker.QuoteVolume, 450.0)
+	assert(t, ticker.Trades, int64(2))
+
+	// the last price is kept once the window is empty
+	now = int64(30 * time.Hour)
+	ticker = stats.Ticker("ETH")
+	assert(t, ticker.LastPrice, 90.0)
+	assert(t, ticker.BaseVolume, 0.0)
+	assert(t, ticker.Trades, int64(0))
+}
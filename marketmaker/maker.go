@@ -1,9 +1,12 @@
 package marketmaker
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/highxshell/crypto-exchange/client"
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/server"
 	"go.uber.org/zap"
 )
 
@@ -25,8 +28,21 @@ type MarketMaker struct {
 	priceOffset		float64
 	exchangeClient 	*client.Client
 	makeInterval	time.Duration
+	// sessionID and orderSeq make the client order IDs of the maker unique
+	sessionID 		int64
+	orderSeq 		int64
+	// quotes are the IDs of the pegged quotes of each side, bid first
+	quotes 			[2]int64
 }
 
+// placeOrderAttempts is how many times an order is sent before giving up.
+// Retries reuse the client order ID so an order is never placed twice.
+const placeOrderAttempts = 3
+
+// cancelAfterIntervals is how many make intervals the maker may miss before
+// the exchange cancels its quotes.
+const cancelAfterIntervals = 3
+
 func NewMarketMaker(cfg Config) *MarketMaker {
 	return &MarketMaker{
 		userID: 		cfg.UserID,
@@ -36,6 +52,7 @@ func NewMarketMaker(cfg Config) *MarketMaker {
 		exchangeClient: cfg.ExchangeClient,
 		makeInterval: 	cfg.MakeInterval,
 		priceOffset: 	cfg.PriceOffset,
+		sessionID: 		time.Now().UnixNano(),
 	}
 }
 
@@ -60,6 +77,13 @@ func (mm *MarketMaker) makerLoop() {
 	ticker := time.NewTicker(mm.makeInterval)
 
 	for {
+		// keep the quotes alive only as long as the maker is
+		if _, err := mm.exchangeClient.CancelAfter(mm.userID, cancelAfterIntervals*mm.makeInterval); err != nil {
+			defer logger.Sync() 
+			sugar.Error(err)
+			break
+		}
+
 		bestBid, err := mm.exchangeClient.GetBestBid()
 		if err != nil {
 			defer logger.Sync() 
@@ -96,12 +120,14 @@ func (mm *MarketMaker) makerLoop() {
 			continue
 		}
 
-		if err := mm.placeOrder(true, bestBid.Price+mm.priceOffset); err != nil {
+		// the quotes follow the book on their own, only the quotes that
+		// were filled or canceled are placed again
+		if err := mm.quote(true, bestBid.Price+mm.priceOffset); err != nil {
 			defer logger.Sync() 
 			sugar.Error(err)
 			break
 		}
-		if err := mm.placeOrder(false, bestAsk.Price-mm.priceOffset); err != nil {
+		if err := mm.quote(false, bestAsk.Price-mm.priceOffset); err != nil {
 			defer logger.Sync() 
 			sugar.Error(err)
 			break
@@ -111,16 +137,62 @@ func (mm *MarketMaker) makerLoop() {
 	}
 }
 
-func (mm *MarketMaker) placeOrder(bid bool, price float64) error {
-	bidOrder := client.PlaceOrderParams{
-		UserID: mm.userID,
-		Size: 	mm.orderSize,
-		Bid: 	bid,
-		Price: 	price,
+// quote places a quote on the side unless the previous one is still open.
+// The quote is pegged priceOffset inside the best price of its side, the
+// exchange reprices it as the book moves. price is where it rests while its
+// side of the book is empty.
+func (mm *MarketMaker) quote(bid bool, price float64) error {
+	side := 0
+	offset := mm.priceOffset
+	if !bid {
+		side = 1
+		offset = -offset
 	}
-	_, err := mm.exchangeClient.PlaceLimitOrder(&bidOrder)
 
-	return err
+	if id := mm.quotes[side]; id != 0 {
+		order, err := mm.exchangeClient.GetOrder(id)
+		if err != nil {
+			return err
+		}
+		if order.Status.IsOpen() {
+			return nil
+		}
+	}
+
+	params := client.PlaceOrderParams{
+		UserID: 	mm.userID,
+		Size: 		mm.orderSize,
+		Bid: 		bid,
+		Price: 		price,
+		PostOnly: 	orderbook.PostOnlySlide,
+		Peg: 		&orderbook.Peg{Reference: orderbook.PegPrimary, Offset: offset},
+	}
+	resp, err := mm.placeLimitOrder(&params)
+	if err != nil {
+		return err
+	}
+	mm.quotes[side] = resp.OrderID
+
+	return nil
+}
+
+// placeLimitOrder sends the order with a new client order ID, retrying
+// failed requests with the same ID.
+func (mm *MarketMaker) placeLimitOrder(params *client.PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	mm.orderSeq++
+	params.ClientOrderID = fmt.Sprintf("mm-%d-%d-%d", mm.userID, mm.sessionID, mm.orderSeq)
+
+	var (
+		resp *server.PlaceOrderResponse
+		err  error
+	)
+	for i := 0; i < placeOrderAttempts; i++ {
+		if resp, err = mm.exchangeClient.PlaceLimitOrder(params); err == nil {
+			return resp, nil
+		}
+	}
+
+	return nil, err
 }
 
 func (mm *MarketMaker) seedMarket() error {
@@ -137,8 +209,7 @@ func (mm *MarketMaker) seedMarket() error {
 		Bid: 	true,
 		Price: 	currPrice - mm.seedOffset,
 	}
-	_, err := mm.exchangeClient.PlaceLimitOrder(&bidOrder)
-	if err != nil {
+	if _, err := mm.placeLimitOrder(&bidOrder); err != nil {
 		return err
 	}
 
@@ -148,8 +219,7 @@ func (mm *MarketMaker) seedMarket() error {
 		Bid: 	false,
 		Price: 	currPrice + mm.seedOffset,
 	}
-	_, err = mm.exchangeClient.PlaceLimitOrder(&askOrder)
-	
+	_, err := mm.placeLimitOrder(&askOrder)
 	return err
 }
 
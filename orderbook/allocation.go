@@ -0,0 +1,142 @@
+package orderbook
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// AllocationFIFO fills the orders of a level in time priority.
+	AllocationFIFO AllocationKind = "FIFO"
+	// AllocationProRata fills the orders of a level in proportion to their
+	// size.
+	AllocationProRata AllocationKind = "PRO_RATA"
+	// AllocationHybrid gives the first order of a level TopOrderPercent of
+	// the taker's size and allocates the rest pro-rata.
+	AllocationHybrid AllocationKind = "HYBRID"
+)
+
+type AllocationKind string
+
+// Allocation is the policy splitting the size a taker takes from a price
+// level between the resting orders of the level. The zero value is FIFO.
+// Pro-rata shares are rounded down to multiples of Lot, zero disables
+// rounding. Whatever rounding leaves over is filled in time priority.
+type Allocation struct {
+	Kind            AllocationKind
+	TopOrderPercent float64 `json:",omitempty"`
+	Lot             float64 `json:",omitempty"`
+}
+
+func (a Allocation) validate() error {
+	switch a.Kind {
+	case "", AllocationFIFO, AllocationProRata, AllocationHybrid:
+	default:
+		return fmt.Errorf("unknown allocation: %s", a.Kind)
+	}
+	if a.TopOrderPercent < 0 || a.TopOrderPercent > 100 {
+		return fmt.Errorf("invalid top order percent [%.2f]", a.TopOrderPercent)
+	}
+	if a.Lot < 0 {
+		return fmt.Errorf("invalid lot [%.2f]", a.Lot)
+	}
+
+	return nil
+}
+
+// allocate splits size between the orders, in the order of the level. rest
+// is the part of size the orders cannot fill.
+func (a Allocation) allocate(orders []*Order, size float64) (sizes []float64, rest float64) {
+	sizes = make([]float64, len(orders))
+
+	total := 0.0
+	for _, order := range orders {
+		total += order.Size
+	}
+	// sweeping the level fills every order whatever the policy
+	if a.Kind == "" || a.Kind == AllocationFIFO || size >= total {
+		return sizes, fillFIFO(orders, sizes, size)
+	}
+
+	remaining := size
+	if a.Kind == AllocationHybrid && len(orders) > 0 {
+		sizes[0] = math.Min(orders[0].Size, a.round(size*a.TopOrderPercent/100))
+		remaining -= sizes[0]
+		total -= sizes[0]
+	}
+
+	if total > 0 {
+		pool := remaining
+		for i, order := range orders {
+			share := a.round(pool * (order.Size - sizes[i]) / total)
+			share = math.Min(share, math.Min(order.Size-sizes[i], remaining))
+			sizes[i] += share
+			remaining -= share
+		}
+	}
+
+	return sizes, fillFIFO(orders, sizes, remaining)
+}
+
+// round rounds a pro-rata share down to a whole number of lots.
+func (a Allocation) round(size float64) float64 {
+	if a.Lot <= 0 {
+		return size
+	}
+
+	return math.Floor(size/a.Lot) * a.Lot
+}
+
+// fillFIFO adds size to the allocations in time priority and returns what
+// the orders cannot fill.
+func fillFIFO(orders []*Order, sizes []float64, size float64) float64 {
+	for i, order := range orders {
+		if size <= 0 {
+			break
+		}
+
+		open := order.Size - sizes[i]
+		if size >= open {
+			size -= open
+			sizes[i] = order.Size
+		} else {
+			sizes[i] += size
+			size = 0
+		}
+	}
+
+	return size
+}
+
+// SetAllocation makes the book allocate the size of takers with the policy
+// from now on. The change is journaled so replays allocate the same way.
+func (ob *Orderbook) SetAllocation(alloc Allocation) error {
+	if err := alloc.validate(); err != nil {
+		return err
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if alloc == ob.allocation {
+		return nil
+	}
+
+	cmd := Command{
+		Type:       CommandSetAllocation,
+		Allocation: &alloc,
+	}
+	ob.submit(&cmd)
+
+	ob.allocation = alloc
+
+	return nil
+}
+
+// Allocation returns the allocation policy of the book.
+func (ob *Orderbook) Allocation() Allocation {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.allocation
+}
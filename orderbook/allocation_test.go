@@ -0,0 +1,139 @@
+package orderbook
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func newLevel(sizes ...float64) *Limit {
+	l := NewLimit(10_000)
+	for i, size := range sizes {
+		order := NewOrder(false, size, int64(i+1))
+		order.ID = int64(i + 1)
+		order.Timestamp = int64(i + 1)
+		l.AddOrder(order)
+	}
+
+	return l
+}
+
+func filledSizes(matches []Match) map[int64]float64 {
+	filled := make(map[int64]float64)
+	for _, match := range matches {
+		filled[match.Ask.ID] += match.SizeFilled
+	}
+
+	return filled
+}
+
+func TestAllocation(t *testing.T) {
+	cases := []struct {
+		name  string
+		alloc Allocation
+		size  float64
+		want  map[int64]float64
+	}{
+		{"fifo", Allocation{}, 12, map[int64]float64{1: 10, 2: 2}},
+		{"pro rata", Allocation{Kind: AllocationProRata}, 10, map[int64]float64{1: 5, 2: 3, 3: 2}},
+		// 12 * (10, 6, 4) / 20 rounds down to (6, 3, 2), the lot left over
+		// goes to the first order with room
+		{"pro rata lots", Allocation{Kind: AllocationProRata, Lot: 1}, 12, map[int64]float64{1: 7, 2: 3, 3: 2}},
+		// the top order gets 5, the other 5 are split (5, 6, 4) / 15 and
+		// rounded down to (1, 2, 1)
+		{"hybrid", Allocation{Kind: AllocationHybrid, TopOrderPercent: 50, Lot: 1}, 10, map[int64]float64{1: 7, 2: 2, 3: 1}},
+		{"sweep", Allocation{Kind: AllocationProRata}, 30, map[int64]float64{1: 10, 2: 6, 3: 4}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := newLevel(10, 6, 4)
+			taker := NewOrder(true, c.size, 9)
+			matches := l.Fill(taker, c.alloc)
+
+			assert(t, filledSizes(matches), c.want)
+			want := math.Max(0, c.size-20)
+			assert(t, taker.Size, want)
+		})
+	}
+}
+
+// TestAllocationProperties checks on random levels that every policy fills
+// exactly what the taker takes and never more than a maker has left.
+func TestAllocationProperties(t *testing.T) {
+	const eps = 1e-9
+
+	rng := rand.New(rand.NewSource(1))
+	allocs := []Allocation{
+		{Kind: AllocationFIFO},
+		{Kind: AllocationProRata},
+		{Kind: AllocationProRata, Lot: 1},
+		{Kind: AllocationHybrid, TopOrderPercent: 40},
+		{Kind: AllocationHybrid, TopOrderPercent: 40, Lot: 0.5},
+		{Kind: AllocationHybrid, TopOrderPercent: 100, Lot: 3},
+	}
+
+	for i := 0; i < 10_000; i++ {
+		alloc := allocs[rng.Intn(len(allocs))]
+		sizes := make([]float64, 1+rng.Intn(8))
+		total := 0.0
+		for k := range sizes {
+			sizes[k] = float64(1 + rng.Intn(100))
+			if rng.Intn(2) == 0 {
+				sizes[k] += rng.Float64()
+			}
+			total += sizes[k]
+		}
+
+		l := newLevel(sizes...)
+		size := rng.Float64() * total * 1.2
+		taker := NewOrder(true, size, 9)
+		matches := l.Fill(taker, alloc)
+
+		filled := 0.0
+		for id, f := range filledSizes(matches) {
+			if f <= 0 || f > sizes[id-1]+eps {
+				t.Fatalf("%+v: order %d of size %v filled %v", alloc, id, sizes[id-1], f)
+			}
+			filled += f
+		}
+		if want := math.Min(size, total); math.Abs(filled-want) > eps {
+			t.Fatalf("%+v: filled %v of %v, want %v", alloc, filled, size, want)
+		}
+		if math.Abs(taker.Size-(size-filled)) > eps {
+			t.Fatalf("%+v: taker has %v left after filling %v of %v", alloc, taker.Size, filled, size)
+		}
+		if math.Abs(l.TotalVolume-(total-filled)) > eps {
+			t.Fatalf("%+v: level has %v left after filling %v of %v", alloc, l.TotalVolume, filled, total)
+		}
+		for _, order := range l.Orders {
+			if order.IsFilled() {
+				t.Fatalf("%+v: filled order %d stays in the level", alloc, order.ID)
+			}
+		}
+	}
+}
+
+func TestReplayAllocation(t *testing.T) {
+	journal := NewMemoryJournal()
+	live, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, live.SetAllocation(Allocation{Kind: "RANDOM"}) != nil, true)
+	if err := live.SetAllocation(Allocation{Kind: AllocationProRata}); err != nil {
+		t.Fatal(err)
+	}
+	live.PlaceLimitOrder(10_000, NewOrder(false, 10, 1))
+	live.PlaceLimitOrder(10_000, NewOrder(false, 30, 2))
+	live.PlaceMarketOrder(NewOrder(true, 8, 3))
+	assert(t, live.Trades[0].Size, 2.0)
+	assert(t, live.Trades[1].Size, 6.0)
+
+	replayed, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameBook(t, live, replayed)
+	assert(t, replayed.Allocation(), live.Allocation())
+}
@@ -0,0 +1,214 @@
+package orderbook
+
+import "math"
+
+// Auction is the result of uncrossing the book at Price. Volume is the size
+// that executes and Imbalance the bid volume minus the ask volume willing to
+// trade at the price, which is left unexecuted.
+type Auction struct {
+	Price     float64
+	Volume    float64
+	Imbalance float64
+}
+
+// InAuction reports whether the book is in a call period.
+func (ob *Orderbook) InAuction() bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.auction
+}
+
+// StartAuction starts a call period. Limit orders accumulate without
+// matching, even when they cross, and market orders are rejected until
+// Uncross.
+func (ob *Orderbook) StartAuction() {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.auction {
+		return
+	}
+
+	cmd := Command{Type: CommandStartAuction}
+	ob.submit(&cmd)
+
+	ob.auction = true
+}
+
+// IndicativeAuction returns the result the auction would have if the book
+// was uncrossed now, false when the book does not cross.
+func (ob *Orderbook) IndicativeAuction() (Auction, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.clearingPrice()
+}
+
+// Uncross ends the call period. Every crossing order executes at the single
+// clearing price, the rest of the book stays in place for continuous
+// trading.
+func (ob *Orderbook) Uncross() []Match {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if !ob.auction {
+		return []Match{}
+	}
+
+	cmd := Command{Type: CommandUncross}
+	ob.submit(&cmd)
+
+	trades := len(ob.Trades)
+	matches := ob.applyUncross(cmd)
+	ob.chargeFees(trades, matches)
+
+	defer logger.Sync()
+	if len(matches) > 0 {
+		sugar.Infow("uncrossed auction",
+			"price", 	matches[0].Price,
+			"matches", 	len(matches),
+		)
+	}
+
+	return matches
+}
+
+func (ob *Orderbook) applyUncross(cmd Command) []Match {
+	ob.auction = false
+
+	auction, ok := ob.clearingPrice()
+	if !ok {
+		return []Match{}
+	}
+
+	return ob.executeAuction(cmd.Timestamp, auction)
+}
+
+// clearingPrice picks the price executing the most volume. Ties go to the
+// smallest imbalance, then to the price closest to the last trade, then to
+// the lowest price.
+func (ob *Orderbook) clearingPrice() (Auction, bool) {
+	bids := sortedLimits(ob.bids, true)
+	asks := sortedLimits(ob.asks, false)
+	if len(bids) == 0 || len(asks) == 0 || bids[0].Price < asks[0].Price {
+		return Auction{}, false
+	}
+
+	reference := 0.0
+	if n := len(ob.Trades); n > 0 {
+		reference = ob.Trades[n-1].Price
+	}
+
+	candidates := []float64{}
+	for _, limit := range append(bids, asks...) {
+		if limit.Price >= asks[0].Price && limit.Price <= bids[0].Price {
+			candidates = append(candidates, limit.Price)
+		}
+	}
+
+	var best Auction
+	for i, price := range candidates {
+		bidVolume, askVolume := 0.0, 0.0
+		for _, limit := range bids {
+			if limit.Price >= price {
+				bidVolume += limit.TotalVolume
+			}
+		}
+		for _, limit := range asks {
+			if limit.Price <= price {
+				askVolume += limit.TotalVolume
+			}
+		}
+		auction := Auction{
+			Price:     price,
+			Volume:    math.Min(bidVolume, askVolume),
+			Imbalance: bidVolume - askVolume,
+		}
+		if i == 0 || auction.better(best, reference) {
+			best = auction
+		}
+	}
+
+	return best, true
+}
+
+func (a Auction) better(b Auction, reference float64) bool {
+	if a.Volume != b.Volume {
+		return a.Volume > b.Volume
+	}
+	if math.Abs(a.Imbalance) != math.Abs(b.Imbalance) {
+		return math.Abs(a.Imbalance) < math.Abs(b.Imbalance)
+	}
+	if reference > 0 && math.Abs(a.Price-reference) != math.Abs(b.Price-reference) {
+		return math.Abs(a.Price-reference) < math.Abs(b.Price-reference)
+	}
+
+	return a.Price < b.Price
+}
+
+// auctionOrders returns the orders willing to trade at the price in
+// price-time priority.
+func auctionOrders(limits []*Limit, price float64, bid bool) []*Order {
+	orders := []*Order{}
+	for _, limit := range limits {
+		if (bid && limit.Price < price) || (!bid && limit.Price > price) {
+			break
+		}
+		orders = append(orders, limit.Orders...)
+	}
+
+	return orders
+}
+
+// executeAuction pairs off the crossing orders at the clearing price. The
+// order that rested first is the maker of each trade.
+func (ob *Orderbook) executeAuction(timestamp int64, auction Auction) []Match {
+	bids := auctionOrders(sortedLimits(ob.bids, true), auction.Price, true)
+	asks := auctionOrders(sortedLimits(ob.asks, false), auction.Price, false)
+
+	var (
+		matches   = []Match{}
+		filled    = []*Order{}
+		remaining = auction.Volume
+		i, j      int
+	)
+	for remaining > 0 && i < len(bids) && j < len(asks) {
+		bid, ask := bids[i], asks[j]
+		size := math.Min(remaining, math.Min(bid.Size, ask.Size))
+
+		bid.Size -= size
+		ask.Size -= size
+		bid.Limit.TotalVolume -= size
+		ask.Limit.TotalVolume -= size
+		remaining -= size
+
+		maker, taker := bid, ask
+		if ask.Timestamp < bid.Timestamp || (ask.Timestamp == bid.Timestamp && ask.ID < bid.ID) {
+			maker, taker = ask, bid
+		}
+		match := Match{
+			Bid:        bid,
+			Ask:        ask,
+			SizeFilled: size,
+			Price:      auction.Price,
+		}
+		ob.recordTrade(timestamp, maker, taker, &match)
+		matches = append(matches, match)
+
+		if bid.IsFilled() {
+			filled = append(filled, bid)
+			i++
+		}
+		if ask.IsFilled() {
+			filled = append(filled, ask)
+			j++
+		}
+	}
+
+	for _, order := range filled {
+		ob.removeFromLimit(order)
+	}
+
+	return matches
+}
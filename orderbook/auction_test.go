@@ -0,0 +1,89 @@
+package orderbook
+
+import "testing"
+
+func TestAuctionUncross(t *testing.T) {
+	ob := NewOrderBook()
+	ob.StartAuction()
+
+	bidA := NewOrder(true, 5, 1)
+	bidB := NewOrder(true, 5, 2)
+	askA := NewOrder(false, 4, 3)
+	askB := NewOrder(false, 4, 4)
+	ob.PlaceLimitOrder(102, bidA)
+	ob.PlaceLimitOrder(100, bidB)
+	ob.PlaceLimitOrder(99, askA)
+	ob.PlaceLimitOrder(101, askB)
+
+	// crossing orders rest and market orders are rejected
+	assert(t, ob.BidTotalVolume(), 10.0)
+	market := NewOrder(true, 1, 5)
+	assert(t, len(ob.PlaceMarketOrder(market)), 0)
+	assert(t, market.Status, StatusRejected)
+
+	// at 101 bids of 5 meet asks of 8, at 100 and 99 bids of 10 meet asks
+	// of 4, the most volume executes at 101
+	auction, ok := ob.IndicativeAuction()
+	assert(t, ok, true)
+	assert(t, auction, Auction{Price: 101, Volume: 5, Imbalance: -3})
+
+	matches := ob.Uncross()
+	assert(t, ob.InAuction(), false)
+	assert(t, len(matches), 2)
+	for _, match := range matches {
+		assert(t, match.Price, 101.0)
+		assert(t, match.Bid, bidA)
+	}
+	assert(t, matches[0].Ask, askA)
+	assert(t, matches[0].SizeFilled, 4.0)
+	assert(t, matches[1].Ask, askB)
+	assert(t, matches[1].SizeFilled, 1.0)
+
+	// the order that rested first is the maker
+	assert(t, ob.Trades[0].MakerOrderID, bidA.ID)
+	assert(t, ob.Trades[0].Bid, false)
+	assert(t, bidA.Status, StatusFilled)
+	assert(t, askB.Status, StatusPartiallyFilled)
+	assert(t, askB.Size, 3.0)
+	assert(t, ob.Asks()[0].Price, 101.0)
+	assert(t, ob.Bids()[0].Price, 100.0)
+	_, ok = ob.IndicativeAuction()
+	assert(t, ok, false)
+}
+
+func TestAuctionTieBreaks(t *testing.T) {
+	ob := NewOrderBook()
+	ob.StartAuction()
+	ob.PlaceLimitOrder(105, NewOrder(true, 5, 1))
+	ob.PlaceLimitOrder(100, NewOrder(false, 5, 2))
+
+	// volume and imbalance are the same at both prices, without a last
+	// trade the lowest price wins
+	auction, _ := ob.IndicativeAuction()
+	assert(t, auction.Price, 100.0)
+
+	ob.Trades = append(ob.Trades, &Trade{Price: 104})
+	auction, _ = ob.IndicativeAuction()
+	assert(t, auction.Price, 105.0)
+}
+
+func TestReplayAuction(t *testing.T) {
+	journal := NewMemoryJournal()
+	live, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.StartAuction()
+	live.PlaceLimitOrder(100, NewOrder(true, 5, 1))
+	live.PlaceLimitOrder(99, NewOrder(false, 3, 2))
+	live.Uncross()
+	live.StartAuction()
+
+	replayed, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameBook(t, live, replayed)
+	assert(t, replayed.InAuction(), true)
+	assert(t, replayed.Snapshot().Auction, true)
+}
@@ -0,0 +1,82 @@
+package orderbook
+
+// FeeSchedule computes the fees of the maker and the taker of a trade. Fees
+// are charged in the base asset, a negative fee is a rebate paid to the
+// user.
+type FeeSchedule interface {
+	Fees(trade *Trade) (makerFee, takerFee float64)
+}
+
+// SetFeeSchedule makes the book charge the fees of the schedule on every
+// trade from now on. Without a schedule trades are free. The fees are
+// journaled, replays never call the schedule.
+func (ob *Orderbook) SetFeeSchedule(fees FeeSchedule) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.fees = fees
+}
+
+// TradeFees are the fees charged for a trade, see CommandChargeFees.
+type TradeFees struct {
+	TradeID  int64
+	MakerFee float64
+	TakerFee float64
+}
+
+// chargeFees computes the fees of the trades recorded since the trade at
+// index from and journals them before they are applied. The schedule depends
+// on state outside of the book, e.g. the volume of the users, so replays
+// apply the journaled fees instead of computing them again.
+func (ob *Orderbook) chargeFees(from int, matches []Match) {
+	if ob.fees == nil || from >= len(ob.Trades) {
+		return
+	}
+
+	cmd := Command{Type: CommandChargeFees}
+	for _, trade := range ob.Trades[from:] {
+		makerFee, takerFee := ob.fees.Fees(trade)
+		cmd.Fees = append(cmd.Fees, TradeFees{
+			TradeID:  trade.ID,
+			MakerFee: makerFee,
+			TakerFee: takerFee,
+		})
+	}
+	ob.submit(&cmd)
+	ob.applyChargeFees(cmd)
+
+	trades := make(map[int64]*Trade, len(cmd.Fees))
+	for _, trade := range ob.Trades[from:] {
+		trades[trade.ID] = trade
+	}
+	for i := range matches {
+		if trade, ok := trades[matches[i].TradeID]; ok {
+			matches[i].setFees(trade)
+		}
+	}
+}
+
+func (ob *Orderbook) applyChargeFees(cmd Command) {
+	fees := make(map[int64]TradeFees, len(cmd.Fees))
+	for _, f := range cmd.Fees {
+		fees[f.TradeID] = f
+	}
+
+	// the trades of the command are the latest ones
+	for i := len(ob.Trades) - 1; i >= 0 && len(fees) > 0; i-- {
+		trade := ob.Trades[i]
+		if f, ok := fees[trade.ID]; ok {
+			trade.MakerFee, trade.TakerFee = f.MakerFee, f.TakerFee
+			delete(fees, trade.ID)
+		}
+	}
+}
+
+// setFees charges the fees of the trade to the orders of the match.
+func (m *Match) setFees(trade *Trade) {
+	m.AskFee, m.BidFee = trade.MakerFee, trade.TakerFee
+	if trade.Bid {
+		return
+	}
+	m.AskFee, m.BidFee = trade.TakerFee, trade.MakerFee
+}
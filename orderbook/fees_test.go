@@ -0,0 +1,45 @@
+package orderbook
+
+import "testing"
+
+type flatFees struct {
+	maker, taker float64
+}
+
+func (f flatFees) Fees(trade *Trade) (float64, float64) {
+	return trade.Size * f.maker, trade.Size * f.taker
+}
+
+func TestReplayKeepsJournaledFees(t *testing.T) {
+	journal := NewMemoryJournal()
+	ob, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob.SetFeeSchedule(flatFees{maker: 0.001, taker: 0.002})
+
+	ob.PlaceLimitOrder(10_000, NewOrder(false, 5, 1))
+	matches := ob.PlaceMarketOrder(NewOrder(true, 2, 2))
+	assert(t, matches[0].AskFee, 0.002)
+	assert(t, matches[0].BidFee, 0.004)
+
+	// the schedule changes, e.g. when the users reach another tier
+	ob.SetFeeSchedule(flatFees{maker: -0.001, taker: 0.001})
+	ob.PlaceLimitOrder(9_000, NewOrder(true, 5, 1))
+	matches = ob.PlaceMarketOrder(NewOrder(false, 1, 3))
+	assert(t, matches[0].BidFee, -0.001)
+	assert(t, matches[0].AskFee, 0.001)
+
+	// a replay without a schedule charges the fees of the journal
+	replayed, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameBook(t, ob, replayed)
+	assert(t, len(replayed.Trades), 2)
+	for i, trade := range replayed.Trades {
+		assert(t, *trade, *ob.Trades[i])
+	}
+	assert(t, replayed.Trades[0].TakerFee, 0.004)
+	assert(t, replayed.Trades[1].MakerFee, -0.001)
+}
@@ -0,0 +1,357 @@
+package orderbook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const DefaultSegmentSize = 10_000
+
+const (
+	CommandPlaceLimit  CommandType = "PLACE_LIMIT"
+	CommandPlaceMarket CommandType = "PLACE_MARKET"
+	CommandCancel      CommandType = "CANCEL"
+	CommandAmend       CommandType = "AMEND"
+	// CommandStartAuction and CommandUncross start and end a call period.
+	CommandStartAuction CommandType = "START_AUCTION"
+	CommandUncross      CommandType = "UNCROSS"
+	// CommandSetAllocation changes the allocation policy of the book.
+	CommandSetAllocation CommandType = "SET_ALLOCATION"
+	// CommandSetTickSize changes the tick size of the book to Price.
+	CommandSetTickSize CommandType = "SET_TICK_SIZE"
+	// CommandChargeFees records the fees of the trades of the command
+	// before it.
+	CommandChargeFees CommandType = "CHARGE_FEES"
+)
+
+// ErrJournal is what the book panics with when a command cannot be
+// journaled. The command has not been applied.
+var ErrJournal = errors.New("failed to journal command")
+
+type CommandType string
+
+// Command is an input of the matching engine. Applying the same commands in
+// the same order always results in the same orderbook.
+type Command struct {
+	Seq       int64
+	Type      CommandType
+	OrderID   int64
+	UserID    int64
+	Bid       bool
+	Size      float64
+	Price     float64
+	Timestamp int64
+	// ClientOrderID is the ID the user gave to a new order.
+	ClientOrderID string   `json:",omitempty"`
+	PostOnly      PostOnly `json:",omitempty"`
+	ReduceOnly    bool     `json:",omitempty"`
+	Peg           *Peg     `json:",omitempty"`
+	// Allocation is the policy set by CommandSetAllocation.
+	Allocation *Allocation `json:",omitempty"`
+	// Fees are the fees charged by CommandChargeFees.
+	Fees []TradeFees `json:",omitempty"`
+}
+
+func (cmd *Command) newOrder() bool {
+	return cmd.Type == CommandPlaceLimit || cmd.Type == CommandPlaceMarket
+}
+
+// Journal is an append-only log of the commands applied to an orderbook.
+type Journal interface {
+	Append(Command) error
+	// Replay calls fn for every command with a sequence number greater than
+	// from, in sequence order.
+	Replay(from int64, fn func(Command) error) error
+	// Prune discards the commands up to seq once they are covered by a
+	// snapshot.
+	Prune(seq int64) error
+}
+
+type MemoryJournal struct {
+	mu       sync.RWMutex
+	commands []Command
+}
+
+func NewMemoryJournal() *MemoryJournal {
+	return &MemoryJournal{}
+}
+
+func (j *MemoryJournal) Append(cmd Command) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.commands = append(j.commands, cmd)
+	return nil
+}
+
+func (j *MemoryJournal) Replay(from int64, fn func(Command) error) error {
+	j.mu.RLock()
+	commands := make([]Command, len(j.commands))
+	copy(commands, j.commands)
+	j.mu.RUnlock()
+
+	for _, cmd := range commands {
+		if cmd.Seq <= from {
+			continue
+		}
+		if err := fn(cmd); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *MemoryJournal) Prune(seq int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	i := sort.Search(len(j.commands), func(i int) bool { return j.commands[i].Seq > seq })
+	j.commands = j.commands[i:]
+
+	return nil
+}
+
+// FileJournal is a Journal stored in a directory of segment files with one
+// JSON encoded command per line. A new segment is started every
+// SegmentSize commands, named after the sequence number of its first
+// command, so segments covered by a snapshot can be pruned. Every command is
+// synced to disk before Append returns.
+type FileJournal struct {
+	mu              sync.Mutex
+	dir             string
+	SegmentSize     int
+	f               *os.File
+	segmentCommands int
+	readOnly        bool
+}
+
+type segment struct {
+	firstSeq int64
+	path     string
+}
+
+func NewFileJournal(dir string) (*FileJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &FileJournal{
+		dir:         dir,
+		SegmentSize: DefaultSegmentSize,
+	}
+
+	segments, err := j.segments()
+	if err != nil {
+		return nil, err
+	}
+	if len(segments) == 0 {
+		return j, nil
+	}
+
+	f, err := os.OpenFile(segments[len(segments)-1].path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	commands, err := truncateTornTail(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	j.f = f
+	j.segmentCommands = commands
+
+	return j, nil
+}
+
+// OpenFileJournalReadOnly opens the journal in dir for replaying only, e.g.
+// while the exchange keeps appending to it.
+func OpenFileJournalReadOnly(dir string) *FileJournal {
+	return &FileJournal{
+		dir:      dir,
+		readOnly: true,
+	}
+}
+
+func segmentName(firstSeq int64) string {
+	return fmt.Sprintf("%020d.journal", firstSeq)
+}
+
+// segments returns the segments of the journal ordered by sequence number.
+func (j *FileJournal) segments() ([]segment, error) {
+	paths, err := filepath.Glob(filepath.Join(j.dir, "*.journal"))
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []segment{}
+	for _, path := range paths {
+		firstSeq, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(path), ".journal"), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{firstSeq, path})
+	}
+	sort.Slice(segments, func(i, k int) bool { return segments[i].firstSeq < segments[k].firstSeq })
+
+	return segments, nil
+}
+
+// truncateTornTail removes a partially written command from the end of the
+// segment so new commands start on a line of their own. It returns the
+// number of complete commands in the segment.
+func truncateTornTail(f *os.File) (int, error) {
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return 0, err
+	}
+
+	commands := bytes.Count(b, []byte{'\n'})
+	if len(b) == 0 || b[len(b)-1] == '\n' {
+		return commands, nil
+	}
+
+	return commands, f.Truncate(int64(bytes.LastIndexByte(b, '\n') + 1))
+}
+
+func (j *FileJournal) Append(cmd Command) error {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.readOnly {
+		return fmt.Errorf("journal %s is read only", j.dir)
+	}
+	if j.f == nil || j.segmentCommands >= j.SegmentSize {
+		if err := j.rotate(cmd.Seq); err != nil {
+			return err
+		}
+	}
+
+	if _, err := j.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	j.segmentCommands++
+
+	return j.f.Sync()
+}
+
+func (j *FileJournal) rotate(firstSeq int64) error {
+	if j.f != nil {
+		if err := j.f.Close(); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(filepath.Join(j.dir, segmentName(firstSeq)), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.segmentCommands = 0
+
+	return nil
+}
+
+// Replay reads the journal from disk, skipping the segments that only hold
+// commands up to from. A torn command at the end of the journal, left behind
+// by a crash in the middle of a write, was never applied and is ignored.
+func (j *FileJournal) Replay(from int64, fn func(Command) error) error {
+	segments, err := j.segments()
+	if err != nil {
+		return err
+	}
+
+	for i, seg := range segments {
+		if i+1 < len(segments) && segments[i+1].firstSeq-1 <= from {
+			continue
+		}
+		if err := replaySegment(seg.path, from, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func replaySegment(path string, from int64, fn func(Command) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var cmd Command
+		if err := json.Unmarshal(bytes.TrimSpace(line), &cmd); err != nil {
+			return err
+		}
+		if cmd.Seq <= from {
+			continue
+		}
+		if err := fn(cmd); err != nil {
+			return err
+		}
+	}
+}
+
+// Prune removes the segments that only hold commands up to seq. The segment
+// that is currently written to is never removed.
+func (j *FileJournal) Prune(seq int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.readOnly {
+		return fmt.Errorf("journal %s is read only", j.dir)
+	}
+
+	segments, err := j.segments()
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(segments)-1; i++ {
+		if segments[i+1].firstSeq-1 > seq {
+			break
+		}
+		if err := os.Remove(segments[i].path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil {
+		return nil
+	}
+
+	return j.f.Close()
+}
@@ -0,0 +1,149 @@
+package orderbook
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func placeJournaledCommands(t *testing.T, ob *Orderbook) {
+	askA := NewOrder(false, 10, 1)
+	askB := NewOrder(false, 5, 2)
+	bidA := NewOrder(true, 8, 3)
+	bidB := NewOrder(true, 4, 4)
+	ob.PlaceLimitOrder(10_000, askA)
+	ob.PlaceLimitOrder(10_000, askB)
+	ob.PlaceLimitOrder(9_000, bidA)
+	ob.PlaceLimitOrder(8_000, bidB)
+
+	ob.PlaceMarketOrder(NewOrder(true, 12, 5))
+	ob.CancelOrder(bidB)
+	if err := ob.AmendOrder(bidA.ID, 9_500, 6); err != nil {
+		t.Fatal(err)
+	}
+	ob.PlaceLimitOrder(9_500, NewOrder(true, 1, 6))
+	ob.PlaceMarketOrder(NewOrder(false, 2, 7))
+}
+
+func assertSameBook(t *testing.T, a, b *Orderbook) {
+	assert(t, a.LastSeq(), b.LastSeq())
+	assert(t, a.Asks(), b.Asks())
+	assert(t, a.Bids(), b.Bids())
+	assert(t, a.Orders, b.Orders)
+	assert(t, a.Trades, b.Trades)
+}
+
+func TestSequencerAssignsIDs(t *testing.T) {
+	ob := NewOrderBook()
+	orderA := NewOrder(false, 10, 0)
+	orderB := NewOrder(false, 10, 0)
+	ob.PlaceLimitOrder(10_000, orderA)
+	ob.PlaceLimitOrder(10_000, orderB)
+
+	assert(t, orderA.ID != 0, true)
+	assert(t, orderB.ID > orderA.ID, true)
+	assert(t, orderB.Timestamp > orderA.Timestamp, true)
+	assert(t, ob.LastSeq(), int64(2))
+}
+
+// TestSequencerOrderIDsNeverCollide sequences millions of orders with a clock
+// that stands still, so IDs must come from the sequence bits alone.
+func TestSequencerOrderIDsNeverCollide(t *testing.T) {
+	const n = 3_000_000
+
+	seq := NewSequencer(1)
+	seq.clock = func() int64 { return 1 }
+
+	seen := make(map[int64]struct{}, n)
+	var last int64
+	for i := 0; i < n; i++ {
+		cmd := Command{Type: CommandPlaceLimit}
+		seq.Next(&cmd)
+
+		if _, ok := seen[cmd.OrderID]; ok {
+			t.Fatalf("order ID %d assigned twice", cmd.OrderID)
+		}
+		if cmd.OrderID <= last {
+			t.Fatalf("order ID %d is not greater than %d", cmd.OrderID, last)
+		}
+		seen[cmd.OrderID] = struct{}{}
+		last = cmd.OrderID
+	}
+}
+
+func TestAmendOrder(t *testing.T) {
+	ob := NewOrderBook()
+	orderA := NewOrder(true, 10, 0)
+	orderB := NewOrder(true, 10, 0)
+	ob.PlaceLimitOrder(10_000, orderA)
+	ob.PlaceLimitOrder(10_000, orderB)
+
+	// reducing the size keeps the priority
+	ob.AmendOrder(orderA.ID, 10_000, 4)
+	assert(t, ob.Bids()[0].Orders[0], orderA)
+	assert(t, ob.BidTotalVolume(), 14.0)
+
+	// increasing the size loses the priority
+	ob.AmendOrder(orderA.ID, 10_000, 6)
+	assert(t, ob.Bids()[0].Orders[0], orderB)
+	assert(t, ob.BidTotalVolume(), 16.0)
+
+	ob.AmendOrder(orderB.ID, 9_000, 10)
+	assert(t, len(ob.bids), 2)
+	assert(t, ob.Bids()[1].Orders[0], orderB)
+
+	assert(t, ob.AmendOrder(12345, 9_000, 10) != nil, true)
+}
+
+func TestReplayJournal(t *testing.T) {
+	journal := NewMemoryJournal()
+	live, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeJournaledCommands(t, live)
+
+	replayed, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameBook(t, live, replayed)
+}
+
+func TestReplayFileJournal(t *testing.T) {
+	dir := t.TempDir()
+	journal, err := NewFileJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeJournaledCommands(t, live)
+	journal.Close()
+
+	// simulate a crash in the middle of a write
+	f, err := os.OpenFile(filepath.Join(dir, segmentName(1)), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Seq":12,"Type":"PLACE`)
+	f.Close()
+
+	journal, err = NewFileJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	replayed, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameBook(t, live, replayed)
+
+	// new orders continue the sequence of the journal
+	order := NewOrder(true, 1, 0)
+	replayed.PlaceLimitOrder(9_000, order)
+	assert(t, replayed.LastSeq(), live.LastSeq()+1)
+}
@@ -2,28 +2,68 @@ package orderbook
 
 import (
 	"fmt"
-	"math/rand"
 	"sort"
 	"sync"
-	"time"
 
+	"github.com/highxshell/crypto-exchange/idgen"
 	"go.uber.org/zap"
 )
 
+// Trade is a fill between a resting (maker) order and an incoming (taker)
+// order. Bid is the side of the taker.
 type Trade struct {
-	Price 		float64
-	Size		float64
-	Bid 		bool
-	Timestamp 	int64
+	ID 				int64
+	MakerOrderID 	int64
+	TakerOrderID 	int64
+	MakerUserID 	int64
+	TakerUserID 	int64
+	Price 			float64
+	Size			float64
+	Bid 			bool
+	Timestamp 		int64
+	// MakerFee and TakerFee are the fees charged to the users, negative for
+	// rebates.
+	MakerFee 		float64
+	TakerFee 		float64
 }
 
 type Match struct{
+	// TradeID is the ID of the trade recorded for the match.
+	TradeID 	int64
 	Ask 		*Order
 	Bid 		*Order
 	SizeFilled 	float64
 	Price 		float64
+	// AskFee and BidFee are the fees charged to the users of the orders,
+	// negative for rebates.
+	AskFee 		float64
+	BidFee 		float64
+}
+
+const (
+	StatusNew 				OrderStatus = "NEW"
+	StatusPartiallyFilled 	OrderStatus = "PARTIALLY_FILLED"
+	StatusFilled 			OrderStatus = "FILLED"
+	StatusCanceled 			OrderStatus = "CANCELED"
+	StatusRejected 			OrderStatus = "REJECTED"
+	// StatusExpired is for orders removed by the exchange at the end of
+	// their lifetime.
+	StatusExpired 			OrderStatus = "EXPIRED"
+	// StatusPending is for conditional orders held by the exchange until
+	// they trigger. They are not in the book yet.
+	StatusPending 			OrderStatus = "PENDING"
+)
+
+type OrderStatus string
+
+// IsOpen reports whether an order in this status can still trade.
+func (s OrderStatus) IsOpen() bool {
+	return s == StatusNew || s == StatusPartiallyFilled
 }
 
+// Order is an order of the book. Size is the remaining size, FilledSize and
+// AvgPrice describe what has been filled so far. UpdatedAt is the timestamp
+// of the command that last changed the order.
 type Order struct {
 	ID		 	int64
 	UserID		int64
@@ -31,6 +71,18 @@ type Order struct {
 	Bid       	bool
 	Limit     	*Limit
 	Timestamp 	int64
+	// ClientOrderID is the optional ID given to the order by its user.
+	ClientOrderID string
+	PostOnly 	PostOnly
+	// ReduceOnly orders may only reduce the position of the user. The book
+	// does not know positions, the exchange enforces the flag.
+	ReduceOnly 	bool
+	// Peg makes the book reprice the order as the top of the book moves.
+	Peg 		*Peg
+	Status 		OrderStatus
+	FilledSize 	float64
+	AvgPrice 	float64
+	UpdatedAt 	int64
 }
 
 type Orders []*Order
@@ -45,13 +97,13 @@ func (o Orders) Swap(i, j int) {o[i], o[j] = o[j], o[i]}
 func (o Orders) Less(i, j int) bool {return o[i].Timestamp < o[j].Timestamp}
 
 
+// NewOrder creates an order without an ID and timestamp. Both are assigned
+// by the sequencer of the orderbook the order is placed in.
 func NewOrder(bid bool, size float64, userID int64) *Order {
 	return &Order{
 		UserID: 	userID,
-		ID: 		int64(rand.Intn(100000000)),
 		Size:     	size,
 		Bid:       	bid,
-		Timestamp: 	time.Now().UnixNano(),
 	}
 }
 
@@ -71,6 +123,37 @@ func (o *Order) IsFilled() bool {
 	return o.Size == 0.0
 }
 
+// recordFill updates the fill state of the order after size was filled at
+// price. The remaining size has already been reduced by the limit.
+func (o *Order) recordFill(size, price float64, timestamp int64) {
+	o.AvgPrice = (o.AvgPrice*o.FilledSize + price*size) / (o.FilledSize + size)
+	o.FilledSize += size
+	o.UpdatedAt = timestamp
+
+	if o.IsFilled() {
+		o.Status = StatusFilled
+	} else {
+		o.Status = StatusPartiallyFilled
+	}
+}
+
+// open resets the state of an order accepted by the book.
+func (o *Order) open(cmd Command) {
+	o.ID = cmd.OrderID
+	o.UserID = cmd.UserID
+	o.Bid = cmd.Bid
+	o.Size = cmd.Size
+	o.Timestamp = cmd.Timestamp
+	o.ClientOrderID = cmd.ClientOrderID
+	o.PostOnly = cmd.PostOnly
+	o.ReduceOnly = cmd.ReduceOnly
+	o.Peg = cmd.Peg
+	o.Status = StatusNew
+	o.FilledSize = 0
+	o.AvgPrice = 0
+	o.UpdatedAt = cmd.Timestamp
+}
+
 type Limit struct {
 	Price       float64
 	Orders      Orders
@@ -116,17 +199,20 @@ func (l *Limit) DeleteOrder(o *Order) {
 	sort.Sort(l.Orders)	
 }
 
-func (l *Limit) Fill(o *Order) []Match {
+// Fill fills the order against the orders of the limit, splitting its size
+// between them by the allocation policy.
+func (l *Limit) Fill(o *Order, alloc Allocation) []Match {
 	var (
 		matches = []Match{}
 		ordersToDelete []*Order
 	)
-	for _, order := range l.Orders {
-		if o.IsFilled() {
-			break
+	sizes, rest := alloc.allocate(l.Orders, o.Size)
+	for i, order := range l.Orders {
+		if sizes[i] == 0 {
+			continue
 		}
 
-		match := l.fillOrder(order, o)
+		match := l.fillOrder(order, o, sizes[i])
 		matches = append(matches, match)
 
 		l.TotalVolume -= match.SizeFilled
@@ -135,6 +221,7 @@ func (l *Limit) Fill(o *Order) []Match {
 			ordersToDelete = append(ordersToDelete, order)
 		}
 	}
+	o.Size = rest
 
 	for _, order := range ordersToDelete {
 		l.DeleteOrder(order)
@@ -143,11 +230,12 @@ func (l *Limit) Fill(o *Order) []Match {
 	return matches
 }
 
-func (l *Limit) fillOrder(a, b *Order) Match {
+// fillOrder fills size of the resting order a against the taker b. The size
+// of the taker is updated by Fill.
+func (l *Limit) fillOrder(a, b *Order, size float64) Match {
 	var (
 		bid *Order
 		ask *Order
-		sizeFilled float64
 	)
 
 	if a.Bid {
@@ -158,20 +246,12 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 		bid = b
 		ask = a
 	}
-	if a.Size >= b.Size {
-		a.Size -= b.Size
-		sizeFilled = b.Size
-		b.Size = 0.0
-	} else {
-		b.Size -= a.Size
-		sizeFilled = a.Size
-		a.Size = 0.0
-	}
+	a.Size -= size
 
 	return Match{
 		Bid: bid,
 		Ask: ask,
-		SizeFilled: sizeFilled,
+		SizeFilled: size,
 		Price: l.Price,
 	}
 }
@@ -186,9 +266,28 @@ type Orderbook struct {
 	AskLimits 	map[float64]*Limit
 	BidLimits 	map[float64]*Limit
 	Orders 		map[int64]*Order
+
+	sequencer 	*Sequencer
+	tradeIDs 	*idgen.Generator
+	journal 	Journal
+	fees 		FeeSchedule
+	// auction is set during a call period
+	auction 	bool
+	allocation 	Allocation
+	tickSize 	float64
+	// pegRefs are the reference prices pegged orders were last priced at.
+	pegRefs 	[2]float64
 }
 
+// NewOrderBook creates the orderbook of market 0, see NewMarketOrderBook.
 func NewOrderBook() *Orderbook{
+	return NewMarketOrderBook(0)
+}
+
+// NewMarketOrderBook creates an empty orderbook. The market ID is embedded
+// in the order and trade IDs of the book, every market of an exchange must
+// have its own.
+func NewMarketOrderBook(marketID int64) *Orderbook{
 	return &Orderbook{
 		asks: 		[]*Limit{},
 		bids: 		[]*Limit{},
@@ -196,20 +295,140 @@ func NewOrderBook() *Orderbook{
 		AskLimits:	make(map[float64]*Limit),
 		BidLimits: 	make(map[float64]*Limit),
 		Orders: 	make(map[int64]*Order),
+		sequencer: 	NewSequencer(marketID),
+		tradeIDs: 	idgen.New(marketID),
+	}
+}
+
+// NewJournaledOrderBook rebuilds the orderbook from the snapshot, if any,
+// and the commands of the journal after it. Every command applied afterwards
+// is appended to the journal before it is applied to the book.
+func NewJournaledOrderBook(marketID int64, journal Journal, snap *Snapshot) (*Orderbook, error) {
+	ob := NewMarketOrderBook(marketID)
+	if snap != nil {
+		ob.Restore(snap)
+	}
+	if err := journal.Replay(ob.LastSeq(), ob.Apply); err != nil {
+		return nil, err
+	}
+	ob.journal = journal
+
+	return ob, nil
+}
+
+// LastSeq returns the sequence number of the last command applied to the
+// orderbook.
+func (ob *Orderbook) LastSeq() int64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.sequencer.LastSeq()
+}
+
+// Apply applies a command that has already been sequenced, e.g. one that is
+// replayed from a journal.
+func (ob *Orderbook) Apply(cmd Command) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.sequencer.observe(&cmd)
+
+	switch cmd.Type {
+	case CommandPlaceLimit:
+		ob.applyPlaceLimitOrder(cmd, &Order{})
+	case CommandPlaceMarket:
+		ob.applyPlaceMarketOrder(cmd, &Order{})
+	case CommandCancel:
+		ob.applyCancelOrder(cmd)
+	case CommandAmend:
+		ob.applyAmendOrder(cmd)
+	case CommandStartAuction:
+		ob.auction = true
+	case CommandUncross:
+		ob.applyUncross(cmd)
+	case CommandSetAllocation:
+		ob.allocation = *cmd.Allocation
+	case CommandSetTickSize:
+		ob.tickSize = cmd.Price
+	case CommandChargeFees:
+		ob.applyChargeFees(cmd)
+	default:
+		return fmt.Errorf("unknown command type: %s", cmd.Type)
+	}
+
+	return nil
+}
+
+// submit sequences the command and writes it ahead to the journal. A
+// command that cannot be journaled must never be applied, so the engine
+// stops instead of diverging from its journal.
+func (ob *Orderbook) submit(cmd *Command) {
+	ob.sequencer.Next(cmd)
+
+	if ob.journal == nil {
+		return
+	}
+	if err := ob.journal.Append(*cmd); err != nil {
+		panic(fmt.Errorf("%w [seq: %d]: %w", ErrJournal, cmd.Seq, err))
 	}
 }
 
+// PlaceMarketOrder fills the order against the other side of the book. An
+// order larger than the volume available is rejected as a whole.
 func (ob *Orderbook) PlaceMarketOrder(o *Order)[]Match {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
+
+	cmd := Command{
+		Type: 		CommandPlaceMarket,
+		OrderID: 	o.ID,
+		UserID: 	o.UserID,
+		Bid: 		o.Bid,
+		Size: 		o.Size,
+		Timestamp: 	o.Timestamp,
+		ClientOrderID: o.ClientOrderID,
+		ReduceOnly: o.ReduceOnly,
+	}
+	ob.submit(&cmd)
+
+	trades := len(ob.Trades)
+	matches := ob.applyPlaceMarketOrder(cmd, o)
+	ob.chargeFees(trades, matches)
+
+	defer logger.Sync()
+	if o.Status == StatusRejected {
+		sugar.Infow("rejected market order",
+			"size", 	o.Size,
+			"type", 	o.Type(),
+		)
+		return matches
+	}
+	if len(ob.Trades) > 0 {
+		sugar.Infow("",
+			"currentPrice", 	ob.Trades[len(ob.Trades) - 1].Price,
+		)
+	}
+
+	return matches
+}
+
+func (ob *Orderbook) applyPlaceMarketOrder(cmd Command, o *Order) []Match {
+	o.open(cmd)
+
 	matches := []Match{}
 
+	available := ob.bidTotalVolume()
 	if o.Bid {
-		if o.Size > ob.AskTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for marker order [size: %.2f]", ob.AskTotalVolume(), o.Size))
-		}
-		for _, limit := range ob.Asks() {
-			limitMatches := limit.Fill(o)
+		available = ob.askTotalVolume()
+	}
+	if o.Size > available || ob.auction {
+		o.Status = StatusRejected
+		return matches
+	}
+
+	if o.Bid {
+		for _, limit := range ob.sortedAsks() {
+			limitMatches := limit.Fill(o, ob.allocation)
 			matches = append(matches, limitMatches...)
 
 			if len(limit.Orders) == 0 {
@@ -217,11 +436,8 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order)[]Match {
 			}
 		}
 	} else {
-		if o.Size > ob.BidTotalVolume() {
-			panic(fmt.Errorf("not enough volume [size: %.2f] for marker order [size: %.2f]", ob.BidTotalVolume(), o.Size))
-		}
-		for _, limit := range ob.Bids() {
-			limitMatches := limit.Fill(o)
+		for _, limit := range ob.sortedBids() {
+			limitMatches := limit.Fill(o, ob.allocation)
 			matches = append(matches, limitMatches...)
 
 			if len(limit.Orders) == 0 {
@@ -230,30 +446,131 @@ func (ob *Orderbook) PlaceMarketOrder(o *Order)[]Match {
 		}
 	}
 
-	for _, match := range matches {
-		trade := &Trade{
-			Price: 		match.Price,
-			Size: 		match.SizeFilled,
-			Timestamp: 	time.Now().UnixNano(),
-			Bid: 		o.Bid,
+	for i, match := range matches {
+		maker := match.Ask
+		if !o.Bid {
+			maker = match.Bid
 		}
-		ob.Trades = append(ob.Trades, trade)
+		ob.recordTrade(cmd.Timestamp, maker, o, &matches[i])
 	}
 
-	defer logger.Sync()
-	sugar.Infow("",
-		"currentPrice", 	ob.Trades[len(ob.Trades) - 1].Price,
-	)
-
 	return matches
 }
 
-func (ob  *Orderbook) PlaceLimitOrder(price float64, o *Order) {
-	var limit *Limit
+// recordTrade records the trade of a match between a resting maker order and
+// a taker order and updates the fills of both orders.
+func (ob *Orderbook) recordTrade(timestamp int64, maker, taker *Order, match *Match) {
+	trade := &Trade{
+		ID: 			ob.tradeIDs.Next(timestamp),
+		MakerOrderID: 	maker.ID,
+		TakerOrderID: 	taker.ID,
+		MakerUserID: 	maker.UserID,
+		TakerUserID: 	taker.UserID,
+		Price: 			match.Price,
+		Size: 			match.SizeFilled,
+		Timestamp: 		timestamp,
+		Bid: 			taker.Bid,
+	}
+	ob.Trades = append(ob.Trades, trade)
+
+	match.TradeID = trade.ID
+	match.Ask.recordFill(match.SizeFilled, match.Price, timestamp)
+	match.Bid.recordFill(match.SizeFilled, match.Price, timestamp)
+
+	if match.Ask.IsFilled() {
+		delete(ob.Orders, match.Ask.ID)
+	}
+	if match.Bid.IsFilled() {
+		delete(ob.Orders, match.Bid.ID)
+	}
+}
+
+// LoadTrades appends trades recorded before a restart to the history of the
+// book. New trades get IDs greater than the loaded ones.
+func (ob *Orderbook) LoadTrades(trades []*Trade) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	for _, trade := range trades {
+		ob.tradeIDs.Observe(trade.ID)
+	}
+	ob.Trades = append(ob.Trades, trades...)
+}
+
+// ObserveOrderID makes sure the book never assigns an order ID up to id
+// again, e.g. the ID of a closed order restored after a restart.
+func (ob *Orderbook) ObserveOrderID(id int64) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.sequencer.orderIDs.Observe(id)
+}
 
+func (ob  *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
+	cmd := Command{
+		Type: 		CommandPlaceLimit,
+		OrderID: 	o.ID,
+		UserID: 	o.UserID,
+		Bid: 		o.Bid,
+		Size: 		o.Size,
+		Price: 		price,
+		Timestamp: 	o.Timestamp,
+		ClientOrderID: o.ClientOrderID,
+		PostOnly: 	o.PostOnly,
+		ReduceOnly: o.ReduceOnly,
+		Peg: 		o.Peg,
+	}
+	ob.submit(&cmd)
+
+	ob.applyPlaceLimitOrder(cmd, o)
+
+	defer logger.Sync() 
+	if o.Status == StatusRejected {
+		sugar.Infow("rejected limit order",
+			"price", 	price,
+			"type", 	o.Type(),
+		)
+		return
+	}
+	sugar.Infow("new limit order",
+		"price", 	o.Limit.Price,
+		"type", 	o.Type(),
+		"size",		o.Size,
+		"userID",	o.UserID,
+	)
+}
+
+func (ob *Orderbook) applyPlaceLimitOrder(cmd Command, o *Order) {
+	o.open(cmd)
+
+	price := cmd.Price
+	if o.Peg != nil {
+		// without a reference price the order rests at the given price
+		pegged, ok := ob.pegPrice(o)
+		if !ok && price <= 0 {
+			o.Status = StatusRejected
+			return
+		}
+		if ok {
+			price = pegged
+		}
+	}
+	price, ok := ob.postOnlyPrice(o, price)
+	if !ok {
+		o.Status = StatusRejected
+		return
+	}
+
+	ob.Orders[o.ID] = o
+	ob.addToLimit(price, o)
+}
+
+func (ob *Orderbook) addToLimit(price float64, o *Order) {
+	var limit *Limit
+
 	if o.Bid {
 		limit = ob.BidLimits[price]
 	} else {
@@ -272,15 +589,6 @@ func (ob  *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		}
 	}
 
-	defer logger.Sync() 
-	sugar.Infow("new limit order",
-		"price", 	limit.Price,
-		"type", 	o.Type(),
-		"size",		o.Size,
-		"userID",	o.UserID,
-	)
-
-	ob.Orders[o.ID] = o
 	limit.AddOrder(o)
 }
 
@@ -307,16 +615,93 @@ func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 }
 
 func (ob *Orderbook) CancelOrder(o *Order) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	cmd := Command{
+		Type: 		CommandCancel,
+		OrderID: 	o.ID,
+	}
+	ob.submit(&cmd)
+
+	ob.applyCancelOrder(cmd)
+}
+
+func (ob *Orderbook) applyCancelOrder(cmd Command) {
+	o, ok := ob.Orders[cmd.OrderID]
+	if !ok {
+		return
+	}
+
+	ob.removeFromLimit(o)
+	delete(ob.Orders, o.ID)
+	o.Status = StatusCanceled
+	o.UpdatedAt = cmd.Timestamp
+}
+
+func (ob *Orderbook) removeFromLimit(o *Order) {
 	limit := o.Limit
 	limit.DeleteOrder(o)
-	delete(ob.Orders, o.ID)
 
 	if len(limit.Orders) == 0 {
 		ob.clearLimit(o.Bid, limit)
 	}
 }
 
+// AmendOrder changes the price and size of a resting order. Reducing the
+// size keeps the time priority of the order, any other change moves the
+// order to the back of the queue of its (new) price level.
+func (ob *Orderbook) AmendOrder(id int64, price, size float64) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if _, ok := ob.Orders[id]; !ok {
+		return fmt.Errorf("order not found: %d", id)
+	}
+	if size <= 0 {
+		return fmt.Errorf("invalid size [%.2f] for amended order", size)
+	}
+
+	cmd := Command{
+		Type: 		CommandAmend,
+		OrderID: 	id,
+		Size: 		size,
+		Price: 		price,
+	}
+	ob.submit(&cmd)
+
+	ob.applyAmendOrder(cmd)
+
+	return nil
+}
+
+func (ob *Orderbook) applyAmendOrder(cmd Command) {
+	o, ok := ob.Orders[cmd.OrderID]
+	if !ok {
+		return
+	}
+
+	o.UpdatedAt = cmd.Timestamp
+	if o.Limit.Price == cmd.Price && cmd.Size <= o.Size {
+		o.Limit.TotalVolume -= o.Size - cmd.Size
+		o.Size = cmd.Size
+		return
+	}
+
+	ob.removeFromLimit(o)
+	o.Size = cmd.Size
+	o.Timestamp = cmd.Timestamp
+	ob.addToLimit(cmd.Price, o)
+}
+
 func (ob *Orderbook) BidTotalVolume() float64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bidTotalVolume()
+}
+
+func (ob *Orderbook) bidTotalVolume() float64 {
 	totalVolume := 0.0
 
 	for i := 0 ; i < len(ob.bids); i++{
@@ -327,6 +712,13 @@ func (ob *Orderbook) BidTotalVolume() float64 {
 }
 
 func (ob *Orderbook) AskTotalVolume() float64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.askTotalVolume()
+}
+
+func (ob *Orderbook) askTotalVolume() float64 {
 	totalVolume := 0.0
 
 	for i := 0 ; i < len(ob.asks); i++{
@@ -336,12 +728,30 @@ func (ob *Orderbook) AskTotalVolume() float64 {
 	return totalVolume
 }
 
+// Asks returns the ask limits ordered best first. The limits are owned by
+// the book, they must not be read while other goroutines modify it.
 func (ob *Orderbook) Asks() []*Limit {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return ob.sortedAsks()
+}
+
+func (ob *Orderbook) sortedAsks() []*Limit {
 	sort.Sort(ByBestAsk{ob.asks})
 	return ob.asks
 }
 
+// Bids returns the bid limits ordered best first. The limits are owned by
+// the book, they must not be read while other goroutines modify it.
 func (ob *Orderbook) Bids() []*Limit {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return ob.sortedBids()
+}
+
+func (ob *Orderbook) sortedBids() []*Limit {
 	sort.Sort(ByBestBid{ob.bids})
 	return ob.bids
 }
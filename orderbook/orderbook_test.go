@@ -105,6 +105,61 @@ func TestPlaceMarketOrderMultiFill(t *testing.T) {
 	fmt.Printf("%+v", matches)
 }
 
+func TestTradesRecordCounterparties(t *testing.T) {
+	ob := NewOrderBook()
+
+	askA := NewOrder(false, 2, 1)
+	askB := NewOrder(false, 3, 2)
+	ob.PlaceLimitOrder(100, askA)
+	ob.PlaceLimitOrder(110, askB)
+
+	buyOrder := NewOrder(true, 4, 3)
+	matches := ob.PlaceMarketOrder(buyOrder)
+
+	assert(t, len(ob.Trades), 2)
+	for i, trade := range ob.Trades {
+		assert(t, trade.ID != 0, true)
+		assert(t, matches[i].TradeID, trade.ID)
+		assert(t, trade.TakerOrderID, buyOrder.ID)
+		assert(t, trade.TakerUserID, int64(3))
+		assert(t, trade.Bid, true)
+	}
+	assert(t, ob.Trades[0].MakerOrderID, askA.ID)
+	assert(t, ob.Trades[0].MakerUserID, int64(1))
+	assert(t, ob.Trades[1].MakerOrderID, askB.ID)
+	assert(t, ob.Trades[1].MakerUserID, int64(2))
+}
+
+func TestOrderLifecycle(t *testing.T) {
+	ob := NewOrderBook()
+
+	askA := NewOrder(false, 2, 1)
+	askB := NewOrder(false, 2, 1)
+	ob.PlaceLimitOrder(100, askA)
+	ob.PlaceLimitOrder(110, askB)
+	assert(t, askA.Status, StatusNew)
+
+	buyOrder := NewOrder(true, 3, 2)
+	ob.PlaceMarketOrder(buyOrder)
+	assert(t, buyOrder.Status, StatusFilled)
+	assert(t, buyOrder.FilledSize, 3.0)
+	assert(t, buyOrder.AvgPrice, (2*100.0+110)/3)
+	assert(t, askA.Status, StatusFilled)
+	assert(t, askB.Status, StatusPartiallyFilled)
+	assert(t, askB.FilledSize, 1.0)
+	assert(t, askB.UpdatedAt, buyOrder.Timestamp)
+
+	tooLarge := NewOrder(true, 5, 2)
+	matches := ob.PlaceMarketOrder(tooLarge)
+	assert(t, len(matches), 0)
+	assert(t, tooLarge.Status, StatusRejected)
+	assert(t, tooLarge.ID != 0, true)
+	assert(t, ob.AskTotalVolume(), 1.0)
+
+	ob.CancelOrder(askB)
+	assert(t, askB.Status, StatusCanceled)
+}
+
 func TestCancelOrderBid(t *testing.T) {
 	ob := NewOrderBook()
 	buyOrder := NewOrder(true, 4, 0)
@@ -0,0 +1,191 @@
+package orderbook
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// PegPrimary pegs an order to the best price of its own side.
+	PegPrimary PegReference = "PRIMARY"
+	// PegMarket pegs an order to the best price of the other side.
+	PegMarket PegReference = "MARKET"
+	// PegMid pegs an order to the midpoint of the best bid and ask.
+	PegMid PegReference = "MID"
+)
+
+// PegReference is the price a pegged order follows.
+type PegReference string
+
+// Peg prices a limit order relative to the top of the book: the reference
+// price plus Offset, rounded passive to the tick size. Bids never rise above
+// Cap and asks never fall below it, a zero Cap leaves the price unbounded.
+// The reference prices only take orders that are not pegged into account, so
+// pegged orders never follow each other.
+type Peg struct {
+	Reference PegReference
+	Offset    float64
+	Cap       float64 `json:",omitempty"`
+}
+
+func (p *Peg) Validate() error {
+	switch p.Reference {
+	case PegPrimary, PegMarket, PegMid:
+	default:
+		return fmt.Errorf("invalid peg reference: %s", p.Reference)
+	}
+	if p.Cap < 0 {
+		return fmt.Errorf("invalid peg cap [%.2f]", p.Cap)
+	}
+
+	return nil
+}
+
+// bestUnpegged returns the best price of the limits without pegged orders,
+// zero when there is none.
+func bestUnpegged(limits []*Limit) float64 {
+	for _, limit := range limits {
+		for _, o := range limit.Orders {
+			if o.Peg == nil {
+				return limit.Price
+			}
+		}
+	}
+
+	return 0
+}
+
+// PegPrice returns the price the pegged order would rest at in the book.
+func (ob *Orderbook) PegPrice(o *Order) (float64, bool) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	return ob.pegPrice(o)
+}
+
+// pegPrice returns the price of a pegged order, false when the book has no
+// reference price for it. The order never crosses the spread: it is kept one
+// tick passive of the best price on the other side.
+func (ob *Orderbook) pegPrice(o *Order) (float64, bool) {
+	asks, bids := ob.sortedAsks(), ob.sortedBids()
+	bestAsk, bestBid := bestUnpegged(asks), bestUnpegged(bids)
+
+	var ref float64
+	switch {
+	case o.Peg.Reference == PegMid:
+		if bestAsk == 0 || bestBid == 0 {
+			return 0, false
+		}
+		ref = (bestAsk + bestBid) / 2
+	case (o.Peg.Reference == PegPrimary) == o.Bid:
+		ref = bestBid
+	default:
+		ref = bestAsk
+	}
+	if ref == 0 {
+		return 0, false
+	}
+
+	price := ref + o.Peg.Offset
+	if ob.tickSize > 0 {
+		// the epsilon keeps prices already on a tick from moving down
+		ticks := price / ob.tickSize
+		if o.Bid {
+			ticks = math.Floor(ticks + 1e-9)
+		} else {
+			ticks = math.Ceil(ticks - 1e-9)
+		}
+		price = ticks * ob.tickSize
+	}
+	if o.Peg.Cap > 0 {
+		if o.Bid {
+			price = math.Min(price, o.Peg.Cap)
+		} else {
+			price = math.Max(price, o.Peg.Cap)
+		}
+	}
+
+	// the best price on the other side may be another pegged order
+	if o.Bid {
+		if best := bestExcept(asks, o); best > 0 && price >= best {
+			price = best - ob.tickSize
+		}
+	} else {
+		if best := bestExcept(bids, o); best > 0 && price <= best {
+			price = best + ob.tickSize
+		}
+	}
+	if ob.tickSize <= 0 && !ob.passive(o, price) {
+		return 0, false
+	}
+
+	return price, price > 0
+}
+
+// bestExcept returns the best price of the limits without the order, zero
+// when there is none.
+func bestExcept(limits []*Limit, o *Order) float64 {
+	for _, limit := range limits {
+		if len(limit.Orders) > 1 || (len(limit.Orders) == 1 && limit.Orders[0] != o) {
+			return limit.Price
+		}
+	}
+
+	return 0
+}
+
+// passive reports whether the order would not cross the spread at the
+// price.
+func (ob *Orderbook) passive(o *Order, price float64) bool {
+	if o.Bid {
+		best := bestExcept(ob.sortedAsks(), o)
+		return best == 0 || price < best
+	}
+	best := bestExcept(ob.sortedBids(), o)
+	return best == 0 || price > best
+}
+
+// RepricePegged moves the pegged orders to their new price when the
+// reference prices changed since the last call and returns the orders that
+// moved. A repriced order loses its time priority, orders keeping their
+// price keep it too. Orders are repriced in ID order so every replica of the
+// book ends up with the same priorities.
+func (ob *Orderbook) RepricePegged() []*Order {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	refs := [2]float64{bestUnpegged(ob.sortedBids()), bestUnpegged(ob.sortedAsks())}
+	if refs == ob.pegRefs {
+		return nil
+	}
+	ob.pegRefs = refs
+
+	pegged := []*Order{}
+	for _, o := range ob.Orders {
+		if o.Peg != nil {
+			pegged = append(pegged, o)
+		}
+	}
+	sort.Slice(pegged, func(i, j int) bool { return pegged[i].ID < pegged[j].ID })
+
+	repriced := []*Order{}
+	for _, o := range pegged {
+		price, ok := ob.pegPrice(o)
+		if !ok || price == o.Limit.Price {
+			continue
+		}
+
+		cmd := Command{
+			Type:    CommandAmend,
+			OrderID: o.ID,
+			Size:    o.Size,
+			Price:   price,
+		}
+		ob.submit(&cmd)
+		ob.applyAmendOrder(cmd)
+		repriced = append(repriced, o)
+	}
+
+	return repriced
+}
@@ -0,0 +1,90 @@
+package orderbook
+
+import "testing"
+
+func pegged(bid bool, size float64, userID int64, peg Peg) *Order {
+	o := NewOrder(bid, size, userID)
+	o.Peg = &peg
+	return o
+}
+
+func TestPegPrice(t *testing.T) {
+	ob := NewOrderBook()
+	if err := ob.SetTickSize(0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a reference price the order needs a price to rest at
+	noRef := pegged(true, 1, 1, Peg{Reference: PegPrimary})
+	ob.PlaceLimitOrder(0, noRef)
+	assert(t, noRef.Status, StatusRejected)
+
+	ob.PlaceLimitOrder(10_000, NewOrder(false, 5, 1))
+	ob.PlaceLimitOrder(9_000, NewOrder(true, 5, 1))
+
+	tests := []struct {
+		bid   bool
+		peg   Peg
+		price float64
+	}{
+		{true, Peg{Reference: PegPrimary, Offset: 1}, 9_001},
+		{false, Peg{Reference: PegPrimary, Offset: -1}, 9_999},
+		{true, Peg{Reference: PegMarket, Offset: -10}, 9_990},
+		{true, Peg{Reference: PegMid}, 9_500},
+		{true, Peg{Reference: PegMid, Offset: 0.3}, 9_500},
+		{false, Peg{Reference: PegMid, Offset: 0.3}, 9_500.5},
+		// capped
+		{true, Peg{Reference: PegPrimary, Offset: 100, Cap: 9_050}, 9_050},
+		{false, Peg{Reference: PegMarket, Offset: -100, Cap: 9_950}, 9_950},
+		// kept passive of the other side
+		{true, Peg{Reference: PegMarket, Offset: 5}, 9_999.5},
+		{false, Peg{Reference: PegMarket}, 9_000.5},
+	}
+	for _, tt := range tests {
+		price, ok := ob.pegPrice(pegged(tt.bid, 1, 2, tt.peg))
+		assert(t, ok, true)
+		assert(t, price, tt.price)
+	}
+}
+
+func TestRepricePegged(t *testing.T) {
+	journal := NewMemoryJournal()
+	ob, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ob.SetTickSize(1); err != nil {
+		t.Fatal(err)
+	}
+	ob.PlaceLimitOrder(10_000, NewOrder(false, 5, 1))
+	best := NewOrder(true, 5, 1)
+	ob.PlaceLimitOrder(9_000, best)
+
+	a := pegged(true, 1, 2, Peg{Reference: PegPrimary})
+	b := pegged(true, 1, 3, Peg{Reference: PegPrimary})
+	ob.PlaceLimitOrder(0, a)
+	ob.PlaceLimitOrder(0, b)
+	assert(t, a.Limit.Price, 9_000.0)
+	assert(t, ob.RepricePegged(), []*Order{})
+
+	// the pegged orders follow the best bid in their priority order
+	ob.PlaceLimitOrder(9_100, NewOrder(true, 1, 4))
+	assert(t, ob.RepricePegged(), []*Order{a, b})
+	assert(t, a.Limit.Price, 9_100.0)
+	assert(t, a.Limit.Orders, Orders{ob.sortedBids()[0].Orders[0], a, b})
+
+	// an unchanged top of the book leaves the orders alone
+	ob.PlaceLimitOrder(8_000, NewOrder(true, 1, 4))
+	assert(t, len(ob.RepricePegged()), 0)
+
+	ob.CancelOrder(best)
+	assert(t, len(ob.RepricePegged()), 0)
+	assert(t, a.Limit.Price, 9_100.0)
+
+	replayed, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameBook(t, ob, replayed)
+	assert(t, *replayed.Orders[a.ID].Peg, Peg{Reference: PegPrimary})
+}
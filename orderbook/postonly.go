@@ -0,0 +1,76 @@
+package orderbook
+
+import "fmt"
+
+const (
+	// PostOnlyReject rejects a post-only order that would cross the spread.
+	PostOnlyReject PostOnly = "REJECT"
+	// PostOnlySlide reprices a post-only order that would cross the spread
+	// one tick passive of the best price on the other side.
+	PostOnlySlide PostOnly = "SLIDE"
+)
+
+// PostOnly is what happens to a limit order that would cross the spread on
+// entry. Orders without it rest at their price.
+type PostOnly string
+
+// SetTickSize sets the price increment sliding post-only orders move by.
+// Without a tick size sliding orders are rejected like PostOnlyReject ones.
+func (ob *Orderbook) SetTickSize(tick float64) error {
+	if tick < 0 {
+		return fmt.Errorf("invalid tick size [%.2f]", tick)
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if tick == ob.tickSize {
+		return nil
+	}
+
+	cmd := Command{
+		Type:  CommandSetTickSize,
+		Price: tick,
+	}
+	ob.submit(&cmd)
+
+	ob.tickSize = tick
+
+	return nil
+}
+
+// TickSize returns the tick size of the book.
+func (ob *Orderbook) TickSize() float64 {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.tickSize
+}
+
+// postOnlyPrice returns the price a post-only order rests at, false when the
+// order must be rejected.
+func (ob *Orderbook) postOnlyPrice(o *Order, price float64) (float64, bool) {
+	if o.PostOnly == "" {
+		return price, true
+	}
+
+	if o.Bid {
+		asks := ob.sortedAsks()
+		if len(asks) == 0 || price < asks[0].Price {
+			return price, true
+		}
+		price = asks[0].Price - ob.tickSize
+	} else {
+		bids := ob.sortedBids()
+		if len(bids) == 0 || price > bids[0].Price {
+			return price, true
+		}
+		price = bids[0].Price + ob.tickSize
+	}
+
+	if o.PostOnly == PostOnlyReject || ob.tickSize <= 0 || price <= 0 {
+		return 0, false
+	}
+
+	return price, true
+}
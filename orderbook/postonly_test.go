@@ -0,0 +1,53 @@
+package orderbook
+
+import "testing"
+
+func TestPostOnly(t *testing.T) {
+	journal := NewMemoryJournal()
+	ob, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ob.PlaceLimitOrder(10_000, NewOrder(false, 5, 1))
+	ob.PlaceLimitOrder(9_000, NewOrder(true, 5, 1))
+
+	// without a tick size sliding orders cannot be repriced
+	slid := NewOrder(true, 1, 2)
+	slid.PostOnly = PostOnlySlide
+	ob.PlaceLimitOrder(10_000, slid)
+	assert(t, slid.Status, StatusRejected)
+
+	assert(t, ob.SetTickSize(-1) != nil, true)
+	if err := ob.SetTickSize(0.5); err != nil {
+		t.Fatal(err)
+	}
+
+	passive := NewOrder(true, 1, 2)
+	passive.PostOnly = PostOnlyReject
+	ob.PlaceLimitOrder(9_999, passive)
+	assert(t, passive.Status, StatusNew)
+	assert(t, passive.Limit.Price, 9_999.0)
+
+	rejected := NewOrder(true, 1, 2)
+	rejected.PostOnly = PostOnlyReject
+	ob.PlaceLimitOrder(10_000, rejected)
+	assert(t, rejected.Status, StatusRejected)
+	assert(t, ob.Orders[rejected.ID] == nil, true)
+
+	slid = NewOrder(false, 1, 2)
+	slid.PostOnly = PostOnlySlide
+	ob.PlaceLimitOrder(8_000, slid)
+	assert(t, slid.Status, StatusNew)
+	assert(t, slid.Limit.Price, 9_999.5)
+
+	assert(t, len(ob.Trades), 0)
+	assert(t, ob.BidTotalVolume(), 6.0)
+	assert(t, ob.AskTotalVolume(), 6.0)
+
+	replayed, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameBook(t, ob, replayed)
+	assert(t, replayed.TickSize(), 0.5)
+}
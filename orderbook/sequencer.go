@@ -0,0 +1,65 @@
+package orderbook
+
+import (
+	"time"
+
+	"github.com/highxshell/crypto-exchange/idgen"
+)
+
+// Sequencer stamps every command entering the orderbook with a sequence
+// number, a timestamp and, for new orders, an order ID. Everything the
+// matching engine needs that is not deterministic comes from here so it
+// can be recorded in the journal and replayed.
+type Sequencer struct {
+	seq           int64
+	orderIDs      *idgen.Generator
+	lastTimestamp int64
+	clock         func() int64
+}
+
+// NewSequencer creates the sequencer of a market. Order IDs embed the
+// market ID so they are unique across markets.
+func NewSequencer(marketID int64) *Sequencer {
+	return &Sequencer{
+		orderIDs: idgen.New(marketID),
+		clock:    func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+// Next stamps the command. Timestamps are strictly increasing so orders
+// never share the same time priority.
+func (s *Sequencer) Next(cmd *Command) {
+	s.seq++
+	cmd.Seq = s.seq
+
+	if cmd.Timestamp == 0 {
+		cmd.Timestamp = s.clock()
+	}
+	if cmd.Timestamp <= s.lastTimestamp {
+		cmd.Timestamp = s.lastTimestamp + 1
+	}
+	s.lastTimestamp = cmd.Timestamp
+
+	if cmd.newOrder() && cmd.OrderID == 0 {
+		cmd.OrderID = s.orderIDs.Next(cmd.Timestamp)
+	}
+	s.observe(cmd)
+}
+
+// observe moves the sequencer past a command that has already been
+// sequenced, either by this sequencer or when replaying a journal.
+func (s *Sequencer) observe(cmd *Command) {
+	if cmd.Seq > s.seq {
+		s.seq = cmd.Seq
+	}
+	if cmd.Timestamp > s.lastTimestamp {
+		s.lastTimestamp = cmd.Timestamp
+	}
+	if cmd.newOrder() {
+		s.orderIDs.Observe(cmd.OrderID)
+	}
+}
+
+func (s *Sequencer) LastSeq() int64 {
+	return s.seq
+}
@@ -0,0 +1,370 @@
+package orderbook
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const snapshotsToKeep = 3
+
+var errStopReplay = errors.New("stop replay")
+
+type (
+	OrderSnapshot struct {
+		ID            int64
+		UserID        int64
+		Size          float64
+		Bid           bool
+		Timestamp     int64
+		ClientOrderID string   `json:",omitempty"`
+		PostOnly      PostOnly `json:",omitempty"`
+		ReduceOnly    bool     `json:",omitempty"`
+		Peg           *Peg     `json:",omitempty"`
+		Status        OrderStatus
+		FilledSize    float64
+		AvgPrice      float64
+		UpdatedAt     int64
+	}
+	// LimitSnapshot holds the orders of a price level in FIFO order.
+	LimitSnapshot struct {
+		Price  float64
+		Orders []OrderSnapshot
+	}
+	// Snapshot is the full state of an orderbook after the command with
+	// sequence number LastSeq was applied. Levels are ordered best first.
+	Snapshot struct {
+		LastSeq       int64
+		LastOrderID   int64
+		LastTimestamp int64
+		Asks          []LimitSnapshot
+		Bids          []LimitSnapshot
+		Trades        []*Trade
+		// Auction is set when the snapshot was taken during a call period.
+		Auction bool `json:",omitempty"`
+		// Allocation is the allocation policy of the book.
+		Allocation Allocation
+		TickSize   float64 `json:",omitempty"`
+	}
+)
+
+func snapshotLimits(limits []*Limit) []LimitSnapshot {
+	snapshots := make([]LimitSnapshot, len(limits))
+	for i, limit := range limits {
+		orders := make([]OrderSnapshot, len(limit.Orders))
+		for k, order := range limit.Orders {
+			orders[k] = OrderSnapshot{
+				ID:            order.ID,
+				UserID:        order.UserID,
+				Size:          order.Size,
+				Bid:           order.Bid,
+				Timestamp:     order.Timestamp,
+				ClientOrderID: order.ClientOrderID,
+				PostOnly:      order.PostOnly,
+				ReduceOnly:    order.ReduceOnly,
+				Peg:           order.Peg,
+				Status:        order.Status,
+				FilledSize:    order.FilledSize,
+				AvgPrice:      order.AvgPrice,
+				UpdatedAt:     order.UpdatedAt,
+			}
+		}
+		snapshots[i] = LimitSnapshot{
+			Price:  limit.Price,
+			Orders: orders,
+		}
+	}
+
+	return snapshots
+}
+
+// sortedLimits returns a sorted copy of the limits so readers never reorder
+// the limits of the book.
+func sortedLimits(limits []*Limit, bid bool) []*Limit {
+	sorted := make(Limits, len(limits))
+	copy(sorted, limits)
+	if bid {
+		sort.Sort(ByBestBid{sorted})
+	} else {
+		sort.Sort(ByBestAsk{sorted})
+	}
+
+	return sorted
+}
+
+func (ob *Orderbook) Snapshot() *Snapshot {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	trades := make([]*Trade, len(ob.Trades))
+	copy(trades, ob.Trades)
+
+	return &Snapshot{
+		LastSeq:       ob.sequencer.seq,
+		LastOrderID:   ob.sequencer.orderIDs.Last(),
+		LastTimestamp: ob.sequencer.lastTimestamp,
+		Asks:          snapshotLimits(sortedLimits(ob.asks, false)),
+		Bids:          snapshotLimits(sortedLimits(ob.bids, true)),
+		Trades:        trades,
+		Auction:       ob.auction,
+		Allocation:    ob.allocation,
+		TickSize:      ob.tickSize,
+	}
+}
+
+// Restore replaces the state of the orderbook with the snapshot.
+func (ob *Orderbook) Restore(snap *Snapshot) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.asks = []*Limit{}
+	ob.bids = []*Limit{}
+	ob.AskLimits = make(map[float64]*Limit)
+	ob.BidLimits = make(map[float64]*Limit)
+	ob.Orders = make(map[int64]*Order)
+	ob.Trades = make([]*Trade, len(snap.Trades))
+	copy(ob.Trades, snap.Trades)
+
+	for _, limits := range [][]LimitSnapshot{snap.Asks, snap.Bids} {
+		for _, limit := range limits {
+			for _, o := range limit.Orders {
+				order := &Order{
+					ID:            o.ID,
+					UserID:        o.UserID,
+					Size:          o.Size,
+					Bid:           o.Bid,
+					Timestamp:     o.Timestamp,
+					ClientOrderID: o.ClientOrderID,
+					PostOnly:      o.PostOnly,
+					ReduceOnly:    o.ReduceOnly,
+					Peg:           o.Peg,
+					Status:        o.Status,
+					FilledSize:    o.FilledSize,
+					AvgPrice:      o.AvgPrice,
+					UpdatedAt:     o.UpdatedAt,
+				}
+				ob.Orders[order.ID] = order
+				ob.addToLimit(limit.Price, order)
+			}
+		}
+	}
+
+	ob.sequencer.seq = snap.LastSeq
+	ob.sequencer.orderIDs.Observe(snap.LastOrderID)
+	for _, trade := range ob.Trades {
+		ob.tradeIDs.Observe(trade.ID)
+	}
+	ob.sequencer.lastTimestamp = snap.LastTimestamp
+	ob.auction = snap.Auction
+	ob.allocation = snap.Allocation
+	ob.tickSize = snap.TickSize
+}
+
+// Hash returns a digest of the sequence number and every resting order of
+// the book in price-time priority. Two books with the same hash are in the
+// same state.
+func (ob *Orderbook) Hash() (int64, string) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.sequencer.seq, ob.hash()
+}
+
+func (ob *Orderbook) hash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "seq:%d\n", ob.sequencer.seq)
+	for _, limits := range [][]*Limit{sortedLimits(ob.asks, false), sortedLimits(ob.bids, true)} {
+		for _, limit := range limits {
+			fmt.Fprintf(h, "limit:%s\n", strconv.FormatFloat(limit.Price, 'g', -1, 64))
+			for _, o := range limit.Orders {
+				fmt.Fprintf(h, "order:%d:%d:%s:%t:%d\n", o.ID, o.UserID, strconv.FormatFloat(o.Size, 'g', -1, 64), o.Bid, o.Timestamp)
+			}
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ReplayUntil applies the commands of the journal after the last sequence
+// number of the orderbook up to and including seq.
+func (ob *Orderbook) ReplayUntil(journal Journal, seq int64) error {
+	err := journal.Replay(ob.LastSeq(), func(cmd Command) error {
+		if cmd.Seq > seq {
+			return errStopReplay
+		}
+		return ob.Apply(cmd)
+	})
+	if err == errStopReplay {
+		return nil
+	}
+
+	return err
+}
+
+// VerifySnapshot restores the snapshot, replays the journal up to seq and
+// checks the resulting book against the hash of the live book at seq.
+func VerifySnapshot(snap *Snapshot, journal Journal, seq int64, liveHash string) error {
+	ob := NewOrderBook()
+	if snap != nil {
+		ob.Restore(snap)
+	}
+	if err := ob.ReplayUntil(journal, seq); err != nil {
+		return err
+	}
+
+	replayedSeq, replayedHash := ob.Hash()
+	if replayedSeq != seq {
+		return fmt.Errorf("journal ends at seq %d before live seq %d", replayedSeq, seq)
+	}
+	if replayedHash != liveHash {
+		return fmt.Errorf("hash mismatch at seq %d: replayed %s != live %s", seq, replayedHash, liveHash)
+	}
+
+	return nil
+}
+
+func snapshotName(seq int64) string {
+	return fmt.Sprintf("%020d.snapshot", seq)
+}
+
+// WriteSnapshot atomically writes the snapshot into dir.
+func WriteSnapshot(dir string, snap *Snapshot) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, snapshotName(snap.LastSeq)+".tmp")
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(dir, snapshotName(snap.LastSeq)))
+}
+
+func snapshotPaths(dir string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.snapshot"))
+	if err != nil {
+		return nil, err
+	}
+	// names are zero padded so they sort by sequence number
+	sort.Strings(paths)
+
+	return paths, nil
+}
+
+// LatestSnapshot reads the most recent snapshot in dir. It returns nil if
+// there is no snapshot yet.
+func LatestSnapshot(dir string) (*Snapshot, error) {
+	paths, err := snapshotPaths(dir)
+	if err != nil || len(paths) == 0 {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(paths[len(paths)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{}
+	if err := json.Unmarshal(b, snap); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+func pruneSnapshots(dir string, keep int) error {
+	paths, err := snapshotPaths(dir)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < len(paths)-keep; i++ {
+		if err := os.Remove(paths[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SnapshotScheduler periodically writes a snapshot of the orderbook and
+// prunes the journal segments and older snapshots it covers.
+type SnapshotScheduler struct {
+	ob       *Orderbook
+	journal  Journal
+	dir      string
+	interval time.Duration
+	quitch   chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewSnapshotScheduler(ob *Orderbook, journal Journal, dir string, interval time.Duration) *SnapshotScheduler {
+	return &SnapshotScheduler{
+		ob:       ob,
+		journal:  journal,
+		dir:      dir,
+		interval: interval,
+		quitch:   make(chan struct{}),
+	}
+}
+
+func (s *SnapshotScheduler) Start() {
+	s.wg.Add(1)
+	go s.loop()
+}
+
+func (s *SnapshotScheduler) Stop() {
+	close(s.quitch)
+	s.wg.Wait()
+}
+
+func (s *SnapshotScheduler) loop() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.TakeSnapshot(); err != nil {
+				sugar.Error(err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// TakeSnapshot writes a snapshot and prunes everything it makes redundant.
+func (s *SnapshotScheduler) TakeSnapshot() error {
+	snap := s.ob.Snapshot()
+	if err := WriteSnapshot(s.dir, snap); err != nil {
+		return err
+	}
+	if err := s.journal.Prune(snap.LastSeq); err != nil {
+		return err
+	}
+
+	defer logger.Sync()
+	sugar.Infow("wrote orderbook snapshot",
+		"seq", snap.LastSeq,
+		"dir", s.dir,
+	)
+
+	return pruneSnapshots(s.dir, snapshotsToKeep)
+}
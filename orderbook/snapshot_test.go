@@ -0,0 +1,79 @@
+package orderbook
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	live := NewOrderBook()
+	placeJournaledCommands(t, live)
+
+	snap := live.Snapshot()
+	assert(t, snap.LastSeq, live.LastSeq())
+	assert(t, len(snap.Asks), 1)
+	assert(t, snap.Asks[0].Orders[0].Size, 3.0)
+	assert(t, snap.Bids[0].Price, 9_500.0)
+	assert(t, snap.Bids[0].Orders[0].Size, 4.0)
+	assert(t, snap.Bids[0].Orders[1].UserID, int64(6))
+
+	restored := NewOrderBook()
+	restored.Restore(snap)
+	assertSameBook(t, live, restored)
+
+	_, liveHash := live.Hash()
+	_, restoredHash := restored.Hash()
+	assert(t, restoredHash, liveHash)
+}
+
+func TestSnapshotAndJournalTail(t *testing.T) {
+	dir := t.TempDir()
+	journalDir := filepath.Join(dir, "journal")
+	snapshotDir := filepath.Join(dir, "snapshots")
+
+	journal, err := NewFileJournal(journalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	journal.SegmentSize = 2
+	live, err := NewJournaledOrderBook(0, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placeJournaledCommands(t, live)
+
+	scheduler := NewSnapshotScheduler(live, journal, snapshotDir, 0)
+	if err := scheduler.TakeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	segments, _ := journal.segments()
+	assert(t, len(segments), 1)
+
+	// the tail after the snapshot
+	ask := NewOrder(false, 3, 8)
+	live.PlaceLimitOrder(11_000, ask)
+	live.CancelOrder(ask)
+	live.PlaceLimitOrder(12_000, NewOrder(false, 3, 8))
+	journal.Close()
+
+	journal, err = NewFileJournal(journalDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	snap, err := LatestSnapshot(snapshotDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, snap.LastSeq, int64(9))
+
+	restored, err := NewJournaledOrderBook(0, journal, snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSameBook(t, live, restored)
+
+	seq, hash := live.Hash()
+	assert(t, VerifySnapshot(snap, journal, seq, hash), nil)
+	assert(t, VerifySnapshot(snap, journal, seq-1, hash) != nil, true)
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+const HeaderAdminKey = "X-Admin-Key"
+
+type RiskLimitsResponse struct {
+	UserID int64
+	Limits RiskLimits
+	// Override is whether the limits were set for the user by an admin.
+	Override bool
+}
+
+// requireAdmin rejects requests without one of the admin keys of the
+// exchange.
+func (ex *Exchange) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !ex.adminKeys[c.Request().Header.Get(HeaderAdminKey)] {
+			return c.JSON(http.StatusUnauthorized, APIError{"admin key required"})
+		}
+
+		return next(c)
+	}
+}
+
+func paramUserID(c echo.Context) (int64, error) {
+	return strconv.ParseInt(c.Param("userID"), 10, 64)
+}
+
+func (ex *Exchange) riskLimitsResponse(c echo.Context, userID int64) error {
+	limits, override := ex.risk.userLimits(userID)
+
+	return c.JSON(http.StatusOK, RiskLimitsResponse{
+		UserID:   userID,
+		Limits:   limits,
+		Override: override,
+	})
+}
+
+func (ex *Exchange) handleGetRiskLimits(c echo.Context) error {
+	userID, err := paramUserID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+
+	return ex.riskLimitsResponse(c, userID)
+}
+
+// handleSetRiskLimits replaces the limits of a user with the limits in the
+// request body.
+func (ex *Exchange) handleSetRiskLimits(c echo.Context) error {
+	userID, err := paramUserID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+
+	var limits RiskLimits
+	if err := json.NewDecoder(c.Request().Body).Decode(&limits); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid request"})
+	}
+	if limits.MaxOrderSize < 0 || limits.MaxOrderNotional < 0 || limits.MaxOpenOrders < 0 ||
+		limits.MaxPosition < 0 || limits.PriceBandPercent < 0 || limits.DailyLossLimit < 0 {
+		return c.JSON(http.StatusBadRequest, APIError{"limits cannot be negative"})
+	}
+
+	if err := ex.saveRiskOverride(userID, limits, false); err != nil {
+		sugar.Errorw("failed to save risk limits", "userID", userID, "err", err)
+		return c.JSON(http.StatusInternalServerError, APIError{"risk limits could not be saved"})
+	}
+	ex.risk.setOverride(userID, limits)
+	sugar.Infow("risk limits overridden", "userID", userID, "limits", limits)
+
+	return ex.riskLimitsResponse(c, userID)
+}
+
+// handleClearRiskLimits puts the user back on the default limits.
+func (ex *Exchange) handleClearRiskLimits(c echo.Context) error {
+	userID, err := paramUserID(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+
+	if err := ex.saveRiskOverride(userID, RiskLimits{}, true); err != nil {
+		sugar.Errorw("failed to save risk limits", "userID", userID, "err", err)
+		return c.JSON(http.StatusInternalServerError, APIError{"risk limits could not be saved"})
+	}
+	ex.risk.clearOverride(userID)
+
+	return ex.riskLimitsResponse(c, userID)
+}
+
+func (ex *Exchange) saveRiskOverride(userID int64, limits RiskLimits, cleared bool) error {
+	return ex.store.SaveRiskOverride(store.RiskOverrideRecord{
+		UserID:           userID,
+		MaxOrderSize:     limits.MaxOrderSize,
+		MaxOrderNotional: limits.MaxOrderNotional,
+		MaxOpenOrders:    limits.MaxOpenOrders,
+		MaxPosition:      limits.MaxPosition,
+		PriceBandPercent: limits.PriceBandPercent,
+		DailyLossLimit:   limits.DailyLossLimit,
+		Cleared:          cleared,
+	})
+}
+
+// restoreRiskOverrides loads the risk limits admins set for users before a
+// restart.
+func (ex *Exchange) restoreRiskOverrides() error {
+	overrides, err := ex.store.RiskOverrides()
+	if err != nil {
+		return err
+	}
+	for _, o := range overrides {
+		ex.risk.setOverride(o.UserID, RiskLimits{
+			MaxOrderSize:     o.MaxOrderSize,
+			MaxOrderNotional: o.MaxOrderNotional,
+			MaxOpenOrders:    o.MaxOpenOrders,
+			MaxPosition:      o.MaxPosition,
+			PriceBandPercent: o.PriceBandPercent,
+			DailyLossLimit:   o.DailyLossLimit,
+		})
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/highxshell/crypto-exchange/marketdata"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultCandlesLimit = 500
+	maxCandlesLimit     = 1000
+)
+
+type CandlesResponse struct {
+	Candles []marketdata.Candle
+	// NextFrom is the open time to request the next page from, zero when
+	// there are no more candles.
+	NextFrom int64
+}
+
+// queryInt64 parses an optional integer query parameter.
+func queryInt64(c echo.Context, name string, def int64) (int64, error) {
+	value := c.QueryParam(name)
+	if value == "" {
+		return def, nil
+	}
+
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (ex *Exchange) handleGetCandles(c echo.Context) error {
+	market := Market(c.Param("market"))
+	candles, ok := ex.candles[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	intervalStr := c.QueryParam("interval")
+	if intervalStr == "" {
+		intervalStr = string(marketdata.Interval1m)
+	}
+	interval, err := marketdata.ParseInterval(intervalStr)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{err.Error()})
+	}
+
+	from, err := queryInt64(c, "from", 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid from"})
+	}
+	to, err := queryInt64(c, "to", math.MaxInt64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid to"})
+	}
+	limit, err := queryInt64(c, "limit", defaultCandlesLimit)
+	if err != nil || limit <= 0 {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid limit"})
+	}
+	if limit > maxCandlesLimit {
+		limit = maxCandlesLimit
+	}
+
+	page, next, err := candles.Candles(interval, from, to, int(limit))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, CandlesResponse{page, next})
+}
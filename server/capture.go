@@ -0,0 +1,98 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// RecordedRequest is a captured order entry or cancel request together with
+// the response of the exchange. A stream of them can be replayed with
+// cmd/replay.
+type RecordedRequest struct {
+	Method   string
+	Path     string
+	Query    string          `json:",omitempty"`
+	Body     json.RawMessage `json:",omitempty"`
+	Response json.RawMessage `json:",omitempty"`
+}
+
+type captureWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// TrafficRecorder appends every successful request passing its middleware to
+// a file, one JSON encoded RecordedRequest per line.
+type TrafficRecorder struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewTrafficRecorder(path string) (*TrafficRecorder, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrafficRecorder{
+		f:   f,
+		enc: json.NewEncoder(f),
+	}, nil
+}
+
+func (tr *TrafficRecorder) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return err
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+			writer := &captureWriter{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = writer
+
+			if err := next(c); err != nil {
+				return err
+			}
+			if c.Response().Status != http.StatusOK {
+				return nil
+			}
+
+			record := RecordedRequest{
+				Method:   c.Request().Method,
+				Path:     c.Request().URL.Path,
+				Query:    c.Request().URL.RawQuery,
+				Response: json.RawMessage(bytes.TrimSpace(writer.body.Bytes())),
+			}
+			if len(body) > 0 {
+				record.Body = json.RawMessage(bytes.TrimSpace(body))
+			}
+
+			tr.mu.Lock()
+			defer tr.mu.Unlock()
+
+			if err := tr.enc.Encode(record); err != nil {
+				sugar.Error(err)
+			}
+
+			return nil
+		}
+	}
+}
+
+func (tr *TrafficRecorder) Close() error {
+	return tr.f.Close()
+}
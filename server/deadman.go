@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MaxCancelAfter = 10 * time.Minute
+
+	sessionPingInterval = 15 * time.Second
+	sessionReadTimeout  = 2 * sessionPingInterval
+)
+
+type (
+	// CancelAfterRequest arms the countdown of a user. Every order of the
+	// user is canceled once Timeout milliseconds pass without the countdown
+	// being armed again. A zero timeout disarms it.
+	CancelAfterRequest struct {
+		UserID  int64
+		Timeout int64
+	}
+	CancelAfterResponse struct {
+		UserID int64
+		// TriggerTime is when the orders are canceled in unix milliseconds,
+		// zero when the countdown is disarmed.
+		TriggerTime int64
+	}
+)
+
+type countdown struct {
+	timer    *time.Timer
+	deadline time.Time
+}
+
+// deadMansSwitch cancels the orders of users whose bots stopped responding,
+// either because their countdown ran out or because their last private
+// session disconnected.
+type deadMansSwitch struct {
+	mu         sync.Mutex
+	countdowns map[int64]*countdown
+	sessions   map[int64]int
+	cancel     func(userID int64)
+}
+
+func newDeadMansSwitch(cancel func(userID int64)) *deadMansSwitch {
+	return &deadMansSwitch{
+		countdowns: make(map[int64]*countdown),
+		sessions:   make(map[int64]int),
+		cancel:     cancel,
+	}
+}
+
+// arm restarts the countdown of the user and returns when it triggers. A
+// zero timeout disarms the countdown.
+func (d *deadMansSwitch) arm(userID int64, timeout time.Duration) time.Time {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if cd, ok := d.countdowns[userID]; ok {
+		cd.timer.Stop()
+		delete(d.countdowns, userID)
+	}
+	if timeout == 0 {
+		return time.Time{}
+	}
+
+	cd := &countdown{deadline: time.Now().Add(timeout)}
+	cd.timer = time.AfterFunc(timeout, func() {
+		d.mu.Lock()
+		// the countdown may have been rearmed while the timer fired
+		if d.countdowns[userID] != cd {
+			d.mu.Unlock()
+			return
+		}
+		delete(d.countdowns, userID)
+		d.mu.Unlock()
+
+		d.cancel(userID)
+	})
+	d.countdowns[userID] = cd
+
+	return cd.deadline
+}
+
+func (d *deadMansSwitch) connect(userID int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.sessions[userID]++
+}
+
+// disconnect cancels the orders of the user once its last session is gone.
+func (d *deadMansSwitch) disconnect(userID int64) {
+	d.mu.Lock()
+	d.sessions[userID]--
+	last := d.sessions[userID] == 0
+	if last {
+		delete(d.sessions, userID)
+	}
+	d.mu.Unlock()
+
+	if last {
+		d.cancel(userID)
+	}
+}
+
+func (d *deadMansSwitch) stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for userID, cd := range d.countdowns {
+		cd.timer.Stop()
+		delete(d.countdowns, userID)
+	}
+}
+
+// cancelUserOrders cancels every open order of the user in every market.
+func (ex *Exchange) cancelUserOrders(userID int64) {
+	for _, market := range ex.markets() {
+		ids, err := ex.cancelAll(market, userID, func(*orderbook.Order) bool { return true })
+		if err != nil {
+			sugar.Errorw("failed to cancel orders", "userID", userID, "market", market, "err", err)
+			continue
+		}
+		if len(ids) > 0 {
+			sugar.Infow("dead man's switch canceled orders", "userID", userID, "market", market, "orders", ids)
+		}
+	}
+}
+
+// handleCancelAfter arms the countdown of the user of the request, the API
+// key must belong to that user.
+func (ex *Exchange) handleCancelAfter(c echo.Context) error {
+	var req CancelAfterRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid request"})
+	}
+	if ok, err := ex.authorize(c, req.UserID); !ok {
+		return err
+	}
+
+	timeout := time.Duration(req.Timeout) * time.Millisecond
+	if timeout < 0 || timeout > MaxCancelAfter {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid timeout"})
+	}
+
+	resp := CancelAfterResponse{UserID: req.UserID}
+	if deadline := ex.deadMan.arm(req.UserID, timeout); !deadline.IsZero() {
+		resp.TriggerTime = deadline.UnixMilli()
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// handlePrivateSession holds a private websocket session of a user. When the
+// last session of the user disconnects, or stops answering pings, every
+// order of the user is canceled. The user is the owner of the API key.
+func (ex *Exchange) handlePrivateSession(c echo.Context) error {
+	userID, ok := ex.limiter.Authenticate(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, APIError{"valid API key required"})
+	}
+
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ex.deadMan.connect(userID)
+	defer ex.deadMan.disconnect(userID)
+
+	conn.SetReadDeadline(time.Now().Add(sessionReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(sessionReadTimeout))
+	})
+
+	closech := make(chan struct{})
+	go func() {
+		defer close(closech)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(sessionReadTimeout))
+		}
+	}()
+
+	ticker := time.NewTicker(sessionPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteWait)); err != nil {
+				return nil
+			}
+		case <-closech:
+			return nil
+		}
+	}
+}
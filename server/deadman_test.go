@@ -0,0 +1,122 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+// waitForBidVolume polls the published view until the bid volume of the
+// market reaches want.
+func waitForBidVolume(t *testing.T, ex *Exchange, want float64) {
+	t.Helper()
+
+	engine, _ := ex.engine(MarketETH)
+	deadline := time.Now().Add(2 * time.Second)
+	for engine.View().TotalBidVolume != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("bid volume %v, want %v", engine.View().TotalBidVolume, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCancelAfterCountdown(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	defer ex.Close()
+
+	mine := orderbook.NewOrder(true, 1, 1)
+	other := orderbook.NewOrder(true, 1, 2)
+	ex.handlePlaceLimitOrder(MarketETH, 900, mine)
+	ex.handlePlaceLimitOrder(MarketETH, 900, other)
+
+	ex.limiter.cfg.APIKeys["secret"] = 1
+	cancelAfterWithKey := func(apiKey, body string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/cancel-after", strings.NewReader(body))
+		req.Header.Set(HeaderAPIKey, apiKey)
+		if err := ex.handleCancelAfter(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code
+	}
+	cancelAfter := func(body string) int {
+		return cancelAfterWithKey("secret", body)
+	}
+
+	// only the user can arm its countdown
+	assert(t, cancelAfterWithKey("", `{"UserID":1,"Timeout":20}`), http.StatusUnauthorized)
+	assert(t, cancelAfter(`{"UserID":2,"Timeout":20}`), http.StatusForbidden)
+
+	// a disarmed countdown never fires
+	assert(t, cancelAfter(`{"UserID":1,"Timeout":20}`), http.StatusOK)
+	assert(t, cancelAfter(`{"UserID":1,"Timeout":0}`), http.StatusOK)
+	time.Sleep(50 * time.Millisecond)
+	waitForBidVolume(t, ex, 2.0)
+
+	assert(t, cancelAfter(`{"UserID":1,"Timeout":-1}`), http.StatusBadRequest)
+
+	assert(t, cancelAfter(`{"UserID":1,"Timeout":20}`), http.StatusOK)
+	waitForBidVolume(t, ex, 1.0)
+	assert(t, len(ex.Orders[1]), 0)
+	assert(t, len(ex.Orders[2]), 1)
+}
+
+func TestCancelOnDisconnect(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	defer ex.Close()
+	ex.limiter.cfg.APIKeys["secret"] = 1
+
+	ex.handlePlaceLimitOrder(MarketETH, 900, orderbook.NewOrder(true, 1, 1))
+
+	e := echo.New()
+	e.GET("/private/stream", ex.handlePrivateSession)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/private/stream"
+	dial := func() *websocket.Conn {
+		header := http.Header{}
+		header.Set(HeaderAPIKey, "secret")
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// sessions need the API key of the user
+	if _, resp, err := websocket.DefaultDialer.Dial(url, nil); err == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected the session to be refused, got %v", err)
+	}
+
+	first, second := dial(), dial()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ex.deadMan.mu.Lock()
+		sessions := ex.deadMan.sessions[1]
+		ex.deadMan.mu.Unlock()
+		if sessions == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions connected, want 2", sessions)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// orders survive as long as one session of the user is connected
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+	waitForBidVolume(t, ex, 1.0)
+
+	second.Close()
+	waitForBidVolume(t, ex, 0.0)
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultDepthLevels = 20
+	maxDepthLevels     = 500
+)
+
+type (
+	DepthLevel struct {
+		Price  float64
+		Size   float64
+		Orders int
+	}
+	// DepthResponse is the aggregated (L2) book of a market. Seq is the
+	// sequence number of the last command applied to the book.
+	DepthResponse struct {
+		Market Market
+		Seq    int64
+		Asks   []DepthLevel
+		Bids   []DepthLevel
+	}
+)
+
+// groupPrice rounds a price to the grouping tick, away from the spread so a
+// grouped level never crosses the other side of the book.
+func groupPrice(price, tick float64, bid bool) float64 {
+	if tick <= 0 {
+		return price
+	}
+
+	// the epsilon keeps prices already on the tick from moving a tick away
+	// due to float rounding
+	ticks := price / tick
+	if bid {
+		ticks = math.Floor(ticks + 1e-9)
+	} else {
+		ticks = math.Ceil(ticks - 1e-9)
+	}
+
+	return ticks * tick
+}
+
+// newDepth aggregates the best levels of a side of the book. Levels are
+// expected best first.
+func newDepth(levels []LevelView, limit int, tick float64, bid bool) []DepthLevel {
+	depth := []DepthLevel{}
+	for _, level := range levels {
+		price := groupPrice(level.Price, tick, bid)
+		if n := len(depth); n > 0 && depth[n-1].Price == price {
+			depth[n-1].Size += level.Volume
+			depth[n-1].Orders += len(level.Orders)
+			continue
+		}
+		if len(depth) == limit {
+			break
+		}
+		depth = append(depth, DepthLevel{
+			Price:  price,
+			Size:   level.Volume,
+			Orders: len(level.Orders),
+		})
+	}
+
+	return depth
+}
+
+func (ex *Exchange) handleGetDepth(c echo.Context) error {
+	market := Market(c.Param("market"))
+	engine, ok := ex.engine(market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	levels, err := queryInt64(c, "levels", defaultDepthLevels)
+	if err != nil || levels <= 0 {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid levels"})
+	}
+	if levels > maxDepthLevels {
+		levels = maxDepthLevels
+	}
+
+	var tick float64
+	if grouping := c.QueryParam("grouping"); grouping != "" {
+		tick, err = strconv.ParseFloat(grouping, 64)
+		if err != nil || tick < 0 {
+			return c.JSON(http.StatusBadRequest, APIError{"invalid grouping"})
+		}
+	}
+
+	view := engine.View()
+
+	return c.JSON(http.StatusOK, DepthResponse{
+		Market: market,
+		Seq:    view.Seq,
+		Asks:   newDepth(view.Asks, int(levels), tick, false),
+		Bids:   newDepth(view.Bids, int(levels), tick, true),
+	})
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+func TestDepthGrouping(t *testing.T) {
+	bids := []LevelView{
+		{Price: 99.5, Volume: 1, Orders: make([]OrderView, 1)},
+		{Price: 99.2, Volume: 2, Orders: make([]OrderView, 2)},
+		{Price: 98.9, Volume: 3, Orders: make([]OrderView, 1)},
+		{Price: 97, Volume: 4, Orders: make([]OrderView, 1)},
+	}
+	asks := []LevelView{
+		{Price: 100.1, Volume: 1, Orders: make([]OrderView, 1)},
+		{Price: 101, Volume: 2, Orders: make([]OrderView, 1)},
+	}
+
+	assert(t, newDepth(bids, 2, 0, true), []DepthLevel{
+		{Price: 99.5, Size: 1, Orders: 1},
+		{Price: 99.2, Size: 2, Orders: 2},
+	})
+	assert(t, newDepth(bids, 10, 1, true), []DepthLevel{
+		{Price: 99, Size: 3, Orders: 3},
+		{Price: 98, Size: 3, Orders: 1},
+		{Price: 97, Size: 4, Orders: 1},
+	})
+	assert(t, newDepth(asks, 10, 1, false), []DepthLevel{
+		{Price: 101, Size: 3, Orders: 2},
+	})
+}
+
+func TestBookRequiresAPIKeyAndHidesUsers(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	ex.limiter.cfg.APIKeys["secret"] = 1
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 1, 1))
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 2, 2))
+
+	getBook := func(apiKey string) (int, OrderbookData) {
+		req := httptest.NewRequest(http.MethodGet, "/book/ETH", nil)
+		if apiKey != "" {
+			req.Header.Set(HeaderAPIKey, apiKey)
+		}
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		c.SetParamNames("market")
+		c.SetParamValues(string(MarketETH))
+		if err := ex.handleGetBook(c); err != nil {
+			t.Fatal(err)
+		}
+
+		data := OrderbookData{}
+		json.Unmarshal(rec.Body.Bytes(), &data)
+		return rec.Code, data
+	}
+
+	code, _ := getBook("")
+	assert(t, code, http.StatusUnauthorized)
+	code, _ = getBook("wrong")
+	assert(t, code, http.StatusUnauthorized)
+
+	code, data := getBook("secret")
+	assert(t, code, http.StatusOK)
+	// the tick size of the market is the first command of the book
+	assert(t, data.Seq, int64(3))
+	assert(t, len(data.Asks), 2)
+	assert(t, data.Asks[0].UserID, int64(1))
+	assert(t, data.Asks[1].UserID, int64(0))
+}
+
+func TestBestOrderHidesUser(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 1, 1))
+
+	resp := map[string]any{}
+	assert(t, doGet(t, ex.handleGetBestAsk, "/book/ETH/ask", "market", "ETH", &resp), http.StatusOK)
+	assert(t, resp["Price"], 1_000.0)
+	_, ok := resp["UserID"]
+	assert(t, ok, false)
+}
@@ -0,0 +1,306 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+)
+
+const DefaultEngineQueueSize = 1024
+
+var (
+	ErrEngineBusy    = errors.New("matching engine queue is full")
+	ErrEngineStopped = errors.New("matching engine is stopped")
+	// ErrCommandFailed resolves the commands that panicked.
+	ErrCommandFailed = errors.New("matching engine command failed")
+)
+
+// Future is the pending result of a command submitted to a MarketEngine.
+type Future struct {
+	done   chan struct{}
+	result any
+	err    error
+}
+
+func newFuture() *Future {
+	return &Future{done: make(chan struct{})}
+}
+
+func (f *Future) resolve(result any, err error) {
+	f.result = result
+	f.err = err
+	close(f.done)
+}
+
+// Wait blocks until the command has been executed by the engine.
+func (f *Future) Wait() (any, error) {
+	<-f.done
+	return f.result, f.err
+}
+
+type engineCommand struct {
+	fn     func(ob *orderbook.Orderbook) (any, error)
+	future *Future
+}
+
+type (
+	OrderView struct {
+		ID        int64
+		UserID    int64
+		Size      float64
+		Bid       bool
+		Timestamp int64
+	}
+	LevelView struct {
+		Price  float64
+		Volume float64
+		Orders []OrderView
+	}
+	// BookView is an immutable copy of an orderbook published by its engine
+	// after every command. Levels are ordered best first. During an
+	// auction Auction is its indicative result, nil while no orders cross.
+	BookView struct {
+		Seq            int64
+		TotalBidVolume float64
+		TotalAskVolume float64
+		Asks           []LevelView
+		Bids           []LevelView
+		Trades         []*orderbook.Trade
+		InAuction      bool
+		Auction        *orderbook.Auction
+	}
+)
+
+func newLevelViews(limits []*orderbook.Limit) []LevelView {
+	levels := make([]LevelView, len(limits))
+	for i, limit := range limits {
+		orders := make([]OrderView, len(limit.Orders))
+		for k, order := range limit.Orders {
+			orders[k] = OrderView{
+				ID:        order.ID,
+				UserID:    order.UserID,
+				Size:      order.Size,
+				Bid:       order.Bid,
+				Timestamp: order.Timestamp,
+			}
+		}
+		levels[i] = LevelView{
+			Price:  limit.Price,
+			Volume: limit.TotalVolume,
+			Orders: orders,
+		}
+	}
+
+	return levels
+}
+
+// newBookView copies the orderbook. It must only be called from the
+// goroutine owning the book.
+func newBookView(ob *orderbook.Orderbook) *BookView {
+	view := &BookView{
+		Seq:            ob.LastSeq(),
+		TotalBidVolume: ob.BidTotalVolume(),
+		TotalAskVolume: ob.AskTotalVolume(),
+		Asks:           newLevelViews(ob.Asks()),
+		Bids:           newLevelViews(ob.Bids()),
+		// trades are never modified once recorded, only appended to
+		Trades:    ob.Trades[:len(ob.Trades):len(ob.Trades)],
+		InAuction: ob.InAuction(),
+	}
+	if auction, ok := ob.IndicativeAuction(); ok {
+		view.Auction = &auction
+	}
+
+	return view
+}
+
+// MarketEngine owns the orderbook of a market. A single goroutine executes
+// every command against the book in the order they were submitted, readers
+// use the BookView published after each command.
+type MarketEngine struct {
+	market Market
+	ob     *orderbook.Orderbook
+	cmdch  chan engineCommand
+	quitch chan struct{}
+	wg     sync.WaitGroup
+	view   atomic.Pointer[BookView]
+
+	// mu guards stopped against commands being queued while the queue is
+	// drained
+	mu      sync.RWMutex
+	stopped bool
+
+	tradeHandlers   []func(trades []*orderbook.Trade)
+	commandHandlers []func()
+	viewHandlers    []func(view *BookView)
+}
+
+func NewMarketEngine(market Market, ob *orderbook.Orderbook, queueSize int) *MarketEngine {
+	e := &MarketEngine{
+		market: market,
+		ob:     ob,
+		cmdch:  make(chan engineCommand, queueSize),
+		quitch: make(chan struct{}),
+	}
+	e.view.Store(newBookView(ob))
+
+	return e
+}
+
+// OnTrades registers fn to be called on the matching goroutine with the
+// trades of every command that matched. fn may change the book, the view
+// published after the command includes its changes, and trades fn causes
+// are passed to the handlers again. It must be called before Start.
+func (e *MarketEngine) OnTrades(fn func(trades []*orderbook.Trade)) {
+	e.tradeHandlers = append(e.tradeHandlers, fn)
+}
+
+// OnCommand registers fn to be called on the matching goroutine after every
+// command and its trade handlers, before the view is published. fn may
+// change the book but must not trade. It must be called before Start.
+func (e *MarketEngine) OnCommand(fn func()) {
+	e.commandHandlers = append(e.commandHandlers, fn)
+}
+
+// OnView registers fn to be called on the matching goroutine with the view
+// published after every command. It must be called before Start.
+func (e *MarketEngine) OnView(fn func(view *BookView)) {
+	e.viewHandlers = append(e.viewHandlers, fn)
+}
+
+func (e *MarketEngine) Start() {
+	e.wg.Add(1)
+	go e.loop()
+}
+
+// Stop waits for the command being executed and rejects the queued ones
+// and every command submitted afterwards.
+func (e *MarketEngine) Stop() {
+	e.reject()
+	close(e.quitch)
+	e.wg.Wait()
+	e.drain()
+}
+
+// reject makes Submit reject every command from now on.
+func (e *MarketEngine) reject() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.stopped = true
+}
+
+func (e *MarketEngine) drain() {
+	for {
+		select {
+		case cmd := <-e.cmdch:
+			cmd.future.resolve(nil, ErrEngineStopped)
+		default:
+			return
+		}
+	}
+}
+
+func (e *MarketEngine) loop() {
+	defer e.wg.Done()
+
+	for {
+		select {
+		case cmd := <-e.cmdch:
+			if !e.execute(cmd) {
+				e.reject()
+				e.drain()
+				return
+			}
+		case <-e.quitch:
+			return
+		}
+	}
+}
+
+// execute runs the command with the handlers and publishes the view. It
+// returns false when the book can no longer be trusted: the command itself
+// panicked half way through changing the book, or a command could not be
+// journaled. The engine then stops instead of diverging from its journal.
+// A handler that panics once the command has been applied only fails the
+// command with ErrCommandFailed.
+func (e *MarketEngine) execute(cmd engineCommand) (ok bool) {
+	resolved, applied := false, false
+	defer func() {
+		if r := recover(); r != nil {
+			err, _ := r.(error)
+			ok = applied && !errors.Is(err, orderbook.ErrJournal)
+			sugar.Errorw("matching engine command panicked",
+				"market", e.market,
+				"panic", r,
+				"stopped", !ok,
+				"stack", string(debug.Stack()),
+			)
+			if !resolved {
+				cmd.future.resolve(nil, fmt.Errorf("%w: %v", ErrCommandFailed, r))
+			}
+		}
+	}()
+
+	n := len(e.ob.Trades)
+	result, err := cmd.fn(e.ob)
+	applied = true
+	// handlers may trade themselves, e.g. by triggering stop orders, their
+	// trades are handled in the next round
+	for len(e.ob.Trades) > n {
+		trades := e.ob.Trades[n:]
+		n = len(e.ob.Trades)
+		for _, handler := range e.tradeHandlers {
+			handler(trades)
+		}
+	}
+	for _, handler := range e.commandHandlers {
+		handler()
+	}
+	view := newBookView(e.ob)
+	e.view.Store(view)
+
+	for _, handler := range e.viewHandlers {
+		handler(view)
+	}
+	resolved = true
+	cmd.future.resolve(result, err)
+
+	return true
+}
+
+// Submit queues fn to be executed on the matching goroutine of the market.
+// The queue is bounded, when it is full the command is rejected right away
+// with ErrEngineBusy.
+func (e *MarketEngine) Submit(fn func(ob *orderbook.Orderbook) (any, error)) *Future {
+	future := newFuture()
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if e.stopped {
+		future.resolve(nil, ErrEngineStopped)
+		return future
+	}
+
+	select {
+	case e.cmdch <- engineCommand{fn, future}:
+	default:
+		future.resolve(nil, ErrEngineBusy)
+	}
+
+	return future
+}
+
+// Execute submits fn and waits for its result.
+func (e *MarketEngine) Execute(fn func(ob *orderbook.Orderbook) (any, error)) (any, error) {
+	return e.Submit(fn).Wait()
+}
+
+// View returns the latest published state of the book.
+func (e *MarketEngine) View() *BookView {
+	return e.view.Load()
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+)
+
+func TestEngineSerializesCommands(t *testing.T) {
+	engine := NewMarketEngine(MarketETH, orderbook.NewOrderBook(), 16)
+	engine.Start()
+	defer engine.Stop()
+
+	futures := []*Future{}
+	for i := 0; i < 10; i++ {
+		futures = append(futures, engine.Submit(func(ob *orderbook.Orderbook) (any, error) {
+			order := orderbook.NewOrder(true, 1, 1)
+			ob.PlaceLimitOrder(1_000, order)
+			return order.ID, nil
+		}))
+	}
+	var last int64
+	for _, future := range futures {
+		id, err := future.Wait()
+		assert(t, err, nil)
+		assert(t, id.(int64) > last, true)
+		last = id.(int64)
+	}
+
+	view := engine.View()
+	assert(t, view.Seq, int64(10))
+	assert(t, view.TotalBidVolume, 10.0)
+	assert(t, len(view.Bids[0].Orders), 10)
+}
+
+func TestEngineRecoversPanickingHandlers(t *testing.T) {
+	engine := NewMarketEngine(MarketETH, orderbook.NewOrderBook(), 16)
+	views := 0
+	engine.OnView(func(view *BookView) {
+		if views++; views == 1 {
+			var trades []*orderbook.Trade
+			_ = trades[len(trades)-1]
+		}
+	})
+	engine.Start()
+	defer engine.Stop()
+
+	_, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		ob.PlaceLimitOrder(1_000, orderbook.NewOrder(true, 1, 1))
+		return nil, nil
+	})
+	assert(t, errors.Is(err, ErrCommandFailed), true)
+
+	// the book is consistent so the engine keeps executing commands
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		return ob.BidTotalVolume(), nil
+	})
+	assert(t, err, nil)
+	assert(t, result, 1.0)
+}
+
+func TestEngineStopsOnPanickingCommands(t *testing.T) {
+	engine := NewMarketEngine(MarketETH, orderbook.NewOrderBook(), 16)
+	engine.Start()
+	defer engine.Stop()
+
+	release := make(chan struct{})
+	panicking := engine.Submit(func(ob *orderbook.Orderbook) (any, error) {
+		<-release
+		var trades []*orderbook.Trade
+		return trades[len(trades)-1], nil
+	})
+	queued := engine.Submit(func(ob *orderbook.Orderbook) (any, error) { return 1, nil })
+	close(release)
+
+	_, err := panicking.Wait()
+	assert(t, errors.Is(err, ErrCommandFailed), true)
+	_, err = queued.Wait()
+	assert(t, err, ErrEngineStopped)
+	_, err = engine.Execute(func(ob *orderbook.Orderbook) (any, error) { return 1, nil })
+	assert(t, err, ErrEngineStopped)
+}
+
+// failingJournal fails to append once fail is set.
+type failingJournal struct {
+	*orderbook.MemoryJournal
+	fail bool
+}
+
+func (j *failingJournal) Append(cmd orderbook.Command) error {
+	if j.fail {
+		return errors.New("disk full")
+	}
+
+	return j.MemoryJournal.Append(cmd)
+}
+
+func TestEngineStopsWhenHandlersCannotJournal(t *testing.T) {
+	journal := &failingJournal{MemoryJournal: orderbook.NewMemoryJournal()}
+	ob, err := orderbook.NewJournaledOrderBook(1, journal, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := NewMarketEngine(MarketETH, ob, 16)
+	engine.OnCommand(func() {
+		if ob.BidTotalVolume() > 0 && ob.AskTotalVolume() == 0 {
+			journal.fail = true
+			ob.PlaceLimitOrder(1_100, orderbook.NewOrder(false, 1, 1))
+		}
+	})
+	engine.Start()
+	defer engine.Stop()
+
+	_, err = engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		ob.PlaceLimitOrder(1_000, orderbook.NewOrder(true, 1, 1))
+		return nil, nil
+	})
+	assert(t, errors.Is(err, ErrCommandFailed), true)
+	_, err = engine.Execute(func(ob *orderbook.Orderbook) (any, error) { return 1, nil })
+	assert(t, err, ErrEngineStopped)
+}
+
+func TestEmptyOrdersAreRejected(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	defer ex.Close()
+
+	for _, req := range []PlaceOrderRequest{
+		{UserID: 1, Type: MarketOrder, Bid: true, Market: MarketETH},
+		{UserID: 1, Type: LimitOrder, Bid: true, Size: 1, Market: MarketETH},
+		{UserID: 1, Type: LimitOrder, Bid: true, Size: -1, Price: 1_000, Market: MarketETH},
+	} {
+		code, _ := placeOrder(t, ex, req)
+		assert(t, code, http.StatusBadRequest)
+	}
+}
+
+func TestEngineQueueIsBounded(t *testing.T) {
+	engine := NewMarketEngine(MarketETH, orderbook.NewOrderBook(), 1)
+
+	// the engine is not started so nothing drains the queue
+	assert(t, engine.Submit(func(ob *orderbook.Orderbook) (any, error) { return nil, nil }).err, nil)
+	_, err := engine.Submit(func(ob *orderbook.Orderbook) (any, error) { return nil, nil }).Wait()
+	assert(t, err, ErrEngineBusy)
+
+	engine.Start()
+	engine.Stop()
+	_, err = engine.Submit(func(ob *orderbook.Orderbook) (any, error) { return nil, nil }).Wait()
+	assert(t, err, ErrEngineStopped)
+}
+
+// TestExchangeConcurrentAccess is meant to be run with -race.
+func TestExchangeConcurrentAccess(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	defer ex.Close()
+
+	var (
+		wg  sync.WaitGroup
+		ids = make(chan int64, 1000)
+	)
+	for p := 0; p < 4; p++ {
+		wg.Add(1)
+		go func(userID int64) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				bid := orderbook.NewOrder(true, 2, userID)
+				ask := orderbook.NewOrder(false, 2, userID)
+				ex.handlePlaceLimitOrder(MarketETH, float64(1_000-i%10), bid)
+				ex.handlePlaceLimitOrder(MarketETH, float64(1_100+i%10), ask)
+				ids <- bid.ID
+				ids <- ask.ID
+				ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(i%2 == 0, 1, userID))
+			}
+		}(int64(p))
+	}
+
+	for c := 0; c < 2; c++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				ex.handleCancelOrder(MarketETH, <-ids)
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				view := ex.engines[MarketETH].View()
+				volume := 0.0
+				for _, level := range view.Bids {
+					for _, order := range level.Orders {
+						volume += order.Size
+					}
+				}
+				if volume != view.TotalBidVolume {
+					t.Errorf("inconsistent view: %f != %f", volume, view.TotalBidVolume)
+					return
+				}
+				_ = len(view.Trades)
+				ex.user(1)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	view := ex.engines[MarketETH].View()
+	assert(t, view.Seq > 0, true)
+
+	ex.mu.RLock()
+	tracked := 0
+	for _, orders := range ex.Orders {
+		tracked += len(orders)
+	}
+	ex.mu.RUnlock()
+	resting := 0
+	for _, levels := range [][]LevelView{view.Asks, view.Bids} {
+		for _, level := range levels {
+			resting += len(level.Orders)
+		}
+	}
+	assert(t, tracked, resting)
+}
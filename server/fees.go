@@ -0,0 +1,217 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	bpsPerUnit = 10_000
+	// feeEpsilon keeps floating point errors from holding back a fee that
+	// adds up to a whole unit.
+	feeEpsilon = 1e-9
+)
+
+type (
+	// FeeRates are the fees of a market in basis points of the traded size.
+	// A negative maker rate is a rebate.
+	FeeRates struct {
+		MakerBps float64
+		TakerBps float64
+	}
+	// FeeTier applies to users who traded at least MinVolume, in quote
+	// currency, within the rolling userstats.Window.
+	FeeTier struct {
+		Name      string
+		MinVolume float64
+		Rates     map[Market]FeeRates
+	}
+	// FeeConfig holds the fee tiers ordered by MinVolume. The first tier
+	// must start at zero volume.
+	FeeConfig struct {
+		Tiers []FeeTier
+	}
+	FeesResponse struct {
+		UserID int64
+		// Volume is the volume of the user within userstats.Window.
+		Volume float64
+		Tier   string
+		Rates  map[Market]FeeRates
+		// NextTier is empty when the user is in the highest tier.
+		NextTier          string `json:",omitempty"`
+		NextTierMinVolume float64
+	}
+)
+
+func DefaultFeeConfig() FeeConfig {
+	return FeeConfig{
+		Tiers: []FeeTier{
+			{
+				Name:      "VIP0",
+				MinVolume: 0,
+				Rates:     map[Market]FeeRates{MarketETH: {MakerBps: 10, TakerBps: 20}},
+			},
+			{
+				Name:      "VIP1",
+				MinVolume: 1_000_000,
+				Rates:     map[Market]FeeRates{MarketETH: {MakerBps: 5, TakerBps: 15}},
+			},
+			{
+				Name:      "VIP2",
+				MinVolume: 10_000_000,
+				Rates:     map[Market]FeeRates{MarketETH: {MakerBps: -1, TakerBps: 10}},
+			},
+		},
+	}
+}
+
+// feeEngine charges users the fees of the tier their trailing volume puts
+// them in.
+type feeEngine struct {
+	cfg    FeeConfig
+	volume func(userID int64, now int64) float64
+}
+
+func newFeeEngine(cfg FeeConfig, volume func(userID int64, now int64) float64) *feeEngine {
+	return &feeEngine{
+		cfg:    cfg,
+		volume: volume,
+	}
+}
+
+// tier returns the index of the tier of a user with the volume.
+func (fe *feeEngine) tier(volume float64) int {
+	return sort.Search(len(fe.cfg.Tiers), func(i int) bool {
+		return fe.cfg.Tiers[i].MinVolume > volume
+	}) - 1
+}
+
+func (fe *feeEngine) rates(userID int64, market Market, now int64) FeeRates {
+	tier := fe.tier(fe.volume(userID, now))
+	if tier < 0 {
+		return FeeRates{}
+	}
+
+	return fe.cfg.Tiers[tier].Rates[market]
+}
+
+// schedule returns the fee schedule of the orderbook of the market.
+func (fe *feeEngine) schedule(market Market) orderbook.FeeSchedule {
+	return marketFees{fe, market}
+}
+
+type marketFees struct {
+	fe     *feeEngine
+	market Market
+}
+
+// Fees charges the rates of the tiers the users were in when the command
+// matching the trade started.
+func (mf marketFees) Fees(trade *orderbook.Trade) (float64, float64) {
+	makerFee := trade.Size * mf.fe.rates(trade.MakerUserID, mf.market, trade.Timestamp).MakerBps / bpsPerUnit
+	takerFee := trade.Size * mf.fe.rates(trade.TakerUserID, mf.market, trade.Timestamp).TakerBps / bpsPerUnit
+
+	return makerFee, takerFee
+}
+
+// feeLedger accumulates the fees of the users until they add up to a whole
+// unit that can be transferred. Fees are a fraction of the traded size, so
+// most fees of a single trade are smaller than the unit of a transfer. The
+// balances are persisted so the fractions survive a restart.
+type feeLedger struct {
+	mu    sync.Mutex
+	store store.Store
+	owed  map[int64]float64
+}
+
+// newFeeLedger loads the persisted balances.
+func newFeeLedger(db store.Store) (*feeLedger, error) {
+	balances, err := db.FeeBalances()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &feeLedger{
+		store: db,
+		owed:  make(map[int64]float64, len(balances)),
+	}
+	for _, balance := range balances {
+		l.owed[balance.UserID] = balance.Owed
+	}
+
+	return l, nil
+}
+
+// charge adds the fee to what the user owes the exchange, a negative fee is
+// a rebate, and returns the whole units that are due. The remainder stays in
+// the ledger. The balance is persisted before the units are transferred, a
+// crash in between loses them instead of charging them twice.
+func (l *feeLedger) charge(userID int64, fee float64) (int64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	owed := l.owed[userID] + fee
+	due := math.Trunc(owed + math.Copysign(feeEpsilon, owed))
+	if err := l.save(userID, owed-due); err != nil {
+		return 0, err
+	}
+
+	return int64(due), nil
+}
+
+// unpaid puts units that could not be transferred back into the ledger.
+func (l *feeLedger) unpaid(userID int64, due int64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.save(userID, l.owed[userID]+float64(due))
+}
+
+// save persists the balance of the user and keeps it once it is persisted.
+func (l *feeLedger) save(userID int64, owed float64) error {
+	if err := l.store.SaveFeeBalance(store.FeeBalanceRecord{UserID: userID, Owed: owed}); err != nil {
+		return err
+	}
+	l.owed[userID] = owed
+
+	return nil
+}
+
+func (ex *Exchange) handleGetFees(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+	if ok, err := ex.authorize(c, userID); !ok {
+		return err
+	}
+
+	resp := FeesResponse{
+		UserID: userID,
+		Volume: ex.stats.volume(userID, time.Now().UnixNano()),
+		Rates:  map[Market]FeeRates{},
+	}
+
+	tiers := ex.fees.cfg.Tiers
+	tier := ex.fees.tier(resp.Volume)
+	if tier >= 0 {
+		resp.Tier = tiers[tier].Name
+		for market, rates := range tiers[tier].Rates {
+			resp.Rates[market] = rates
+		}
+	}
+	if tier+1 < len(tiers) {
+		resp.NextTier = tiers[tier+1].Name
+		resp.NextTierMinVolume = tiers[tier+1].MinVolume
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
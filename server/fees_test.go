@@ -0,0 +1,130 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+)
+
+func TestFeeTiers(t *testing.T) {
+	volumes := map[int64]float64{}
+	fe := newFeeEngine(FeeConfig{
+		Tiers: []FeeTier{
+			{Name: "T0", MinVolume: 0, Rates: map[Market]FeeRates{MarketETH: {MakerBps: 10, TakerBps: 20}}},
+			{Name: "T1", MinVolume: 1_000, Rates: map[Market]FeeRates{MarketETH: {MakerBps: -5, TakerBps: 10}}},
+		},
+	}, func(userID int64, now int64) float64 { return volumes[userID] })
+	fees := fe.schedule(MarketETH)
+
+	trade := &orderbook.Trade{MakerUserID: 1, TakerUserID: 2, Price: 1_000, Size: 10}
+	maker, taker := fees.Fees(trade)
+	assert(t, maker, 0.01)
+	assert(t, taker, 0.02)
+
+	// the maker reached the next tier and now gets a rebate
+	volumes[1] = 1_000
+	maker, taker = fees.Fees(trade)
+	assert(t, maker, -0.005)
+	assert(t, taker, 0.02)
+
+	// markets without rates are free
+	maker, taker = fe.schedule("BTC").Fees(trade)
+	assert(t, maker, 0.0)
+	assert(t, taker, 0.0)
+}
+
+func TestTradesChargeFees(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 10, 1))
+	matches, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 10, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rates := DefaultFeeConfig().Tiers[0].Rates[MarketETH]
+	assert(t, matches[0].AskFee, 10*rates.MakerBps/bpsPerUnit)
+	assert(t, matches[0].BidFee, 10*rates.TakerBps/bpsPerUnit)
+
+	fills := FillsResponse{}
+	ex.limiter.cfg.APIKeys["taker"] = 2
+	doGetAuth(t, ex.handleGetFills, "/fills/2", "taker", "userID", "2", &fills)
+	assert(t, fills.Fills[0].Fee, matches[0].BidFee)
+
+	resp := FeesResponse{}
+	assert(t, doGet(t, ex.handleGetFees, "/fees/2", "userID", "2", &resp), http.StatusUnauthorized)
+	doGetAuth(t, ex.handleGetFees, "/fees/2", "taker", "userID", "2", &resp)
+	assert(t, resp.Tier, "VIP0")
+	assert(t, resp.Volume, 10_000.0)
+	assert(t, resp.Rates[MarketETH], rates)
+	assert(t, resp.NextTier, "VIP1")
+	assert(t, resp.NextTierMinVolume, DefaultFeeConfig().Tiers[1].MinVolume)
+}
+
+func TestFeesAreTransferredInWholeUnits(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	for _, userID := range []int64{1, 2} {
+		pk, err := crypto.GenerateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ex.registerUser(hex.EncodeToString(crypto.FromECDSA(pk)), userID)
+	}
+	exchange := crypto.PubkeyToAddress(ex.PrivateKey.PublicKey)
+	taker, _ := ex.user(2)
+
+	fees := []*big.Int{}
+	ex.transfer = func(from *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
+		if to == exchange {
+			fees = append(fees, amount)
+		}
+		return nil
+	}
+
+	match := orderbook.Match{
+		Ask:        orderbook.NewOrder(false, 10, 1),
+		Bid:        orderbook.NewOrder(true, 10, 2),
+		SizeFilled: 10,
+		AskFee:     0.01,
+		BidFee:     0.02,
+	}
+	for i := 0; i < 49; i++ {
+		if err := ex.handleMatches(MarketETH, []orderbook.Match{match}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert(t, len(fees), 0)
+
+	// the fractions owed survive a restart
+	owed := ex.feeLedger.owed[taker.ID]
+	restarted := newTestExchange(t, db)
+	assert(t, restarted.feeLedger.owed[taker.ID], owed)
+	restarted.Close()
+
+	// the fees of the taker add up to a whole unit with the 50th trade
+	if err := ex.handleMatches(MarketETH, []orderbook.Match{match}); err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(fees), 1)
+	assert(t, fees[0].Int64(), int64(1))
+	assert(t, ex.feeLedger.owed[taker.ID] < feeEpsilon, true)
+
+	// a failed transfer keeps the fee owed
+	ex.transfer = func(*ecdsa.PrivateKey, common.Address, *big.Int) error { return errors.New("no funds") }
+	assert(t, ex.collectFee(taker, 1) != nil, true)
+	due, err := ex.feeLedger.charge(taker.ID, 0)
+	assert(t, err, nil)
+	assert(t, due, int64(1))
+}
@@ -0,0 +1,500 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+type (
+	// PlaceGroupRequest places a group of linked orders. An OCO group takes
+	// its two orders, each a limit or a stop order. A bracket takes its
+	// entry order and the prices of the take-profit limit and the stop-loss
+	// stop order that close the position once the entry is filled.
+	PlaceGroupRequest struct {
+		UserID          int64
+		Market          Market
+		Type            store.OrderGroupType
+		Orders          []PlaceOrderRequest
+		TakeProfitPrice float64
+		StopLossPrice   float64
+	}
+)
+
+// orderGroups indexes the working order groups by their ID. Every order
+// stays linked to its group after the group is done so later state
+// transitions of the order are still recorded with it.
+type orderGroups struct {
+	mu      sync.Mutex
+	groups  map[int64]*store.OrderGroupRecord
+	byOrder map[int64]int64
+}
+
+func newOrderGroups() *orderGroups {
+	return &orderGroups{
+		groups:  make(map[int64]*store.OrderGroupRecord),
+		byOrder: make(map[int64]int64),
+	}
+}
+
+func (g *orderGroups) add(group *store.OrderGroupRecord) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.groups[group.ID] = group
+	for _, id := range group.OrderIDs {
+		g.byOrder[id] = group.ID
+	}
+}
+
+// link adds an order to the group.
+func (g *orderGroups) link(group *store.OrderGroupRecord, orderID int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	group.OrderIDs = append(group.OrderIDs, orderID)
+	g.byOrder[orderID] = group.ID
+}
+
+// remove stops tracking a group once it is done.
+func (g *orderGroups) remove(group *store.OrderGroupRecord) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.groups, group.ID)
+}
+
+// get returns a working group.
+func (g *orderGroups) get(id int64) (*store.OrderGroupRecord, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	group, ok := g.groups[id]
+	return group, ok
+}
+
+// working returns the working group of an order.
+func (g *orderGroups) working(orderID int64) (*store.OrderGroupRecord, bool) {
+	return g.get(g.groupOf(orderID))
+}
+
+func (g *orderGroups) groupOf(orderID int64) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.byOrder[orderID]
+}
+
+// user returns copies of the working groups of a user oldest first.
+func (g *orderGroups) user(userID int64) []store.OrderGroupRecord {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	groups := []store.OrderGroupRecord{}
+	for _, group := range g.groups {
+		if group.UserID == userID {
+			record := *group
+			record.OrderIDs = append([]int64{}, group.OrderIDs...)
+			groups = append(groups, record)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].ID < groups[j].ID })
+
+	return groups
+}
+
+func (ex *Exchange) saveGroup(group *store.OrderGroupRecord) error {
+	ex.groups.mu.Lock()
+	group.UpdatedAt = time.Now().UnixNano()
+	record := *group
+	ex.groups.mu.Unlock()
+
+	return ex.store.SaveOrderGroup(record)
+}
+
+// closeGroup completes or cancels a working group and cancels its working
+// orders except skip.
+func (ex *Exchange) closeGroup(ob *orderbook.Orderbook, market Market, group *store.OrderGroupRecord, status store.OrderGroupStatus, skip int64) {
+	ex.groups.mu.Lock()
+	group.Status = status
+	ex.groups.mu.Unlock()
+	ex.groups.remove(group)
+
+	ex.cancelGroupOrders(ob, market, group, skip)
+	if err := ex.saveGroup(group); err != nil {
+		sugar.Error(err)
+	}
+}
+
+// workingOrder returns an order of the market that can still execute,
+// either resting in the book or a pending stop order.
+func (ex *Exchange) workingOrder(ob *orderbook.Orderbook, id int64) (*orderbook.Order, bool) {
+	if order, ok := ob.Orders[id]; ok {
+		return order, true
+	}
+	if stop, ok := ex.stops.get(id); ok {
+		return stop.order, true
+	}
+
+	return nil, false
+}
+
+// cancelGroupOrders cancels the working orders of the group except skip.
+func (ex *Exchange) cancelGroupOrders(ob *orderbook.Orderbook, market Market, group *store.OrderGroupRecord, skip int64) {
+	for _, id := range group.OrderIDs {
+		if id == skip {
+			continue
+		}
+		if order, ok := ex.workingOrder(ob, id); ok {
+			if err := ex.cancelWorkingOrder(ob, market, order); err != nil {
+				sugar.Error(err)
+			}
+		}
+	}
+}
+
+// placeRequest places the order of a request in the book, or holds it as a
+// stop order. It runs on the matching goroutine of the market.
+func (ex *Exchange) placeRequest(ob *orderbook.Orderbook, market Market, req PlaceOrderRequest, order *orderbook.Order) (marketOrderResult, error) {
+	switch {
+	case req.StopPrice > 0 || req.trailing():
+		stop := &stopOrder{
+			order:        order,
+			market:       market,
+			price:        req.Price,
+			stopPrice:    req.StopPrice,
+			trailAmount:  req.TrailAmount,
+			trailPercent: req.TrailPercent,
+		}
+		if req.Type == MarketOrder {
+			stop.price = 0
+		}
+		return marketOrderResult{}, ex.placeStopOrder(ob, stop)
+	case req.Type == LimitOrder:
+		return marketOrderResult{}, ex.placeLimitOrder(ob, market, req.Price, order)
+	case req.Type == MarketOrder:
+		return ex.placeMarketOrder(ob, market, order)
+	}
+
+	return marketOrderResult{}, fmt.Errorf("invalid order type: %s", req.Type)
+}
+
+func validateGroup(req PlaceGroupRequest) error {
+	switch req.Type {
+	case store.GroupOCO:
+		if len(req.Orders) != 2 {
+			return fmt.Errorf("an OCO group takes 2 orders")
+		}
+		for _, order := range req.Orders {
+			if order.Type == MarketOrder && order.StopPrice <= 0 && !order.trailing() {
+				return fmt.Errorf("the orders of an OCO group must rest")
+			}
+			if order.Bid != req.Orders[0].Bid {
+				return fmt.Errorf("the orders of an OCO group must be on the same side")
+			}
+		}
+	case store.GroupBracket:
+		if len(req.Orders) != 1 {
+			return fmt.Errorf("a bracket takes 1 entry order")
+		}
+		if req.TakeProfitPrice <= 0 || req.StopLossPrice <= 0 {
+			return fmt.Errorf("a bracket needs take-profit and stop-loss prices")
+		}
+		// the exit orders sell above and stop below a long entry
+		if req.Orders[0].Bid != (req.TakeProfitPrice > req.StopLossPrice) {
+			return fmt.Errorf("the take-profit price must be on the profitable side of the stop-loss price")
+		}
+	default:
+		return fmt.Errorf("invalid group type: %s", req.Type)
+	}
+
+	for _, order := range req.Orders {
+		if order.Size <= 0 {
+			return fmt.Errorf("invalid size [%.2f]", order.Size)
+		}
+		if !validPostOnly(order.PostOnly) {
+			return fmt.Errorf("invalid post-only behavior")
+		}
+		if err := validatePeg(order); err != nil {
+			return err
+		}
+		if err := validateTrail(order); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// placeGroup places the orders of a group. Order IDs are assigned up front
+// so every order is recorded with its group. When an order cannot be
+// placed the orders placed before it are canceled. It runs on the matching
+// goroutine of the market.
+func (ex *Exchange) placeGroup(ob *orderbook.Orderbook, market Market, req PlaceGroupRequest) (store.OrderGroupRecord, []orderbook.Match, error) {
+	now := time.Now().UnixNano()
+	group := &store.OrderGroupRecord{
+		ID:        ex.conditionalIDs.Next(now),
+		UserID:    req.UserID,
+		Market:    string(market),
+		Type:      req.Type,
+		Status:    store.GroupActive,
+		OrderIDs:  []int64{},
+		Timestamp: now,
+	}
+	if req.Type == store.GroupBracket {
+		group.Status = store.GroupPending
+		group.Size = req.Orders[0].Size
+		group.TakeProfitPrice = req.TakeProfitPrice
+		group.StopLossPrice = req.StopLossPrice
+	}
+	ex.groups.add(group)
+
+	matches := []orderbook.Match{}
+	for i, r := range req.Orders {
+		order := orderbook.NewOrder(r.Bid, r.Size, req.UserID)
+		order.ClientOrderID = r.ClientOrderID
+		order.PostOnly = r.PostOnly
+		order.ReduceOnly = r.ReduceOnly
+		order.Peg = r.Peg
+		order.ID = ex.conditionalIDs.Next(now)
+		ex.groups.link(group, order.ID)
+		if i == 0 && req.Type == store.GroupBracket {
+			group.EntryID = order.ID
+		}
+
+		result, err := ex.placeRequest(ob, market, r, order)
+		if err != nil {
+			ex.closeGroup(ob, market, group, store.GroupCanceled, 0)
+			return store.OrderGroupRecord{}, nil, err
+		}
+		matches = append(matches, result.matches...)
+	}
+
+	if err := ex.saveGroup(group); err != nil {
+		sugar.Error(err)
+	}
+	ex.groups.mu.Lock()
+	record := *group
+	ex.groups.mu.Unlock()
+
+	return record, matches, nil
+}
+
+// orderExecuted reacts to an order of a group trading or, for stop orders,
+// triggering: a filled bracket entry spawns its exit orders, an executed
+// exit order cancels the other one. It runs on the matching goroutine of
+// the market.
+func (ex *Exchange) orderExecuted(ob *orderbook.Orderbook, market Market, orderID int64) {
+	group, ok := ex.groups.working(orderID)
+	if !ok {
+		return
+	}
+
+	switch {
+	case group.Status == store.GroupPending && orderID == group.EntryID:
+		// wait for the entry to fill completely
+		if _, ok := ex.workingOrder(ob, orderID); ok {
+			return
+		}
+		ex.placeBracketExits(ob, market, group)
+	case group.Status == store.GroupActive && orderID != group.EntryID:
+		ex.closeGroup(ob, market, group, store.GroupCompleted, orderID)
+	}
+}
+
+// placeBracketExits places the take-profit limit and the stop-loss stop
+// order closing the position of a filled bracket entry. The exits are on the
+// other side of the entry, which validateGroup checked against the order of
+// the prices. An exit that cannot be placed is recorded as rejected and the
+// other one keeps working, so the position keeps the protection it can get.
+// The group is only canceled when no exit could be placed.
+func (ex *Exchange) placeBracketExits(ob *orderbook.Orderbook, market Market, group *store.OrderGroupRecord) {
+	bid := group.TakeProfitPrice < group.StopLossPrice
+
+	ex.groups.mu.Lock()
+	group.Status = store.GroupActive
+	ex.groups.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	exits := []PlaceOrderRequest{
+		{Type: LimitOrder, Bid: bid, Size: group.Size, Price: group.TakeProfitPrice},
+		{Type: MarketOrder, Bid: bid, Size: group.Size, StopPrice: group.StopLossPrice},
+	}
+	working := 0
+	for _, r := range exits {
+		order := orderbook.NewOrder(r.Bid, r.Size, group.UserID)
+		order.ID = ex.conditionalIDs.Next(now)
+		ex.groups.link(group, order.ID)
+
+		if _, err := ex.placeRequest(ob, market, r, order); err != nil {
+			sugar.Errorw("failed to place bracket exit order", "group", group.ID, "order", order.ID, "err", err)
+			order.Status = orderbook.StatusRejected
+			record := ex.orderRecord(market, r.Price, order)
+			record.StopPrice = r.StopPrice
+			if err := ex.store.SaveOrder(record); err != nil {
+				sugar.Error(err)
+			}
+			continue
+		}
+		working++
+	}
+
+	if working == 0 {
+		ex.closeGroup(ob, market, group, store.GroupCanceled, 0)
+		return
+	}
+	if err := ex.saveGroup(group); err != nil {
+		sugar.Error(err)
+	}
+}
+
+// orderCanceled cancels the group of a canceled order together with its
+// other working orders. A bracket entry canceled after filling in part
+// still opened a position, its exits close the size that was filled. It
+// runs on the matching goroutine of the market.
+func (ex *Exchange) orderCanceled(ob *orderbook.Orderbook, market Market, order *orderbook.Order) {
+	group, ok := ex.groups.working(order.ID)
+	if !ok {
+		return
+	}
+
+	if group.Status == store.GroupPending && order.ID == group.EntryID && order.FilledSize > 0 {
+		ex.groups.mu.Lock()
+		group.Size = order.FilledSize
+		ex.groups.mu.Unlock()
+		ex.placeBracketExits(ob, market, group)
+		return
+	}
+	ex.closeGroup(ob, market, group, store.GroupCanceled, order.ID)
+}
+
+// groupsOnTrades passes the orders that traded to their groups. It runs on
+// the matching goroutine of the market.
+func (ex *Exchange) groupsOnTrades(ob *orderbook.Orderbook, market Market, trades []*orderbook.Trade) {
+	for _, trade := range trades {
+		ex.orderExecuted(ob, market, trade.MakerOrderID)
+		ex.orderExecuted(ob, market, trade.TakerOrderID)
+	}
+}
+
+// restoreGroups links the orders to their groups again and loads the
+// working groups.
+func (ex *Exchange) restoreGroups() error {
+	groups, err := ex.store.OrderGroups()
+	if err != nil {
+		return err
+	}
+	for _, group := range groups {
+		group := group
+		ex.conditionalIDs.Observe(group.ID)
+		ex.groups.add(&group)
+		if group.Status != store.GroupPending && group.Status != store.GroupActive {
+			ex.groups.remove(&group)
+		}
+	}
+
+	return nil
+}
+
+func (ex *Exchange) handlePlaceGroup(c echo.Context) error {
+	var req PlaceGroupRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid request"})
+	}
+	if ok, err := ex.authorize(c, req.UserID); !ok {
+		return err
+	}
+	if err := validateGroup(req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{err.Error()})
+	}
+
+	engine, ok := ex.engine(req.Market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	var matches []orderbook.Match
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		group, m, err := ex.placeGroup(ob, req.Market, req)
+		matches = m
+		return group, err
+	})
+	if err != nil {
+		return engineError(c, err)
+	}
+	if err := ex.handleMatches(req.Market, matches); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// parseGroupID looks up the group of the request path, working or not.
+func (ex *Exchange) parseGroupID(c echo.Context) (store.OrderGroupRecord, bool, error) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return store.OrderGroupRecord{}, false, nil
+	}
+
+	return ex.store.OrderGroup(id)
+}
+
+func (ex *Exchange) handleGetGroup(c echo.Context) error {
+	group, ok, err := ex.parseGroupID(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{"group not found"})
+	}
+	if ok, err := ex.authorize(c, group.UserID); !ok {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, group)
+}
+
+// handleCancelGroup cancels a working group and every working order in it.
+func (ex *Exchange) handleCancelGroup(c echo.Context) error {
+	record, ok, err := ex.parseGroupID(c)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{"group not found"})
+	}
+	if ok, err := ex.authorize(c, record.UserID); !ok {
+		return err
+	}
+
+	market := Market(record.Market)
+	engine, ok := ex.engine(market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		group, ok := ex.groups.get(record.ID)
+		if !ok {
+			return nil, fmt.Errorf("group %d is not working", record.ID)
+		}
+		ex.closeGroup(ob, market, group, store.GroupCanceled, 0)
+
+		ex.groups.mu.Lock()
+		defer ex.groups.mu.Unlock()
+		return *group, nil
+	})
+	if err != nil {
+		return engineError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
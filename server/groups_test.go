@@ -0,0 +1,323 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+)
+
+func sell(t *testing.T, ex *Exchange, size float64) {
+	t.Helper()
+
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(false, size, 9)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStopOrder(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	ex.handlePlaceLimitOrder(MarketETH, 960, orderbook.NewOrder(true, 1, 2))
+	ex.handlePlaceLimitOrder(MarketETH, 900, orderbook.NewOrder(true, 5, 2))
+
+	code, resp := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 1, StopPrice: 950, Market: MarketETH})
+	assert(t, code, http.StatusOK)
+	record, _, _ := db.Order(resp.OrderID)
+	assert(t, record.Status, orderbook.StatusPending)
+	assert(t, record.StopPrice, 950.0)
+
+	// 960 does not reach the stop price
+	sell(t, ex, 1)
+	record, _, _ = db.Order(resp.OrderID)
+	assert(t, record.Status, orderbook.StatusPending)
+
+	sell(t, ex, 1)
+	record, _, _ = db.Order(resp.OrderID)
+	assert(t, record.Status, orderbook.StatusFilled)
+	assert(t, record.AvgPrice, 900.0)
+
+	engine, _ := ex.engine(MarketETH)
+	assert(t, engine.View().TotalBidVolume, 3.0)
+}
+
+func TestStopOrderSurvivesRestart(t *testing.T) {
+	db, err := store.NewFileStore(filepath.Join(t.TempDir(), "exchange.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := newTestExchange(t, db)
+
+	_, resp := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 940, StopPrice: 950, Market: MarketETH})
+	ex.Close()
+
+	ex = newTestExchange(t, db)
+	defer ex.Close()
+
+	stop, ok := ex.stops.get(resp.OrderID)
+	if !ok {
+		t.Fatal("stop order not restored")
+	}
+	assert(t, stop.price, 940.0)
+	assert(t, stop.stopPrice, 950.0)
+
+	ex.handlePlaceLimitOrder(MarketETH, 950, orderbook.NewOrder(true, 1, 2))
+	sell(t, ex, 1)
+
+	record, _, _ := db.Order(resp.OrderID)
+	assert(t, record.Status, orderbook.StatusNew)
+	engine, _ := ex.engine(MarketETH)
+	assert(t, engine.View().TotalAskVolume, 1.0)
+}
+
+func TestTrailingStop(t *testing.T) {
+	db, err := store.NewFileStore(filepath.Join(t.TempDir(), "exchange.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := newTestExchange(t, db)
+
+	code, _ := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 1, TrailAmount: 50, Market: MarketETH})
+	assert(t, code, http.StatusBadRequest)
+	code, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 1, TrailAmount: 50, TrailPercent: 5, Market: MarketETH})
+	assert(t, code, http.StatusBadRequest)
+
+	buy := func(price float64) {
+		ex.handlePlaceLimitOrder(MarketETH, price, orderbook.NewOrder(false, 1, 2))
+		if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 1, 3)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buy(1_000)
+
+	_, market := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Size: 1, TrailAmount: 50, Market: MarketETH})
+	_, limit := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 940, TrailPercent: 5, Market: MarketETH})
+	record, _, _ := db.Order(market.OrderID)
+	assert(t, record.StopPrice, 950.0)
+
+	// the stops ratchet up with the price and never move back
+	buy(1_100)
+	buy(1_060)
+	record, _, _ = db.Order(market.OrderID)
+	assert(t, record.Status, orderbook.StatusPending)
+	assert(t, record.StopPrice, 1_050.0)
+	record, _, _ = db.Order(limit.OrderID)
+	assert(t, record.StopPrice, 1_045.0)
+	assert(t, record.Price, 1_035.0)
+	ex.Close()
+
+	ex = newTestExchange(t, db)
+	defer ex.Close()
+	stops := ex.userStops(1)
+	assert(t, len(stops), 2)
+	assert(t, stops[0].StopPrice, 1_050.0)
+	assert(t, stops[1].TrailPercent, 5.0)
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_040, orderbook.NewOrder(true, 5, 2))
+	sell(t, ex, 1)
+
+	record, _, _ = db.Order(market.OrderID)
+	assert(t, record.Status, orderbook.StatusFilled)
+	record, _, _ = db.Order(limit.OrderID)
+	assert(t, record.Status, orderbook.StatusNew)
+	assert(t, record.Price, 1_035.0)
+}
+
+func TestOCOGroup(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	engine, _ := ex.engine(MarketETH)
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		group, _, err := ex.placeGroup(ob, MarketETH, PlaceGroupRequest{
+			UserID: 1,
+			Market: MarketETH,
+			Type:   store.GroupOCO,
+			Orders: []PlaceOrderRequest{
+				{Type: LimitOrder, Bid: true, Size: 1, Price: 900},
+				{Type: LimitOrder, Bid: true, Size: 1, Price: 1_000, StopPrice: 1_100},
+			},
+		})
+		return group, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := result.(store.OrderGroupRecord)
+	assert(t, len(group.OrderIDs), 2)
+
+	limit, _, _ := db.Order(group.OrderIDs[0])
+	assert(t, limit.GroupID, group.ID)
+
+	sell(t, ex, 1)
+
+	record, _, _ := db.OrderGroup(group.ID)
+	assert(t, record.Status, store.GroupCompleted)
+	stop, _, _ := db.Order(group.OrderIDs[1])
+	assert(t, stop.Status, orderbook.StatusCanceled)
+	assert(t, stop.GroupID, group.ID)
+	assert(t, len(ex.stops.filter(func(*stopOrder) bool { return true })), 0)
+}
+
+func TestBracketGroup(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	engine, _ := ex.engine(MarketETH)
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		group, _, err := ex.placeGroup(ob, MarketETH, PlaceGroupRequest{
+			UserID:          1,
+			Market:          MarketETH,
+			Type:            store.GroupBracket,
+			Orders:          []PlaceOrderRequest{{Type: LimitOrder, Bid: true, Size: 2, Price: 1_000}},
+			TakeProfitPrice: 1_200,
+			StopLossPrice:   900,
+		})
+		return group, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := result.(store.OrderGroupRecord)
+	assert(t, group.Status, store.GroupPending)
+
+	// the exits wait for the entry to fill completely
+	sell(t, ex, 1)
+	record, _, _ := db.OrderGroup(group.ID)
+	assert(t, len(record.OrderIDs), 1)
+
+	sell(t, ex, 1)
+	record, _, _ = db.OrderGroup(group.ID)
+	assert(t, record.Status, store.GroupActive)
+	assert(t, len(record.OrderIDs), 3)
+
+	takeProfit, _, _ := db.Order(record.OrderIDs[1])
+	assert(t, takeProfit.Bid, false)
+	assert(t, takeProfit.Price, 1_200.0)
+	assert(t, takeProfit.Size, 2.0)
+	stopLoss, _, _ := db.Order(record.OrderIDs[2])
+	assert(t, stopLoss.Status, orderbook.StatusPending)
+	assert(t, stopLoss.StopPrice, 900.0)
+
+	// canceling the take-profit cancels the stop-loss with the group
+	if err := ex.handleCancelOrder(MarketETH, takeProfit.ID); err != nil {
+		t.Fatal(err)
+	}
+	record, _, _ = db.OrderGroup(group.ID)
+	assert(t, record.Status, store.GroupCanceled)
+	stopLoss, _, _ = db.Order(record.OrderIDs[2])
+	assert(t, stopLoss.Status, orderbook.StatusCanceled)
+}
+
+func TestBracketExitFailureKeepsTheOtherExit(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	engine, _ := ex.engine(MarketETH)
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		group, _, err := ex.placeGroup(ob, MarketETH, PlaceGroupRequest{
+			UserID:          1,
+			Market:          MarketETH,
+			Type:            store.GroupBracket,
+			Orders:          []PlaceOrderRequest{{Type: LimitOrder, Bid: true, Size: 1, Price: 1_000}},
+			TakeProfitPrice: 1_200,
+			StopLossPrice:   900,
+		})
+		return group, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := result.(store.OrderGroupRecord)
+
+	// the take-profit is out of the price band once the entry fills
+	ex.risk.setOverride(1, RiskLimits{PriceBandPercent: 10})
+	sell(t, ex, 1)
+
+	record, _, _ := db.OrderGroup(group.ID)
+	assert(t, record.Status, store.GroupActive)
+	assert(t, len(record.OrderIDs), 3)
+	takeProfit, _, _ := db.Order(record.OrderIDs[1])
+	assert(t, takeProfit.Status, orderbook.StatusRejected)
+	assert(t, takeProfit.GroupID, group.ID)
+	stopLoss, _, _ := db.Order(record.OrderIDs[2])
+	assert(t, stopLoss.Status, orderbook.StatusPending)
+	assert(t, stopLoss.Bid, false)
+}
+
+func TestBracketEntryCanceledAfterPartialFill(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	engine, _ := ex.engine(MarketETH)
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		group, _, err := ex.placeGroup(ob, MarketETH, PlaceGroupRequest{
+			UserID:          1,
+			Market:          MarketETH,
+			Type:            store.GroupBracket,
+			Orders:          []PlaceOrderRequest{{Type: LimitOrder, Bid: true, Size: 2, Price: 1_000}},
+			TakeProfitPrice: 1_200,
+			StopLossPrice:   900,
+		})
+		return group, err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := result.(store.OrderGroupRecord)
+
+	sell(t, ex, 0.5)
+	if err := ex.handleCancelOrder(MarketETH, group.EntryID); err != nil {
+		t.Fatal(err)
+	}
+
+	// the exits close the part of the entry that filled
+	record, _, _ := db.OrderGroup(group.ID)
+	assert(t, record.Status, store.GroupActive)
+	assert(t, len(record.OrderIDs), 3)
+	takeProfit, _, _ := db.Order(record.OrderIDs[1])
+	assert(t, takeProfit.Status, orderbook.StatusNew)
+	assert(t, takeProfit.Size, 0.5)
+	stopLoss, _, _ := db.Order(record.OrderIDs[2])
+	assert(t, stopLoss.Status, orderbook.StatusPending)
+	assert(t, stopLoss.Size, 0.5)
+
+	// only the owner reads and cancels the group
+	id := strconv.FormatInt(group.ID, 10)
+	resp := store.OrderGroupRecord{}
+	assert(t, doGetAuth(t, ex.handleGetGroup, "/groups/"+id, userKey(ex, 2), "id", id, &resp), http.StatusForbidden)
+	req := httptest.NewRequest(http.MethodDelete, "/groups/"+id, nil)
+	req.Header.Set(HeaderAPIKey, userKey(ex, 2))
+	assert(t, doRequest(t, ex.handleCancelGroup, req, []string{"id"}, []string{id}, &resp), http.StatusForbidden)
+
+	req = httptest.NewRequest(http.MethodDelete, "/groups/"+id, nil)
+	req.Header.Set(HeaderAPIKey, userKey(ex, 1))
+	assert(t, doRequest(t, ex.handleCancelGroup, req, []string{"id"}, []string{id}, &resp), http.StatusOK)
+	assert(t, resp.Status, store.GroupCanceled)
+}
+
+func TestPlaceGroupValidation(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	defer ex.Close()
+
+	for _, req := range []PlaceGroupRequest{
+		{Type: store.GroupOCO, Orders: []PlaceOrderRequest{{Type: LimitOrder, Size: 1, Price: 900}}},
+		{Type: store.GroupOCO, Orders: []PlaceOrderRequest{{Type: MarketOrder, Size: 1}, {Type: LimitOrder, Size: 1, Price: 900}}},
+		{Type: store.GroupOCO, Orders: []PlaceOrderRequest{{Type: LimitOrder, Bid: true, Size: 1, Price: 900}, {Type: LimitOrder, Size: 1, Price: 900}}},
+		{Type: store.GroupBracket, Orders: []PlaceOrderRequest{{Type: LimitOrder, Bid: true, Size: 1, Price: 1_000}}, TakeProfitPrice: 900, StopLossPrice: 1_100},
+	} {
+		if err := validateGroup(req); err == nil {
+			t.Errorf("%+v: expected an error", req)
+		}
+	}
+}
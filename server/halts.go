@@ -0,0 +1,465 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MarketOpen   MarketStatus = "OPEN"
+	MarketHalted MarketStatus = "HALTED"
+	// MarketAuction is the call period of an opening or reopening auction.
+	MarketAuction MarketStatus = "AUCTION"
+
+	StreamStatus  StreamMessageType = "STATUS"
+	StreamAuction StreamMessageType = "AUCTION"
+)
+
+var (
+	ErrMarketHalted    = errors.New("market is halted")
+	ErrMarketInAuction = errors.New("market is in an auction")
+)
+
+type (
+	MarketStatus string
+	// CircuitBreakerConfig halts a market for Cooldown when its last price
+	// moves more than MaxMovePercent from any trade within Window. Zero
+	// MaxMovePercent disables the circuit breaker. Halted markets reopen
+	// through an auction with a call period of ReopeningAuction.
+	CircuitBreakerConfig struct {
+		MaxMovePercent   float64
+		Window           time.Duration
+		Cooldown         time.Duration
+		ReopeningAuction time.Duration
+	}
+	// MarketState is the trading status of a market. Timestamps are in unix
+	// nanoseconds. ResumeAt is when the halt or auction ends, zero for halts
+	// that only an admin can lift.
+	MarketState struct {
+		Market   Market
+		Status   MarketStatus
+		Reason   string `json:",omitempty"`
+		Since    int64
+		ResumeAt int64 `json:",omitempty"`
+	}
+	HaltRequest struct {
+		Reason string
+	}
+	// AuctionResponse is the indicative result of the auction of a market
+	// in its call period. Crossed is false while no orders cross.
+	AuctionResponse struct {
+		Market  Market
+		Crossed bool
+		orderbook.Auction
+	}
+)
+
+func DefaultCircuitBreakerConfig() CircuitBreakerConfig {
+	return CircuitBreakerConfig{
+		MaxMovePercent:   10,
+		Window:           5 * time.Minute,
+		Cooldown:         5 * time.Minute,
+		ReopeningAuction: 30 * time.Second,
+	}
+}
+
+type pricePoint struct {
+	price     float64
+	timestamp int64
+}
+
+type marketState struct {
+	state MarketState
+	// prices holds the trades within the circuit breaker window
+	prices []pricePoint
+	// changes counts the status changes so a stale timer does not act on a
+	// newer status
+	changes int
+	next    *time.Timer
+}
+
+// marketStates holds the trading status of every market. Status changes
+// are passed to publish.
+type marketStates struct {
+	cfg     CircuitBreakerConfig
+	publish func(state MarketState)
+
+	mu      sync.Mutex
+	markets map[Market]*marketState
+}
+
+func newMarketStates(cfg CircuitBreakerConfig, markets []Market, publish func(state MarketState)) *marketStates {
+	ms := &marketStates{
+		cfg:     cfg,
+		publish: publish,
+		markets: make(map[Market]*marketState),
+	}
+	now := time.Now().UnixNano()
+	for _, market := range markets {
+		ms.markets[market] = &marketState{
+			state: MarketState{Market: market, Status: MarketOpen, Since: now},
+		}
+	}
+
+	return ms
+}
+
+func (ms *marketStates) status(market Market) (MarketState, bool) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	m, ok := ms.markets[market]
+	if !ok {
+		return MarketState{}, false
+	}
+
+	return m.state, true
+}
+
+// set changes the status of the market. Unless next is nil it is called
+// after the delay, provided the status did not change in the meantime.
+func (ms *marketStates) set(market Market, status MarketStatus, reason string, delay time.Duration, next func()) MarketState {
+	ms.mu.Lock()
+	m := ms.markets[market]
+
+	now := time.Now()
+	m.changes++
+	if m.next != nil {
+		m.next.Stop()
+		m.next = nil
+	}
+	if status != m.state.Status {
+		// the move that caused a halt must not trip the breaker again
+		m.prices = nil
+	}
+	m.state = MarketState{
+		Market: market,
+		Status: status,
+		Reason: reason,
+		Since:  now.UnixNano(),
+	}
+	if next != nil {
+		changes := m.changes
+		m.state.ResumeAt = now.Add(delay).UnixNano()
+		m.next = time.AfterFunc(delay, func() {
+			ms.mu.Lock()
+			stale := m.changes != changes
+			ms.mu.Unlock()
+
+			if !stale {
+				next()
+			}
+		})
+	}
+	state := m.state
+	ms.mu.Unlock()
+
+	sugar.Infow("market status changed", "market", market, "status", status, "reason", reason)
+	ms.publish(state)
+
+	return state
+}
+
+// observe feeds the trades of the market to its circuit breaker and returns
+// why the market must halt, if it must.
+func (ms *marketStates) observe(market Market, trades []*orderbook.Trade) (string, bool) {
+	if ms.cfg.MaxMovePercent <= 0 || len(trades) == 0 {
+		return "", false
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	m, ok := ms.markets[market]
+	if !ok || m.state.Status != MarketOpen {
+		return "", false
+	}
+
+	for _, trade := range trades {
+		m.prices = append(m.prices, pricePoint{trade.Price, trade.Timestamp})
+	}
+	last := m.prices[len(m.prices)-1]
+	cutoff := last.timestamp - int64(ms.cfg.Window)
+	i := 0
+	for ; i < len(m.prices) && m.prices[i].timestamp < cutoff; i++ {
+	}
+	m.prices = m.prices[i:]
+
+	move := 0.0
+	for _, p := range m.prices {
+		move = math.Max(move, math.Abs(last.price-p.price)/p.price*100)
+	}
+	if move <= ms.cfg.MaxMovePercent {
+		return "", false
+	}
+
+	return fmt.Sprintf("circuit breaker: price moved %.2f%% within %s", move, ms.cfg.Window), true
+}
+
+func (ms *marketStates) stop() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, m := range ms.markets {
+		m.changes++
+		if m.next != nil {
+			m.next.Stop()
+		}
+	}
+}
+
+// haltMarket stops matching in the market and starts collecting orders for
+// the reopening auction. With a cooldown the market reopens by itself once
+// it passed. It runs on the matching goroutine of the market.
+func (ex *Exchange) haltMarket(ob *orderbook.Orderbook, market Market, reason string, cooldown time.Duration) MarketState {
+	ob.StartAuction()
+
+	var reopen func()
+	if cooldown > 0 {
+		reopen = func() {
+			if err := ex.reopenMarket(market); err != nil {
+				sugar.Errorw("failed to reopen market", "market", market, "err", err)
+			}
+		}
+	}
+
+	return ex.states.set(market, MarketHalted, reason, cooldown, reopen)
+}
+
+// startAuction starts a call period that ends with the book being uncrossed
+// after the period. It runs on the matching goroutine of the market.
+func (ex *Exchange) startAuction(ob *orderbook.Orderbook, market Market, period time.Duration) MarketState {
+	ob.StartAuction()
+
+	return ex.states.set(market, MarketAuction, "", period, func() {
+		matches, err := ex.uncrossMarket(market)
+		if err == nil {
+			err = ex.handleMatches(market, matches)
+		}
+		if err != nil {
+			sugar.Errorw("failed to uncross market", "market", market, "err", err)
+		}
+	})
+}
+
+// reopenMarket moves a halted market to its reopening auction.
+func (ex *Exchange) reopenMarket(market Market) error {
+	engine, ok := ex.engine(market)
+	if !ok {
+		return fmt.Errorf("orderbook not found: %s", market)
+	}
+
+	_, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		if state, _ := ex.states.status(market); state.Status == MarketHalted {
+			ex.startAuction(ob, market, ex.states.cfg.ReopeningAuction)
+		}
+		return nil, nil
+	})
+
+	return err
+}
+
+// uncrossMarket ends the call period of the market and opens it for
+// continuous trading. The auction trades are handled while the market is
+// still in its auction, see openUncrossed. The returned matches are not
+// settled yet.
+func (ex *Exchange) uncrossMarket(market Market) ([]orderbook.Match, error) {
+	engine, ok := ex.engine(market)
+	if !ok {
+		return nil, fmt.Errorf("orderbook not found: %s", market)
+	}
+
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		if state, _ := ex.states.status(market); state.Status != MarketAuction {
+			return []orderbook.Match{}, nil
+		}
+
+		// filled orders leave their limit, remember their price to persist them
+		prices := make(map[int64]float64, len(ob.Orders))
+		for id, order := range ob.Orders {
+			prices[id] = order.Limit.Price
+		}
+
+		n := len(ob.Trades)
+		matches := ob.Uncross()
+		// with trades the market opens once the trade handlers saw them
+		if len(ob.Trades) == n {
+			ex.states.set(market, MarketOpen, "", 0, nil)
+		}
+
+		for _, match := range matches {
+			for _, order := range []*orderbook.Order{match.Bid, match.Ask} {
+				if err := ex.saveOrder(market, prices[order.ID], order); err != nil {
+					sugar.Error(err)
+				}
+				if order.IsFilled() {
+					ex.removeUserOrder(order)
+				}
+			}
+		}
+		for _, trade := range ob.Trades[n:] {
+			if err := ex.store.SaveTrade(string(market), trade); err != nil {
+				sugar.Error(err)
+			}
+		}
+
+		return matches, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.([]orderbook.Match), nil
+}
+
+// openUncrossed opens a market for continuous trading once the trades of
+// its uncross were handled in the auction state, so the circuit breaker
+// does not take the jump to the auction price for a continuous move. It
+// runs on the matching goroutine of the market.
+func (ex *Exchange) openUncrossed(ob *orderbook.Orderbook, market Market) {
+	if state, _ := ex.states.status(market); state.Status == MarketAuction && !ob.InAuction() {
+		ex.states.set(market, MarketOpen, "", 0, nil)
+	}
+}
+
+// restoreMarketState halts the market or restarts its auction as it was
+// stored before a restart. A cooldown that ran out in the meantime moves
+// the market to its reopening auction. It runs before the engine of the
+// market is started.
+func (ex *Exchange) restoreMarketState(ob *orderbook.Orderbook, market Market, state store.MarketStateRecord) {
+	left := time.Until(time.Unix(0, state.ResumeAt))
+	switch {
+	case MarketStatus(state.Status) == MarketAuction:
+		ex.startAuction(ob, market, max(left, 0))
+	case state.ResumeAt == 0:
+		ex.haltMarket(ob, market, state.Reason, 0)
+	case left > 0:
+		ex.haltMarket(ob, market, state.Reason, left)
+	default:
+		ex.startAuction(ob, market, ex.states.cfg.ReopeningAuction)
+	}
+}
+
+// marketStateChanged persists a status change of the market and publishes
+// it.
+func (ex *Exchange) marketStateChanged(state MarketState) {
+	err := ex.store.SaveMarketState(store.MarketStateRecord{
+		Market:   string(state.Market),
+		Status:   string(state.Status),
+		Reason:   state.Reason,
+		Since:    state.Since,
+		ResumeAt: state.ResumeAt,
+	})
+	if err != nil {
+		sugar.Errorw("failed to save market status", "market", state.Market, "err", err)
+	}
+	ex.publishMarketState(state)
+}
+
+// auctionPublisher pushes the indicative price and volume of the market to
+// the stream whenever they change during a call period.
+func (ex *Exchange) auctionPublisher(market Market) func(view *BookView) {
+	var last *orderbook.Auction
+
+	return func(view *BookView) {
+		if view.Auction == nil || (last != nil && *view.Auction == *last) {
+			last = view.Auction
+			return
+		}
+		last = view.Auction
+
+		ex.stream.Publish(StreamMessage{
+			Type:   StreamAuction,
+			Market: market,
+			Data:   *view.Auction,
+		})
+	}
+}
+
+func (ex *Exchange) publishMarketState(state MarketState) {
+	ex.stream.Publish(StreamMessage{
+		Type:   StreamStatus,
+		Market: state.Market,
+		Data:   state,
+	})
+}
+
+func (ex *Exchange) handleGetMarketStatus(c echo.Context) error {
+	state, ok := ex.states.status(Market(c.Param("market")))
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	return c.JSON(http.StatusOK, state)
+}
+
+// handleHaltMarket halts a market until an admin resumes it.
+func (ex *Exchange) handleHaltMarket(c echo.Context) error {
+	var req HaltRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid request"})
+	}
+	if req.Reason == "" {
+		req.Reason = "halted by admin"
+	}
+
+	market := Market(c.Param("market"))
+	engine, ok := ex.engine(market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	state, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		return ex.haltMarket(ob, market, req.Reason, 0), nil
+	})
+	if err != nil {
+		return engineError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, state)
+}
+
+// handleResumeMarket reopens a halted market through its reopening auction.
+func (ex *Exchange) handleResumeMarket(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.engine(market); !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	if err := ex.reopenMarket(market); err != nil {
+		return engineError(c, err)
+	}
+	state, _ := ex.states.status(market)
+
+	return c.JSON(http.StatusOK, state)
+}
+
+func (ex *Exchange) handleGetAuction(c echo.Context) error {
+	market := Market(c.Param("market"))
+	engine, ok := ex.engine(market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	view := engine.View()
+	if !view.InAuction {
+		return c.JSON(http.StatusBadRequest, APIError{"market is not in an auction"})
+	}
+
+	resp := AuctionResponse{Market: market}
+	if view.Auction != nil {
+		resp.Auction = *view.Auction
+		resp.Crossed = true
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+// waitForStatus polls the status of the market until it is want.
+func waitForStatus(t *testing.T, ex *Exchange, want MarketStatus) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for state, _ := ex.states.status(MarketETH); state.Status != want; state, _ = ex.states.status(MarketETH) {
+		if time.Now().After(deadline) {
+			t.Fatalf("market is %s, want %s", state.Status, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCircuitBreakerHaltsAndResumes(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	defer ex.Close()
+	ex.states.cfg = CircuitBreakerConfig{
+		MaxMovePercent:   5,
+		Window:           time.Minute,
+		Cooldown:         50 * time.Millisecond,
+		ReopeningAuction: 20 * time.Millisecond,
+	}
+	sub := ex.stream.subscribe(MarketETH)
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 1, 1))
+	ex.handlePlaceLimitOrder(MarketETH, 1_100, orderbook.NewOrder(false, 1, 1))
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 2, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := ex.states.status(MarketETH)
+	assert(t, state.Status, MarketHalted)
+	assert(t, state.ResumeAt > 0, true)
+
+	// resting orders and cancels are accepted, matching is not
+	bid := orderbook.NewOrder(true, 1, 1)
+	assert(t, ex.handlePlaceLimitOrder(MarketETH, 1_050, bid), nil)
+	_, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(false, 1, 2))
+	assert(t, err, ErrMarketHalted)
+	assert(t, ex.handleCancelOrder(MarketETH, bid.ID), nil)
+
+	waitForStatus(t, ex, MarketOpen)
+
+	// the status is published right after it changed
+	statuses := []MarketStatus{}
+	timeout := time.After(2 * time.Second)
+	for len(statuses) == 0 || statuses[len(statuses)-1] != MarketOpen {
+		select {
+		case msg := <-sub.sendch:
+			if msg.Type == StreamStatus {
+				statuses = append(statuses, msg.Data.(MarketState).Status)
+			}
+		case <-timeout:
+			t.Fatalf("statuses %v, want the market to reopen", statuses)
+		}
+	}
+	// halted markets reopen through an auction
+	assert(t, statuses, []MarketStatus{MarketHalted, MarketAuction, MarketOpen})
+}
+
+func TestAdminHalt(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	defer ex.Close()
+	ex.adminKeys["secret"] = true
+
+	e := echo.New()
+	e.GET("/markets/:market/status", ex.handleGetMarketStatus)
+	admin := e.Group("/admin", ex.requireAdmin)
+	admin.POST("/markets/:market/halt", ex.handleHaltMarket)
+	admin.POST("/markets/:market/resume", ex.handleResumeMarket)
+
+	do := func(method, target, body string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set(HeaderAdminKey, "secret")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert(t, do(http.MethodPost, "/admin/markets/BTC/halt", `{}`), http.StatusBadRequest)
+	assert(t, do(http.MethodPost, "/admin/markets/ETH/halt", `{"Reason":"maintenance"}`), http.StatusOK)
+
+	state := MarketState{}
+	doGet(t, ex.handleGetMarketStatus, "/markets/ETH/status", "market", "ETH", &state)
+	assert(t, state.Status, MarketHalted)
+	assert(t, state.Reason, "maintenance")
+	// manual halts are only lifted by an admin
+	assert(t, state.ResumeAt, int64(0))
+
+	ex.states.cfg.ReopeningAuction = 20 * time.Millisecond
+	assert(t, do(http.MethodPost, "/admin/markets/ETH/resume", ""), http.StatusOK)
+	state, _ = ex.states.status(MarketETH)
+	assert(t, state.Status, MarketAuction)
+	assert(t, state.ResumeAt > 0, true)
+}
+
+func TestReopeningAuction(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	defer ex.Close()
+	ex.states.cfg.ReopeningAuction = time.Hour
+	sub := ex.stream.subscribe(MarketETH)
+
+	engine, _ := ex.engine(MarketETH)
+	engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		return ex.haltMarket(ob, MarketETH, "maintenance", 0), nil
+	})
+
+	// orders crossing during the halt wait for the auction
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 1, 1))
+	ex.handlePlaceLimitOrder(MarketETH, 1_040, orderbook.NewOrder(false, 1, 1))
+	ex.handlePlaceLimitOrder(MarketETH, 1_050, orderbook.NewOrder(true, 2, 2))
+	ex.handlePlaceLimitOrder(MarketETH, 1_020, orderbook.NewOrder(true, 1, 2))
+	assert(t, len(engine.View().Trades), 0)
+
+	resp := AuctionResponse{}
+	assert(t, doGet(t, ex.handleGetAuction, "/auction/ETH", "market", "ETH", &resp), http.StatusOK)
+	assert(t, resp.Crossed, true)
+	assert(t, resp.Auction, orderbook.Auction{Price: 1_040, Volume: 2, Imbalance: 0})
+
+	if err := ex.reopenMarket(MarketETH); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 1, 2))
+	assert(t, err, ErrMarketInAuction)
+
+	matches, err := ex.uncrossMarket(MarketETH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, len(matches), 2)
+	state, _ := ex.states.status(MarketETH)
+	assert(t, state.Status, MarketOpen)
+	assert(t, doGet(t, ex.handleGetAuction, "/auction/ETH", "market", "ETH", &resp), http.StatusBadRequest)
+
+	view := engine.View()
+	assert(t, len(view.Trades), 2)
+	for _, trade := range view.Trades {
+		assert(t, trade.Price, 1_040.0)
+	}
+	assert(t, view.TotalBidVolume, 1.0)
+	assert(t, view.TotalAskVolume, 0.0)
+	assert(t, len(ex.Orders[1]), 0)
+	assert(t, len(ex.Orders[2]), 1)
+
+	auctions := 0
+	for len(sub.sendch) > 0 {
+		if msg := <-sub.sendch; msg.Type == StreamAuction {
+			auctions++
+		}
+	}
+	// the indicative result is published whenever it changes
+	assert(t, auctions > 0, true)
+}
+
+func TestUncrossTradesAreHandledInTheAuction(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+	ex.states.cfg = CircuitBreakerConfig{
+		MaxMovePercent:   5,
+		Window:           time.Minute,
+		Cooldown:         time.Hour,
+		ReopeningAuction: time.Hour,
+	}
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 1, 1))
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	ex.handlePlaceLimitOrder(MarketETH, 1_200, orderbook.NewOrder(false, 1, 1))
+	_, resp := placeOrder(t, ex, PlaceOrderRequest{UserID: 3, Type: MarketOrder, Bid: true, Size: 1, StopPrice: 1_050, Market: MarketETH})
+
+	engine, _ := ex.engine(MarketETH)
+	engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		return ex.haltMarket(ob, MarketETH, "maintenance", 0), nil
+	})
+	ex.handlePlaceLimitOrder(MarketETH, 1_100, orderbook.NewOrder(false, 1, 1))
+	ex.handlePlaceLimitOrder(MarketETH, 1_100, orderbook.NewOrder(true, 1, 2))
+	if err := ex.reopenMarket(MarketETH); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.uncrossMarket(MarketETH); err != nil {
+		t.Fatal(err)
+	}
+
+	// the jump to the auction price does not trip the circuit breaker
+	state, _ := ex.states.status(MarketETH)
+	assert(t, state.Status, MarketOpen)
+	// but it triggers the stops once the market is open
+	record, _, _ := db.Order(resp.OrderID)
+	assert(t, record.Status, orderbook.StatusFilled)
+	assert(t, record.AvgPrice, 1_200.0)
+}
+
+func TestMarketHaltsSurviveRestart(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	engine, _ := ex.engine(MarketETH)
+	engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		return ex.haltMarket(ob, MarketETH, "maintenance", 0), nil
+	})
+	ex.Close()
+
+	ex = newTestExchange(t, db)
+	state, _ := ex.states.status(MarketETH)
+	assert(t, state.Status, MarketHalted)
+	assert(t, state.Reason, "maintenance")
+	assert(t, state.ResumeAt, int64(0))
+	_, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 1, 2))
+	assert(t, err, ErrMarketHalted)
+	engine, _ = ex.engine(MarketETH)
+	engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		return ex.haltMarket(ob, MarketETH, "circuit breaker", time.Millisecond), nil
+	})
+	ex.Close()
+
+	// a cooldown that ran out while the exchange was down moves the market
+	// to its reopening auction
+	time.Sleep(5 * time.Millisecond)
+	ex = newTestExchange(t, db)
+	defer ex.Close()
+	state, _ = ex.states.status(MarketETH)
+	assert(t, state.Status, MarketAuction)
+	assert(t, state.ResumeAt > 0, true)
+}
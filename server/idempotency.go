@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultClientOrderIDWindow = 24 * time.Hour
+	maxClientOrderIDLength     = 64
+)
+
+type clientOrderKey struct {
+	userID        int64
+	clientOrderID string
+}
+
+// clientOrderEntry is the result of the first request placing an order with
+// a client order ID. done is closed once the result is known.
+type clientOrderEntry struct {
+	done      chan struct{}
+	code      int
+	body      any
+	createdAt time.Time
+}
+
+// clientOrderIDs remembers the orders placed with a client order ID within
+// the window so that retries return the original result.
+type clientOrderIDs struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[clientOrderKey]*clientOrderEntry
+	// keys holds the keys in the order they were reserved for eviction
+	keys []clientOrderKey
+	now  func() time.Time
+}
+
+func newClientOrderIDs(window time.Duration) *clientOrderIDs {
+	return &clientOrderIDs{
+		window:  window,
+		entries: make(map[clientOrderKey]*clientOrderEntry),
+		now:     time.Now,
+	}
+}
+
+// reserve returns the entry of the key. The caller owns the entry, and must
+// finish it, if no request with the key was seen within the window.
+func (ids *clientOrderIDs) reserve(key clientOrderKey) (*clientOrderEntry, bool) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	now := ids.now()
+	ids.evict(now)
+
+	if entry, ok := ids.entries[key]; ok {
+		return entry, false
+	}
+
+	entry := &clientOrderEntry{
+		done:      make(chan struct{}),
+		createdAt: now,
+	}
+	ids.entries[key] = entry
+	ids.keys = append(ids.keys, key)
+
+	return entry, true
+}
+
+// finish records the result of the request owning the entry. Results of
+// requests that failed on the exchange side are not kept so the order can be
+// retried.
+func (ids *clientOrderIDs) finish(key clientOrderKey, entry *clientOrderEntry, code int, body any) {
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+
+	entry.code = code
+	entry.body = body
+	close(entry.done)
+
+	if code >= http.StatusInternalServerError {
+		delete(ids.entries, key)
+	}
+}
+
+// recent reports whether an order placed at timestamp is within the window.
+func (ids *clientOrderIDs) recent(timestamp int64) bool {
+	return ids.now().Sub(time.Unix(0, timestamp)) < ids.window
+}
+
+func (ids *clientOrderIDs) evict(now time.Time) {
+	i := 0
+	for ; i < len(ids.keys); i++ {
+		entry, ok := ids.entries[ids.keys[i]]
+		if ok && now.Sub(entry.createdAt) < ids.window {
+			break
+		}
+		if ok {
+			delete(ids.entries, ids.keys[i])
+		}
+	}
+	ids.keys = ids.keys[i:]
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+// userKey returns the API key of a user, registering it on first use.
+func userKey(ex *Exchange, userID int64) string {
+	key := fmt.Sprintf("user-%d", userID)
+	if _, ok := ex.limiter.cfg.APIKeys[key]; !ok {
+		ex.limiter.cfg.APIKeys[key] = userID
+	}
+
+	return key
+}
+
+func placeOrder(t *testing.T, ex *Exchange, req PlaceOrderRequest) (int, PlaceOrderResponse) {
+	t.Helper()
+
+	body, _ := json.Marshal(req)
+	rec := httptest.NewRecorder()
+	httpReq := httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader(body))
+	httpReq.Header.Set(HeaderAPIKey, userKey(ex, req.UserID))
+	c := echo.New().NewContext(httpReq, rec)
+	if err := ex.handlePlaceOrder(c); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := PlaceOrderResponse{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+// getClientOrder gets the order "order-1" of user 1 with an API key.
+func getClientOrder(t *testing.T, ex *Exchange, apiKey string, order *store.OrderRecord) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, "/orders/client/1/order-1", nil)
+	req.Header.Set(HeaderAPIKey, apiKey)
+	return doRequest(t, ex.handleGetClientOrder, req, []string{"userID", "clientOrderID"}, []string{"1", "order-1"}, order)
+}
+
+func TestClientOrderIDIsIdempotent(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	req := PlaceOrderRequest{
+		UserID:        1,
+		Type:          LimitOrder,
+		Size:          1,
+		Price:         1_000,
+		Market:        MarketETH,
+		ClientOrderID: "order-1",
+	}
+	// register the key before the concurrent requests only read it
+	userKey(ex, req.UserID)
+
+	var (
+		wg  sync.WaitGroup
+		ids = make([]int64, 10)
+	)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			code, resp := placeOrder(t, ex, req)
+			assert(t, code, http.StatusOK)
+			assert(t, resp.ClientOrderID, "order-1")
+			ids[i] = resp.OrderID
+		}(i)
+	}
+	wg.Wait()
+
+	for _, id := range ids {
+		assert(t, id, ids[0])
+	}
+	view, _ := ex.engine(MarketETH)
+	assert(t, view.View().TotalAskVolume, 1.0)
+
+	// the same ID of another user is another order
+	req.UserID = 2
+	_, resp := placeOrder(t, ex, req)
+	assert(t, resp.OrderID != ids[0], true)
+
+	order := store.OrderRecord{}
+	assert(t, getClientOrder(t, ex, userKey(ex, 2), &order), http.StatusForbidden)
+	assert(t, getClientOrder(t, ex, userKey(ex, 1), &order), http.StatusOK)
+	assert(t, order.ID, ids[0])
+	assert(t, order.Status, orderbook.StatusNew)
+
+	// only the user can cancel the order
+	for _, tc := range []struct {
+		key  string
+		code int
+	}{
+		{"", http.StatusUnauthorized},
+		{userKey(ex, 2), http.StatusForbidden},
+		{userKey(ex, 1), http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodDelete, "/order/client/1/order-1", nil)
+		req.Header.Set(HeaderAPIKey, tc.key)
+		resp := map[string]any{}
+		assert(t, doRequest(t, ex.handleCancelClientOrder, req, []string{"userID", "clientOrderID"}, []string{"1", "order-1"}, &resp), tc.code)
+	}
+
+	getClientOrder(t, ex, userKey(ex, 1), &order)
+	assert(t, order.Status, orderbook.StatusCanceled)
+}
+
+func TestClientOrderIDSurvivesRestart(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	req := PlaceOrderRequest{
+		UserID:        1,
+		Type:          LimitOrder,
+		Size:          1,
+		Price:         1_000,
+		Market:        MarketETH,
+		ClientOrderID: "order-1",
+	}
+	_, first := placeOrder(t, ex, req)
+	ex.Close()
+
+	ex = newTestExchange(t, db)
+	_, retry := placeOrder(t, ex, req)
+	assert(t, retry.OrderID, first.OrderID)
+	engine, _ := ex.engine(MarketETH)
+	assert(t, engine.View().TotalAskVolume, 1.0)
+}
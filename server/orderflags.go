@@ -0,0 +1,109 @@
+package server
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+)
+
+// DefaultTickSize is the tick size of markets without one in the config.
+const DefaultTickSize = 0.01
+
+var (
+	ErrPostOnly   = errors.New("post-only order would cross the spread")
+	ErrReduceOnly = errors.New("reduce-only order would not reduce the position")
+)
+
+func validPostOnly(postOnly orderbook.PostOnly) bool {
+	return postOnly == "" || postOnly == orderbook.PostOnlyReject || postOnly == orderbook.PostOnlySlide
+}
+
+// reduces reports whether an order on the side reduces the position.
+func reduces(bid bool, position float64) bool {
+	return (bid && position < 0) || (!bid && position > 0)
+}
+
+// checkReduceOnly makes sure a reduce-only order, together with the resting
+// reduce-only orders of the user, never exceeds the position of the user. It
+// runs on the matching goroutine of the market.
+func (ex *Exchange) checkReduceOnly(ob *orderbook.Orderbook, market Market, order *orderbook.Order) error {
+	if !order.ReduceOnly {
+		return nil
+	}
+
+	position, _ := ex.stats.risk(order.UserID, market, time.Now().UnixNano())
+	if !reduces(order.Bid, position) {
+		return ErrReduceOnly
+	}
+
+	open := 0.0
+	for _, o := range ob.Orders {
+		if o.UserID == order.UserID && o.ReduceOnly && o.Bid == order.Bid {
+			open += o.Size
+		}
+	}
+	if order.Size > math.Abs(position)-open {
+		return ErrReduceOnly
+	}
+
+	return nil
+}
+
+// enforceReduceOnly shrinks or cancels the resting reduce-only orders of the
+// users that traded so they never exceed the positions left. Older orders
+// keep their size first. It runs on the matching goroutine of the market.
+func (ex *Exchange) enforceReduceOnly(ob *orderbook.Orderbook, market Market, trades []*orderbook.Trade) {
+	users := make(map[int64]bool)
+	for _, trade := range trades {
+		users[trade.MakerUserID] = true
+		users[trade.TakerUserID] = true
+	}
+
+	orders := []*orderbook.Order{}
+	for _, order := range ob.Orders {
+		if order.ReduceOnly && users[order.UserID] {
+			orders = append(orders, order)
+		}
+	}
+	if len(orders) == 0 {
+		return
+	}
+	sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+
+	now := time.Now().UnixNano()
+	positions := make(map[int64]float64)
+	left := make(map[int64]float64)
+	for _, order := range orders {
+		position, ok := positions[order.UserID]
+		if !ok {
+			position, _ = ex.stats.risk(order.UserID, market, now)
+			positions[order.UserID] = position
+			left[order.UserID] = math.Abs(position)
+		}
+
+		price := order.Limit.Price
+		switch size := left[order.UserID]; {
+		case !reduces(order.Bid, position) || size <= 0:
+			if err := ex.cancelWorkingOrder(ob, market, order); err != nil {
+				sugar.Error(err)
+			}
+			continue
+		case order.Size <= size:
+			left[order.UserID] -= order.Size
+			continue
+		default:
+			if err := ob.AmendOrder(order.ID, price, size); err != nil {
+				sugar.Error(err)
+				continue
+			}
+			left[order.UserID] = 0
+		}
+
+		if err := ex.saveOrder(market, price, order); err != nil {
+			sugar.Error(err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+)
+
+func TestPostOnly(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 1, 1))
+
+	code, _ := placeOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: MarketOrder, Bid: true, Size: 1, Market: MarketETH, PostOnly: orderbook.PostOnlyReject})
+	assert(t, code, http.StatusBadRequest)
+
+	code, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 1, Price: 1_000, Market: MarketETH, PostOnly: orderbook.PostOnlyReject})
+	assert(t, code, http.StatusBadRequest)
+	rejected, _ := db.UserOrders(2, orderbook.StatusRejected)
+	assert(t, len(rejected), 1)
+
+	code, resp := placeOrder(t, ex, PlaceOrderRequest{UserID: 2, Type: LimitOrder, Bid: true, Size: 1, Price: 1_050, Market: MarketETH, PostOnly: orderbook.PostOnlySlide})
+	assert(t, code, http.StatusOK)
+	order, _, _ := db.Order(resp.OrderID)
+	assert(t, order.Price, 1_000-DefaultTickSize)
+	assert(t, order.PostOnly, orderbook.PostOnlySlide)
+
+	engine, _ := ex.engine(MarketETH)
+	assert(t, len(engine.View().Trades), 0)
+}
+
+func TestReduceOnly(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 2, 1))
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 2, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	reduceOnly := func(bid bool, price, size float64) (*orderbook.Order, error) {
+		order := orderbook.NewOrder(bid, size, 2)
+		order.ReduceOnly = true
+		return order, ex.handlePlaceLimitOrder(MarketETH, price, order)
+	}
+
+	// the position of user 2 is long 2
+	_, err := reduceOnly(true, 900, 1)
+	assert(t, err, ErrReduceOnly)
+	_, err = reduceOnly(false, 1_100, 3)
+	assert(t, err, ErrReduceOnly)
+	older, err := reduceOnly(false, 1_100, 1.5)
+	assert(t, err, nil)
+	_, err = reduceOnly(false, 1_200, 1)
+	assert(t, err, ErrReduceOnly)
+	newer, err := reduceOnly(false, 1_200, 0.5)
+	assert(t, err, nil)
+
+	// selling 1 leaves room for 1 of the resting reduce-only orders
+	ex.handlePlaceLimitOrder(MarketETH, 900, orderbook.NewOrder(true, 1, 3))
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(false, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	record, _, _ := db.Order(older.ID)
+	assert(t, record.Status, orderbook.StatusNew)
+	assert(t, record.Size, 1.0)
+	record, _, _ = db.Order(newer.ID)
+	assert(t, record.Status, orderbook.StatusCanceled)
+
+	engine, _ := ex.engine(MarketETH)
+	assert(t, engine.View().TotalAskVolume, 1.0)
+	assert(t, len(ex.Orders[2]), 1)
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+var orderStatuses = map[orderbook.OrderStatus]bool{
+	orderbook.StatusNew:             true,
+	orderbook.StatusPartiallyFilled: true,
+	orderbook.StatusFilled:          true,
+	orderbook.StatusCanceled:        true,
+	orderbook.StatusRejected:        true,
+	orderbook.StatusExpired:         true,
+	orderbook.StatusPending:         true,
+}
+
+// handleGetOrder returns the latest state of an order, including orders that
+// are no longer in the book.
+func (ex *Exchange) handleGetOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid order ID"})
+	}
+
+	order, ok, err := ex.store.Order(id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{"order not found"})
+	}
+	if ok, err := ex.authorize(c, order.UserID); !ok {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+// handleGetOrderHistory returns the orders of a user oldest first, optionally
+// filtered by status.
+func (ex *Exchange) handleGetOrderHistory(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.QueryParam("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+	if ok, err := ex.authorize(c, userID); !ok {
+		return err
+	}
+
+	status := orderbook.OrderStatus(c.QueryParam("status"))
+	if status != "" && !orderStatuses[status] {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid status"})
+	}
+
+	orders, err := ex.store.UserOrders(userID, status)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, orders)
+}
+
+// clientOrder looks up the order of the user and client order ID of the
+// request path once the API key of the request is the user's. It returns
+// false when the response has been written.
+func (ex *Exchange) clientOrder(c echo.Context) (store.OrderRecord, bool, error) {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return store.OrderRecord{}, false, c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+	if ok, err := ex.authorize(c, userID); !ok {
+		return store.OrderRecord{}, false, err
+	}
+
+	order, ok, err := ex.store.OrderByClientID(userID, c.Param("clientOrderID"))
+	if err != nil {
+		return store.OrderRecord{}, false, err
+	}
+	if !ok {
+		return store.OrderRecord{}, false, c.JSON(http.StatusNotFound, APIError{"order not found"})
+	}
+
+	return order, true, nil
+}
+
+func (ex *Exchange) handleGetClientOrder(c echo.Context) error {
+	order, ok, err := ex.clientOrder(c)
+	if !ok {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, order)
+}
+
+func (ex *Exchange) handleCancelClientOrder(c echo.Context) error {
+	order, ok, err := ex.clientOrder(c)
+	if !ok {
+		return err
+	}
+	if !(order.Status.IsOpen() || order.Status == orderbook.StatusPending) {
+		return c.JSON(http.StatusNotFound, APIError{"open order not found"})
+	}
+
+	if err := ex.handleCancelOrder(Market(order.Market), order.ID); err != nil {
+		return engineError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"msg": "order deleted"})
+}
+
+type CancelAllResponse struct {
+	Canceled []int64
+}
+
+// parseSide parses the side of an order, BID or ASK. An empty side matches
+// both sides.
+func parseSide(side string) (bid, both bool, err error) {
+	switch side {
+	case "":
+		return false, true, nil
+	case "BID":
+		return true, false, nil
+	case "ASK":
+		return false, false, nil
+	}
+
+	return false, false, fmt.Errorf("invalid side: %s", side)
+}
+
+// handleCancelAll cancels the open orders of a user, optionally only those
+// of a market and side. The orders of a market are canceled in a single
+// engine command so no order of the user can match in between. The API key
+// must belong to the user.
+func (ex *Exchange) handleCancelAll(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.QueryParam("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+	if ok, err := ex.authorize(c, userID); !ok {
+		return err
+	}
+	bid, bothSides, err := parseSide(c.QueryParam("side"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{err.Error()})
+	}
+
+	markets := ex.markets()
+	if market := Market(c.QueryParam("market")); market != "" {
+		if _, ok := ex.engine(market); !ok {
+			return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+		}
+		markets = []Market{market}
+	}
+
+	resp := CancelAllResponse{Canceled: []int64{}}
+	for _, market := range markets {
+		ids, err := ex.cancelAll(market, userID, func(o *orderbook.Order) bool {
+			return bothSides || o.Bid == bid
+		})
+		resp.Canceled = append(resp.Canceled, ids...)
+		if err != nil {
+			return engineError(c, err)
+		}
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// cancelAll cancels the open orders of the user in the market matching fn
+// and returns their IDs.
+func (ex *Exchange) cancelAll(market Market, userID int64, fn func(*orderbook.Order) bool) ([]int64, error) {
+	engine, ok := ex.engine(market)
+	if !ok {
+		return nil, fmt.Errorf("orderbook not found: %s", market)
+	}
+
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		orders := []*orderbook.Order{}
+		for _, order := range ob.Orders {
+			if order.UserID == userID && fn(order) {
+				orders = append(orders, order)
+			}
+		}
+		for _, stop := range ex.stops.filter(func(s *stopOrder) bool { return s.market == market }) {
+			if stop.order.UserID == userID && fn(stop.order) {
+				orders = append(orders, stop.order)
+			}
+		}
+		// cancel in ID order so the journal does not depend on map order
+		sort.Slice(orders, func(i, j int) bool { return orders[i].ID < orders[j].ID })
+
+		ids := make([]int64, 0, len(orders))
+		for _, order := range orders {
+			// orders of a group may be canceled with an earlier order
+			if _, ok := ex.workingOrder(ob, order.ID); ok {
+				ex.stats.addCancel(order)
+				if err := ex.cancelWorkingOrder(ob, market, order); err != nil {
+					sugar.Error(err)
+				}
+			}
+			ids = append(ids, order.ID)
+		}
+
+		return ids, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.([]int64), nil
+}
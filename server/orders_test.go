@@ -0,0 +1,106 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+func TestOrderStatusHistory(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+
+	ask := orderbook.NewOrder(false, 2, 1)
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, ask)
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 2, 2)); err != nil {
+		t.Fatal(err)
+	}
+	rejected := orderbook.NewOrder(true, 1, 2)
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, rejected); err == nil {
+		t.Fatal("expected the market order to be rejected")
+	}
+
+	order := store.OrderRecord{}
+	id := strconv.FormatInt(ask.ID, 10)
+	assert(t, doGetAuth(t, ex.handleGetOrder, "/orders/"+id, userKey(ex, 2), "id", id, &order), http.StatusForbidden)
+	assert(t, doGetAuth(t, ex.handleGetOrder, "/orders/"+id, userKey(ex, 1), "id", id, &order), http.StatusOK)
+	assert(t, order.Status, orderbook.StatusFilled)
+	assert(t, order.FilledSize, 2.0)
+	assert(t, order.AvgPrice, 1_000.0)
+
+	assert(t, doGet(t, ex.handleGetOrder, "/orders/999", "id", "999", &order), http.StatusNotFound)
+	assert(t, doGet(t, ex.handleGetOrders, "/order/1", "userID", "1", &GetOrdersResponse{}), http.StatusUnauthorized)
+
+	orders := []store.OrderRecord{}
+	assert(t, doGet(t, ex.handleGetOrderHistory, "/orders?userID=2", "", "", &orders), http.StatusUnauthorized)
+	assert(t, doGetAuth(t, ex.handleGetOrderHistory, "/orders?userID=2", userKey(ex, 1), "", "", &orders), http.StatusForbidden)
+	doGetAuth(t, ex.handleGetOrderHistory, "/orders?userID=2", userKey(ex, 2), "", "", &orders)
+	assert(t, len(orders), 2)
+	assert(t, orders[1].ID, rejected.ID)
+	assert(t, orders[1].Status, orderbook.StatusRejected)
+
+	orders = []store.OrderRecord{}
+	doGetAuth(t, ex.handleGetOrderHistory, "/orders?userID=2&status=FILLED", userKey(ex, 2), "", "", &orders)
+	assert(t, len(orders), 1)
+
+	assert(t, doGetAuth(t, ex.handleGetOrderHistory, "/orders?userID=2&status=OPEN", userKey(ex, 2), "", "", &orders), http.StatusBadRequest)
+}
+
+func TestCancelAll(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+
+	bidA := orderbook.NewOrder(true, 1, 1)
+	bidB := orderbook.NewOrder(true, 1, 1)
+	ask := orderbook.NewOrder(false, 1, 1)
+	other := orderbook.NewOrder(true, 1, 2)
+	ex.handlePlaceLimitOrder(MarketETH, 900, bidA)
+	ex.handlePlaceLimitOrder(MarketETH, 950, bidB)
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, ask)
+	ex.handlePlaceLimitOrder(MarketETH, 900, other)
+
+	ex.limiter.cfg.APIKeys["secret"] = 1
+	cancelAllWithKey := func(apiKey, query string) (int, CancelAllResponse) {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/orders?"+query, nil)
+		req.Header.Set(HeaderAPIKey, apiKey)
+		if err := ex.handleCancelAll(echo.New().NewContext(req, rec)); err != nil {
+			t.Fatal(err)
+		}
+		resp := CancelAllResponse{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	cancelAll := func(query string) (int, CancelAllResponse) {
+		return cancelAllWithKey("secret", query)
+	}
+
+	// only the user can cancel its orders
+	code, _ := cancelAllWithKey("", "userID=1")
+	assert(t, code, http.StatusUnauthorized)
+	code, _ = cancelAll("userID=2")
+	assert(t, code, http.StatusForbidden)
+	assert(t, other.Status, orderbook.StatusNew)
+
+	code, resp := cancelAll("userID=1&market=ETH&side=BID")
+	assert(t, code, http.StatusOK)
+	assert(t, resp.Canceled, []int64{bidA.ID, bidB.ID})
+	assert(t, bidA.Status, orderbook.StatusCanceled)
+	assert(t, ask.Status, orderbook.StatusNew)
+
+	_, resp = cancelAll("userID=1")
+	assert(t, resp.Canceled, []int64{ask.ID})
+
+	engine, _ := ex.engine(MarketETH)
+	view := engine.View()
+	assert(t, view.TotalAskVolume, 0.0)
+	assert(t, view.TotalBidVolume, 1.0)
+	assert(t, len(ex.Orders[1]), 0)
+
+	code, _ = cancelAll("userID=1&side=BUY")
+	assert(t, code, http.StatusBadRequest)
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+)
+
+var ErrNoPegReference = errors.New("no reference price for pegged order")
+
+func validatePeg(req PlaceOrderRequest) error {
+	if req.Peg == nil {
+		return nil
+	}
+	if req.Type != LimitOrder || req.StopPrice > 0 || req.trailing() {
+		return fmt.Errorf("only limit orders can be pegged")
+	}
+
+	return req.Peg.Validate()
+}
+
+// pegRepricer returns the command handler of the market that moves the
+// pegged orders with the top of the book. Pegged orders keep their price
+// while the market is halted or in an auction.
+func (ex *Exchange) pegRepricer(ob *orderbook.Orderbook, market Market) func() {
+	return func() {
+		if state, _ := ex.states.status(market); state.Status != MarketOpen {
+			return
+		}
+
+		for _, order := range ob.RepricePegged() {
+			if err := ex.saveOrder(market, order.Limit.Price, order); err != nil {
+				sugar.Error(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+)
+
+func TestPeggedOrder(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	defer ex.Close()
+
+	peg := &orderbook.Peg{Reference: orderbook.PegPrimary, Offset: 1}
+	code, _ := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 1, Market: MarketETH, Peg: peg})
+	assert(t, code, http.StatusBadRequest)
+	code, _ = placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: MarketOrder, Bid: true, Size: 1, Market: MarketETH, Peg: peg})
+	assert(t, code, http.StatusBadRequest)
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 5, 2))
+	ex.handlePlaceLimitOrder(MarketETH, 900, orderbook.NewOrder(true, 5, 2))
+
+	code, resp := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: true, Size: 1, Market: MarketETH, Peg: peg})
+	assert(t, code, http.StatusOK)
+	record, _, _ := db.Order(resp.OrderID)
+	assert(t, record.Price, 901.0)
+	assert(t, *record.Peg, *peg)
+
+	ex.handlePlaceLimitOrder(MarketETH, 950, orderbook.NewOrder(true, 1, 2))
+	record, _, _ = db.Order(resp.OrderID)
+	assert(t, record.Price, 951.0)
+
+	// a halted market keeps the pegged orders where they are
+	engine, _ := ex.engine(MarketETH)
+	engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		ex.haltMarket(ob, MarketETH, "test", 0)
+		return nil, nil
+	})
+	ex.handlePlaceLimitOrder(MarketETH, 960, orderbook.NewOrder(true, 1, 2))
+	record, _, _ = db.Order(resp.OrderID)
+	assert(t, record.Price, 951.0)
+}
+
+func TestPeggedOrderSurvivesRestart(t *testing.T) {
+	db, err := store.NewFileStore(filepath.Join(t.TempDir(), "exchange.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := newTestExchange(t, db)
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 5, 2))
+	ex.handlePlaceLimitOrder(MarketETH, 900, orderbook.NewOrder(true, 5, 2))
+	_, resp := placeOrder(t, ex, PlaceOrderRequest{UserID: 1, Type: LimitOrder, Bid: false, Size: 1, Market: MarketETH, Peg: &orderbook.Peg{Reference: orderbook.PegMid}})
+	ex.Close()
+
+	ex = newTestExchange(t, db)
+	defer ex.Close()
+
+	ex.handlePlaceLimitOrder(MarketETH, 980, orderbook.NewOrder(true, 1, 2))
+	record, _, _ := db.Order(resp.OrderID)
+	assert(t, record.Price, 990.0)
+	assert(t, record.Peg.Reference, orderbook.PegMid)
+}
@@ -0,0 +1,319 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ClassOrderEntry EndpointClass = "ORDER_ENTRY"
+	ClassCancel     EndpointClass = "CANCEL"
+	ClassMarketData EndpointClass = "MARKET_DATA"
+
+	TierDefault     Tier = "DEFAULT"
+	TierMarketMaker Tier = "MARKET_MAKER"
+
+	HeaderAPIKey = "X-Api-Key"
+
+	HeaderRateLimitLimit     = "X-Ratelimit-Limit"
+	HeaderRateLimitRemaining = "X-Ratelimit-Remaining"
+	HeaderRateLimitReset     = "X-Ratelimit-Reset"
+	HeaderOrderTradeRatio    = "X-Order-Trade-Ratio"
+
+	// sweepInterval is how often the limiter forgets idle callers.
+	sweepInterval = 1 * time.Minute
+)
+
+type (
+	EndpointClass string
+	Tier          string
+
+	// BucketConfig describes a token bucket: Rate tokens are added every
+	// second up to a maximum of Burst tokens.
+	BucketConfig struct {
+		Rate  float64
+		Burst float64
+	}
+	TierConfig struct {
+		Buckets map[EndpointClass]BucketConfig
+		// MaxOrderToTradeRatio is the maximum number of orders a user can
+		// place per trade inside RatioWindow. Zero disables the check.
+		MaxOrderToTradeRatio float64
+		// MinOrdersForRatio is the amount of orders a user can place in a
+		// window before the ratio is enforced.
+		MinOrdersForRatio int64
+	}
+	RateLimitConfig struct {
+		Tiers       map[Tier]TierConfig
+		RatioWindow time.Duration
+		// APIKeys maps an API key to the user it belongs to.
+		APIKeys   map[string]int64
+		UserTiers map[int64]Tier
+	}
+)
+
+func DefaultRateLimitConfig() RateLimitConfig {
+	return RateLimitConfig{
+		Tiers: map[Tier]TierConfig{
+			TierDefault: {
+				Buckets: map[EndpointClass]BucketConfig{
+					ClassOrderEntry: {Rate: 10, Burst: 20},
+					ClassCancel:     {Rate: 20, Burst: 40},
+					ClassMarketData: {Rate: 50, Burst: 100},
+				},
+				MaxOrderToTradeRatio: 100,
+				MinOrdersForRatio:    200,
+			},
+			TierMarketMaker: {
+				Buckets: map[EndpointClass]BucketConfig{
+					ClassOrderEntry: {Rate: 100, Burst: 200},
+					ClassCancel:     {Rate: 200, Burst: 400},
+					ClassMarketData: {Rate: 200, Burst: 400},
+				},
+				MaxOrderToTradeRatio: 1000,
+				MinOrdersForRatio:    2000,
+			},
+		},
+		RatioWindow: 1 * time.Minute,
+		APIKeys:     make(map[string]int64),
+		UserTiers: map[int64]Tier{
+			8888: TierMarketMaker,
+		},
+	}
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(cfg BucketConfig, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   cfg.Rate,
+		burst:  cfg.Burst,
+		tokens: cfg.Burst,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// take removes a token from the bucket. When the bucket is empty it returns
+// the duration after which the next token will be available.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	missing := 1 - b.tokens
+	return false, time.Duration(missing / b.rate * float64(time.Second))
+}
+
+// resetIn returns the duration after which the bucket will be full again.
+func (b *tokenBucket) resetIn() time.Duration {
+	return time.Duration((b.burst - b.tokens) / b.rate * float64(time.Second))
+}
+
+type orderTradeCounter struct {
+	windowStart time.Time
+	orders      int64
+	trades      int64
+}
+
+func (c *orderTradeCounter) roll(now time.Time, window time.Duration) {
+	if now.Sub(c.windowStart) >= window {
+		c.windowStart = now
+		c.orders = 0
+		c.trades = 0
+	}
+}
+
+func (c *orderTradeCounter) ratio() float64 {
+	return float64(c.orders) / math.Max(1, float64(c.trades))
+}
+
+type bucketKey struct {
+	identity string
+	class    EndpointClass
+}
+
+type RateLimiter struct {
+	mu        sync.Mutex
+	cfg       RateLimitConfig
+	buckets   map[bucketKey]*tokenBucket
+	counters  map[int64]*orderTradeCounter
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	return &RateLimiter{
+		cfg:      cfg,
+		buckets:  make(map[bucketKey]*tokenBucket),
+		counters: make(map[int64]*orderTradeCounter),
+		now:      time.Now,
+	}
+}
+
+// identify resolves the caller of the request. Users are identified by their
+// API key, anonymous callers by their IP address.
+func (rl *RateLimiter) identify(c echo.Context) (string, int64, bool) {
+	if userID, ok := rl.Authenticate(c); ok {
+		return fmt.Sprintf("user:%d", userID), userID, true
+	}
+
+	return "ip:" + c.RealIP(), 0, false
+}
+
+// Authenticate resolves the user of the request from its API key.
+func (rl *RateLimiter) Authenticate(c echo.Context) (int64, bool) {
+	userID, ok := rl.cfg.APIKeys[c.Request().Header.Get(HeaderAPIKey)]
+	return userID, ok
+}
+
+// authorize responds with an error unless the API key of the request belongs
+// to the user. It returns false when the response has been written.
+func (ex *Exchange) authorize(c echo.Context, userID int64) (bool, error) {
+	caller, ok := ex.limiter.Authenticate(c)
+	if !ok {
+		return false, c.JSON(http.StatusUnauthorized, APIError{"valid API key required"})
+	}
+	if caller != userID {
+		return false, c.JSON(http.StatusForbidden, APIError{"API key does not belong to the user"})
+	}
+
+	return true, nil
+}
+
+func (rl *RateLimiter) tier(userID int64) TierConfig {
+	if tier, ok := rl.cfg.UserTiers[userID]; ok {
+		return rl.cfg.Tiers[tier]
+	}
+
+	return rl.cfg.Tiers[TierDefault]
+}
+
+func (rl *RateLimiter) counter(userID int64, now time.Time) *orderTradeCounter {
+	counter, ok := rl.counters[userID]
+	if !ok {
+		counter = &orderTradeCounter{windowStart: now}
+		rl.counters[userID] = counter
+	}
+	counter.roll(now, rl.cfg.RatioWindow)
+
+	return counter
+}
+
+// sweep forgets the buckets that are full again and the counters whose
+// window is over. They are in the same state as new ones, so callers that
+// come back are limited as if they were never forgotten.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < sweepInterval {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, bucket := range rl.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= bucket.burst {
+			delete(rl.buckets, key)
+		}
+	}
+	for userID, counter := range rl.counters {
+		if now.Sub(counter.windowStart) >= rl.cfg.RatioWindow {
+			delete(rl.counters, userID)
+		}
+	}
+}
+
+// RecordTrade credits a trade to the order-to-trade ratio of the user.
+func (rl *RateLimiter) RecordTrade(userID int64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.counter(userID, rl.now()).trades++
+}
+
+// Middleware limits the requests of the given endpoint class. Every response
+// carries the current usage of the caller so clients can throttle themselves.
+func (rl *RateLimiter) Middleware(class EndpointClass) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, userID, isUser := rl.identify(c)
+			tier := rl.tier(userID)
+			bucketCfg, ok := tier.Buckets[class]
+			if !ok {
+				return next(c)
+			}
+
+			rl.mu.Lock()
+			now := rl.now()
+			rl.sweep(now)
+			key := bucketKey{identity, class}
+			bucket, ok := rl.buckets[key]
+			if !ok {
+				bucket = newTokenBucket(bucketCfg, now)
+				rl.buckets[key] = bucket
+			}
+			allowed, retryAfter := bucket.take(now)
+
+			var (
+				ratio         float64
+				ratioExceeded bool
+			)
+			if allowed && isUser && class == ClassOrderEntry {
+				counter := rl.counter(userID, now)
+				counter.orders++
+				ratio = counter.ratio()
+				if tier.MaxOrderToTradeRatio > 0 && counter.orders > tier.MinOrdersForRatio && ratio > tier.MaxOrderToTradeRatio {
+					ratioExceeded = true
+					retryAfter = rl.cfg.RatioWindow - now.Sub(counter.windowStart)
+					// rejected orders never reach the book and do not count
+					counter.orders--
+				}
+			}
+
+			header := c.Response().Header()
+			header.Set(HeaderRateLimitLimit, strconv.FormatFloat(bucketCfg.Burst, 'f', 0, 64))
+			header.Set(HeaderRateLimitRemaining, strconv.FormatFloat(math.Floor(bucket.tokens), 'f', 0, 64))
+			header.Set(HeaderRateLimitReset, strconv.FormatFloat(math.Ceil(bucket.resetIn().Seconds()), 'f', 0, 64))
+			if isUser && class == ClassOrderEntry {
+				header.Set(HeaderOrderTradeRatio, strconv.FormatFloat(ratio, 'f', 2, 64))
+			}
+			rl.mu.Unlock()
+
+			if !allowed || ratioExceeded {
+				header.Set(echo.HeaderRetryAfter, strconv.FormatFloat(math.Ceil(retryAfter.Seconds()), 'f', 0, 64))
+
+				msg := "rate limit exceeded"
+				if ratioExceeded {
+					msg = "order to trade ratio exceeded"
+				}
+				sugar.Infow(msg,
+					"identity", identity,
+					"class", class,
+				)
+
+				return c.JSON(http.StatusTooManyRequests, APIError{msg})
+			}
+
+			return next(c)
+		}
+	}
+}
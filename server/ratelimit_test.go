@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+func newTestLimiter(now *time.Time, maxRatio float64) *RateLimiter {
+	cfg := DefaultRateLimitConfig()
+	cfg.Tiers[TierDefault] = TierConfig{
+		Buckets: map[EndpointClass]BucketConfig{
+			ClassOrderEntry: {Rate: 1, Burst: 2},
+		},
+		MaxOrderToTradeRatio: maxRatio,
+		MinOrdersForRatio:    2,
+	}
+	cfg.APIKeys = map[string]int64{"1": 1, "2": 2}
+	rl := NewRateLimiter(cfg)
+	rl.now = func() time.Time { return *now }
+
+	return rl
+}
+
+func doLimited(rl *RateLimiter, apiKey string) *httptest.ResponseRecorder {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPost, "/order", nil)
+	req.Header.Set(HeaderAPIKey, apiKey)
+	rec := httptest.NewRecorder()
+	handler := rl.Middleware(ClassOrderEntry)(func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	handler(e.NewContext(req, rec))
+
+	return rec
+}
+
+func TestRateLimitTokenBucket(t *testing.T) {
+	now := time.Now()
+	rl := newTestLimiter(&now, 0)
+
+	if rec := doLimited(rl, "1"); rec.Code != http.StatusOK || rec.Header().Get(HeaderRateLimitRemaining) != "1" {
+		t.Fatalf("unexpected response %d %v", rec.Code, rec.Header())
+	}
+	if rec := doLimited(rl, "1"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 got %d", rec.Code)
+	}
+
+	rec := doLimited(rl, "1")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 got %d", rec.Code)
+	}
+	if rec.Header().Get(echo.HeaderRetryAfter) != "1" {
+		t.Fatalf("expected retry after of 1 second got %s", rec.Header().Get(echo.HeaderRetryAfter))
+	}
+
+	// other users have their own bucket
+	if rec := doLimited(rl, "2"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 got %d", rec.Code)
+	}
+
+	now = now.Add(1 * time.Second)
+	if rec := doLimited(rl, "1"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after refill got %d", rec.Code)
+	}
+}
+
+func TestRateLimitOrderToTradeRatio(t *testing.T) {
+	now := time.Now()
+	rl := newTestLimiter(&now, 2)
+
+	for i := 0; i < 2; i++ {
+		if rec := doLimited(rl, "1"); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 got %d", rec.Code)
+		}
+		now = now.Add(1 * time.Second)
+	}
+
+	rec := doLimited(rl, "1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get(echo.HeaderRetryAfter) != "58" {
+		t.Fatalf("expected ratio rejection got %d %v", rec.Code, rec.Header())
+	}
+	// the rejected order does not count against the ratio
+	assert(t, rl.counters[1].orders, int64(2))
+
+	rl.RecordTrade(1)
+	rl.RecordTrade(1)
+	now = now.Add(1 * time.Second)
+	if rec := doLimited(rl, "1"); rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 after trades got %d", rec.Code)
+	}
+}
+
+func TestRateLimitIdentity(t *testing.T) {
+	now := time.Now()
+	rl := newTestLimiter(&now, 0)
+
+	// a caller with an unknown key is limited by its IP
+	for _, apiKey := range []string{"1", "1", "unknown"} {
+		if rec := doLimited(rl, apiKey); rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 got %d", rec.Code)
+		}
+	}
+	if rec := doLimited(rl, "1"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 got %d", rec.Code)
+	}
+	_, ok := rl.buckets[bucketKey{"ip:192.0.2.1", ClassOrderEntry}]
+	assert(t, ok, true)
+}
+
+func TestRateLimitForgetsIdleCallers(t *testing.T) {
+	now := time.Now()
+	rl := newTestLimiter(&now, 2)
+
+	doLimited(rl, "1")
+	doLimited(rl, "2")
+	assert(t, len(rl.buckets), 2)
+	assert(t, len(rl.counters), 2)
+
+	now = now.Add(sweepInterval)
+	doLimited(rl, "1")
+	assert(t, len(rl.buckets), 1)
+	assert(t, len(rl.counters), 1)
+	assert(t, rl.counters[1].orders, int64(1))
+}
+
+func TestOrderEntryRequiresTheKeyOfTheUser(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	ex.limiter.cfg.APIKeys["secret"] = 2
+
+	order, _ := json.Marshal(PlaceOrderRequest{UserID: 1, Type: LimitOrder, Size: 1, Price: 1_000, Market: MarketETH})
+	group, _ := json.Marshal(PlaceGroupRequest{UserID: 1, Market: MarketETH})
+	for _, tc := range []struct {
+		handler echo.HandlerFunc
+		body    []byte
+	}{
+		{ex.handlePlaceOrder, order},
+		{ex.handlePlaceGroup, group},
+	} {
+		resp := APIError{}
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tc.body))
+		assert(t, doRequest(t, tc.handler, req, nil, nil, &resp), http.StatusUnauthorized)
+
+		req = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(tc.body))
+		req.Header.Set(HeaderAPIKey, "secret")
+		assert(t, doRequest(t, tc.handler, req, nil, nil, &resp), http.StatusForbidden)
+	}
+
+	engine, _ := ex.engine(MarketETH)
+	assert(t, engine.View().TotalAskVolume, 0.0)
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+)
+
+func newTestExchange(t *testing.T, db store.Store) *Exchange {
+	pk, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ExchangeConfig{
+		PrivateKey: hex.EncodeToString(crypto.FromECDSA(pk)),
+		Store:      db,
+	}
+	ex, err := NewExchange(cfg, context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ex
+}
+
+func TestRestartPreservesRestingOrders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exchange.log")
+	db, err := store.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := newTestExchange(t, db)
+
+	askA := orderbook.NewOrder(false, 10, 1)
+	askB := orderbook.NewOrder(false, 5, 2)
+	askC := orderbook.NewOrder(false, 7, 3)
+	bid := orderbook.NewOrder(true, 3, 4)
+	canceled := orderbook.NewOrder(true, 2, 4)
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, askA)
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, askB)
+	ex.handlePlaceLimitOrder(MarketETH, 1_100, askC)
+	ex.handlePlaceLimitOrder(MarketETH, 900, bid)
+	ex.handlePlaceLimitOrder(MarketETH, 800, canceled)
+
+	if err := ex.handleCancelOrder(MarketETH, canceled.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// partially fill askA, the head of the best level
+	market := orderbook.NewOrder(true, 4, 5)
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, market); err != nil {
+		t.Fatal(err)
+	}
+
+	// kill the exchange and start a new one from the same store
+	ex.Close()
+	db.Close()
+	db, err = store.NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	restarted := newTestExchange(t, db)
+	defer restarted.Close()
+	ob := restarted.orderbooks[MarketETH]
+
+	asks := ob.Asks()
+	assert(t, len(asks), 2)
+	assert(t, asks[0].Price, 1_000.0)
+	assert(t, len(asks[0].Orders), 2)
+	assert(t, asks[0].Orders[0].ID, askA.ID)
+	assert(t, asks[0].Orders[0].Size, 6.0)
+	assert(t, asks[0].Orders[1].ID, askB.ID)
+	assert(t, asks[1].Orders[0].ID, askC.ID)
+
+	bids := ob.Bids()
+	assert(t, len(bids), 1)
+	assert(t, bids[0].Orders[0].ID, bid.ID)
+
+	assert(t, len(ob.Orders), 4)
+	assert(t, len(ob.Trades), 1)
+	assert(t, ob.Trades[0].Size, 4.0)
+	assert(t, len(restarted.Orders[4]), 1)
+
+	// IDs keep increasing after the restart, also past closed orders
+	next := orderbook.NewOrder(false, 1, 6)
+	restarted.handlePlaceLimitOrder(MarketETH, 1_200, next)
+	assert(t, next.ID > market.ID, true)
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+)
+
+type (
+	// RiskLimits are the pre-trade limits of a user. A zero limit disables
+	// its check.
+	RiskLimits struct {
+		MaxOrderSize     float64
+		MaxOrderNotional float64
+		MaxOpenOrders    int
+		// MaxPosition is the largest absolute net position in a market.
+		MaxPosition float64
+		// PriceBandPercent is how far a limit price may be from the last
+		// trade, or the mid price before the first trade.
+		PriceBandPercent float64
+		// DailyLossLimit is the largest realized loss of a user in a UTC day
+		// before new orders are rejected.
+		DailyLossLimit float64
+	}
+	// RiskCheck is an order about to be placed together with the state of
+	// the user and the market it is checked against.
+	RiskCheck struct {
+		Market Market
+		Type   OrderType
+		Order  *orderbook.Order
+		// Price is zero for market orders.
+		Price  float64
+		Limits RiskLimits
+		// ReferencePrice is the last trade price, or the mid price before
+		// the first trade. Zero when the market has neither.
+		ReferencePrice float64
+		OpenOrders     int
+		Position       float64
+		DailyPnL       float64
+	}
+	// RiskRule is a pre-trade check. Check returns the reason the order is
+	// rejected, or nil to let it through.
+	RiskRule interface {
+		Name() string
+		Check(check RiskCheck) error
+	}
+	// RiskError is returned for orders rejected by a risk rule.
+	RiskError struct {
+		Rule   string
+		Reason error
+	}
+)
+
+func (e *RiskError) Error() string {
+	return fmt.Sprintf("order rejected by risk check %s: %v", e.Rule, e.Reason)
+}
+
+// DefaultRiskLimits only enables the checks that do not depend on the units
+// sizes are quoted in, which differ between deployments.
+func DefaultRiskLimits() RiskLimits {
+	return RiskLimits{
+		MaxOpenOrders:    200,
+		PriceBandPercent: 20,
+	}
+}
+
+func DefaultRiskRules() []RiskRule {
+	return []RiskRule{
+		orderSizeRule{},
+		openOrdersRule{},
+		positionRule{},
+		priceBandRule{},
+		dailyLossRule{},
+	}
+}
+
+// notional returns the value of the order, valuing market orders at the
+// reference price.
+func (check RiskCheck) notional() float64 {
+	if check.Type == MarketOrder {
+		return check.Order.Size * check.ReferencePrice
+	}
+
+	return check.Order.Size * check.Price
+}
+
+type orderSizeRule struct{}
+
+func (orderSizeRule) Name() string { return "ORDER_SIZE" }
+
+func (orderSizeRule) Check(check RiskCheck) error {
+	if max := check.Limits.MaxOrderSize; max > 0 && check.Order.Size > max {
+		return fmt.Errorf("size %.2f exceeds the maximum of %.2f", check.Order.Size, max)
+	}
+	if max := check.Limits.MaxOrderNotional; max > 0 && check.notional() > max {
+		return fmt.Errorf("notional %.2f exceeds the maximum of %.2f", check.notional(), max)
+	}
+
+	return nil
+}
+
+type openOrdersRule struct{}
+
+func (openOrdersRule) Name() string { return "OPEN_ORDERS" }
+
+func (openOrdersRule) Check(check RiskCheck) error {
+	// market orders never rest on the book
+	if check.Type == MarketOrder {
+		return nil
+	}
+	if max := check.Limits.MaxOpenOrders; max > 0 && check.OpenOrders >= max {
+		return fmt.Errorf("%d open orders, the maximum is %d", check.OpenOrders, max)
+	}
+
+	return nil
+}
+
+type positionRule struct{}
+
+func (positionRule) Name() string { return "POSITION" }
+
+func (positionRule) Check(check RiskCheck) error {
+	position := check.Position + check.Order.Size
+	if !check.Order.Bid {
+		position = check.Position - check.Order.Size
+	}
+
+	// orders reducing the position are always allowed
+	if max := check.Limits.MaxPosition; max > 0 && math.Abs(position) > max && math.Abs(position) > math.Abs(check.Position) {
+		return fmt.Errorf("position would be %.2f, the maximum is %.2f", position, max)
+	}
+
+	return nil
+}
+
+type priceBandRule struct{}
+
+func (priceBandRule) Name() string { return "PRICE_BAND" }
+
+func (priceBandRule) Check(check RiskCheck) error {
+	band := check.Limits.PriceBandPercent
+	if check.Type == MarketOrder || band <= 0 || check.ReferencePrice == 0 {
+		return nil
+	}
+
+	deviation := math.Abs(check.Price-check.ReferencePrice) / check.ReferencePrice * 100
+	if deviation > band {
+		return fmt.Errorf("price %.2f is %.2f%% away from %.2f, the band is %.2f%%", check.Price, deviation, check.ReferencePrice, band)
+	}
+
+	return nil
+}
+
+type dailyLossRule struct{}
+
+func (dailyLossRule) Name() string { return "DAILY_LOSS" }
+
+func (dailyLossRule) Check(check RiskCheck) error {
+	if limit := check.Limits.DailyLossLimit; limit > 0 && -check.DailyPnL >= limit {
+		return fmt.Errorf("daily loss %.2f reached the limit of %.2f", -check.DailyPnL, limit)
+	}
+
+	return nil
+}
+
+// riskEngine runs the pre-trade rules against the limits of each user.
+type riskEngine struct {
+	rules []RiskRule
+
+	mu     sync.RWMutex
+	limits RiskLimits
+	// overrides are set by admins, the Exchange persists them
+	overrides map[int64]RiskLimits
+}
+
+func newRiskEngine(rules []RiskRule, limits RiskLimits) *riskEngine {
+	return &riskEngine{
+		rules:     rules,
+		limits:    limits,
+		overrides: make(map[int64]RiskLimits),
+	}
+}
+
+// userLimits returns the limits of the user and whether they are an
+// override.
+func (re *riskEngine) userLimits(userID int64) (RiskLimits, bool) {
+	re.mu.RLock()
+	defer re.mu.RUnlock()
+
+	if limits, ok := re.overrides[userID]; ok {
+		return limits, true
+	}
+
+	return re.limits, false
+}
+
+func (re *riskEngine) setOverride(userID int64, limits RiskLimits) {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	re.overrides[userID] = limits
+}
+
+func (re *riskEngine) clearOverride(userID int64) {
+	re.mu.Lock()
+	defer re.mu.Unlock()
+
+	delete(re.overrides, userID)
+}
+
+func (re *riskEngine) check(check RiskCheck) error {
+	for _, rule := range re.rules {
+		if err := rule.Check(check); err != nil {
+			return &RiskError{Rule: rule.Name(), Reason: err}
+		}
+	}
+
+	return nil
+}
+
+func referencePrice(ob *orderbook.Orderbook) float64 {
+	if n := len(ob.Trades); n > 0 {
+		return ob.Trades[n-1].Price
+	}
+
+	bids, asks := ob.Bids(), ob.Asks()
+	if len(bids) == 0 || len(asks) == 0 {
+		return 0
+	}
+
+	return (bids[0].Price + asks[0].Price) / 2
+}
+
+// checkRisk runs the pre-trade rules against an order. It runs on the
+// matching goroutine of the market so the state it checks cannot change
+// before the order is placed.
+func (ex *Exchange) checkRisk(ob *orderbook.Orderbook, market Market, typ OrderType, price float64, order *orderbook.Order) error {
+	if order.Size <= 0 {
+		return fmt.Errorf("invalid size [%.2f]", order.Size)
+	}
+	if typ == LimitOrder && price <= 0 {
+		return fmt.Errorf("invalid price [%.2f]", price)
+	}
+
+	limits, _ := ex.risk.userLimits(order.UserID)
+
+	ex.mu.RLock()
+	openOrders := len(ex.Orders[order.UserID])
+	ex.mu.RUnlock()
+
+	position, dailyPnL := ex.stats.risk(order.UserID, market, time.Now().UnixNano())
+
+	return ex.risk.check(RiskCheck{
+		Market:         market,
+		Type:           typ,
+		Order:          order,
+		Price:          price,
+		Limits:         limits,
+		ReferencePrice: referencePrice(ob),
+		OpenOrders:     openOrders,
+		Position:       position,
+		DailyPnL:       dailyPnL,
+	})
+}
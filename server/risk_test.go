@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+func riskRule(err error) string {
+	var riskErr *RiskError
+	if !errors.As(err, &riskErr) {
+		return ""
+	}
+	return riskErr.Rule
+}
+
+func TestRiskChecks(t *testing.T) {
+	ex := newTestExchange(t, store.NewMemoryStore())
+	ex.risk.setOverride(1, RiskLimits{
+		MaxOrderSize:     10,
+		MaxOrderNotional: 5_000,
+		MaxOpenOrders:    2,
+		PriceBandPercent: 10,
+	})
+	ex.risk.setOverride(2, RiskLimits{MaxPosition: 3, DailyLossLimit: 100})
+
+	err := ex.handlePlaceLimitOrder(MarketETH, 100, orderbook.NewOrder(false, 11, 1))
+	assert(t, riskRule(err), "ORDER_SIZE")
+	err = ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 6, 1))
+	assert(t, riskRule(err), "ORDER_SIZE")
+
+	assert(t, ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 2, 1)), nil)
+	assert(t, ex.handlePlaceLimitOrder(MarketETH, 900, orderbook.NewOrder(true, 2, 1)), nil)
+	err = ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 1, 1))
+	assert(t, riskRule(err), "OPEN_ORDERS")
+	ex.risk.setOverride(1, RiskLimits{PriceBandPercent: 10})
+
+	// the mid price is 950
+	err = ex.handlePlaceLimitOrder(MarketETH, 1_100, orderbook.NewOrder(false, 1, 1))
+	assert(t, riskRule(err), "PRICE_BAND")
+	assert(t, ex.handlePlaceLimitOrder(MarketETH, 1_040, orderbook.NewOrder(false, 1, 1)), nil)
+
+	_, _, err = ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 4, 2))
+	assert(t, riskRule(err), "POSITION")
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+	// reducing the position is allowed at the limit
+	ex.handlePlaceLimitOrder(MarketETH, 950, orderbook.NewOrder(true, 3, 1))
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(false, 3, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// bought at 1000 and 1040 and sold at 950, the loss is over the limit
+	_, _, err = ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(false, 1, 2))
+	assert(t, riskRule(err), "DAILY_LOSS")
+
+	ex.risk.clearOverride(2)
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(false, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdminRiskLimits(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	ex.adminKeys["secret"] = true
+
+	e := echo.New()
+	admin := e.Group("/admin", ex.requireAdmin)
+	admin.GET("/risk/:userID", ex.handleGetRiskLimits)
+	admin.PUT("/risk/:userID", ex.handleSetRiskLimits)
+	admin.DELETE("/risk/:userID", ex.handleClearRiskLimits)
+
+	do := func(method, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/risk/7", strings.NewReader(body))
+		req.Header.Set(HeaderAdminKey, key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert(t, do(http.MethodGet, "", "").Code, http.StatusUnauthorized)
+	assert(t, do(http.MethodGet, "wrong", "").Code, http.StatusUnauthorized)
+	assert(t, do(http.MethodGet, "secret", "").Code, http.StatusOK)
+
+	assert(t, do(http.MethodPut, "secret", `{"MaxOrderSize":-1}`).Code, http.StatusBadRequest)
+	assert(t, do(http.MethodPut, "secret", `{"MaxOrderSize":5}`).Code, http.StatusOK)
+	limits, override := ex.risk.userLimits(7)
+	assert(t, override, true)
+	assert(t, limits, RiskLimits{MaxOrderSize: 5})
+
+	// overrides survive a restart
+	restarted := newTestExchange(t, db)
+	limits, override = restarted.risk.userLimits(7)
+	restarted.Close()
+	assert(t, override, true)
+	assert(t, limits, RiskLimits{MaxOrderSize: 5})
+
+	assert(t, do(http.MethodDelete, "secret", "").Code, http.StatusOK)
+	limits, override = ex.risk.userLimits(7)
+	assert(t, override, false)
+	assert(t, limits, DefaultRiskLimits())
+
+	restarted = newTestExchange(t, db)
+	_, override = restarted.risk.userLimits(7)
+	restarted.Close()
+	assert(t, override, false)
+}
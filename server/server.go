@@ -1,16 +1,22 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
@@ -19,7 +25,10 @@ import (
 	"github.com/joho/godotenv"
 	"go.uber.org/zap"
 
+	"github.com/highxshell/crypto-exchange/idgen"
+	"github.com/highxshell/crypto-exchange/marketdata"
 	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
 	"github.com/labstack/echo/v4"
 )
 
@@ -27,8 +36,21 @@ const(
 	MarketOrder OrderType = "MARKET"
 	LimitOrder 	OrderType = "LIMIT"
 	MarketETH Market = "ETH"
+
+	// settlementNode is the ID node of the settlement batches, markets use
+	// the nodes below it.
+	settlementNode = idgen.MaxNode
+	// conditionalNode is the ID node of the stop orders and order groups
+	// the exchange holds outside of the books.
+	conditionalNode = settlementNode - 1
 )
 
+// marketIDs are embedded in the order and trade IDs of every market. They
+// must never change once a market traded.
+var marketIDs = map[Market]int64{
+	MarketETH: 1,
+}
+
 type (
 	OrderType string
 	Market string
@@ -39,9 +61,29 @@ type (
 		Size 	float64
 		Price 	float64
 		Market 	Market
+		// ClientOrderID optionally identifies the order for its user. A
+		// request repeating the ID of a recent order returns the result of
+		// that order instead of placing a new one.
+		ClientOrderID string
+		// PostOnly limit orders never cross the spread on entry.
+		PostOnly 	orderbook.PostOnly
+		// ReduceOnly orders may only reduce the position of the user.
+		ReduceOnly 	bool
+		// StopPrice turns the order into a stop order held until a trade
+		// reaches it.
+		StopPrice 	float64
+		// TrailAmount or TrailPercent make a trailing stop whose stop
+		// price follows the trades at that distance. Without a StopPrice
+		// it starts from the last trade.
+		TrailAmount 	float64
+		TrailPercent 	float64
+		// Peg makes a limit order follow the top of the book. Price is only
+		// used while the book has no reference price for it.
+		Peg 		*orderbook.Peg
 	}
 	Order struct{
-		UserID		int64
+		// UserID is only set on the orders of the caller.
+		UserID		int64 `json:",omitempty"`
 		ID 			int64
 		Price 		float64
 		Size 		float64
@@ -49,6 +91,7 @@ type (
 		Timestamp 	int64
 	}
 	OrderbookData struct{
+		Seq 			int64
 		TotalBidVolume 	float64
 		TotalAskVolume 	float64
 		Asks 			[]*Order
@@ -79,6 +122,9 @@ func StartServer() {
 
 	s := echo.New()
 	s.HTTPErrorHandler = httpErrorHandler
+	// anonymous callers are rate limited by the address of the connection,
+	// forwarded headers can be set by anyone
+	s.IPExtractor = echo.ExtractIPDirect()
 
 	client, err := ethclient.Dial(os.Getenv("GANACHE_URI"))
 	if err != nil {
@@ -86,8 +132,31 @@ func StartServer() {
 	}
 	ctx := context.Background()
 
-	exchangePrivateKey := os.Getenv("EXCHANGE_PK")
-	ex, err := NewExchange(exchangePrivateKey, client, ctx)
+	storePath := os.Getenv("STORE_PATH")
+	if storePath == "" {
+		storePath = filepath.Join("data", "exchange.log")
+	}
+	db, err := store.NewFileStore(storePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	apiKeys, err := parseAPIKeys(os.Getenv("API_KEYS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg := ExchangeConfig{
+		APIKeys: 	apiKeys,
+		AdminKeys: 	strings.FieldsFunc(os.Getenv("ADMIN_KEYS"), func(r rune) bool { return r == ',' }),
+		PrivateKey: os.Getenv("EXCHANGE_PK"),
+		Client: 	client,
+		Store: 		db,
+		JournalDir: os.Getenv("JOURNAL_DIR"),
+		SnapshotInterval: 1 * time.Minute,
+	}
+	ex, err := NewExchange(cfg, ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -96,15 +165,58 @@ func StartServer() {
 	ex.registerUser(os.Getenv("USER_2_PK"), 6667)
 	ex.registerUser(os.Getenv("ELON_MUSK_PK"), 1)
 
-	s.POST("/order", ex.handlePlaceOrder)
+	orderEntry := ex.limiter.Middleware(ClassOrderEntry)
+	cancels := ex.limiter.Middleware(ClassCancel)
+	marketData := ex.limiter.Middleware(ClassMarketData)
 
-	s.DELETE("/order/:id", ex.cancelOrder)
+	// record the order entry traffic so it can be replayed with cmd/replay
+	capture := []echo.MiddlewareFunc{}
+	if path := os.Getenv("CAPTURE_FILE"); path != "" {
+		recorder, err := NewTrafficRecorder(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer recorder.Close()
+		capture = append(capture, recorder.Middleware())
+	}
 
-	s.GET("/trades/:market", ex.handleGetTrades)
-	s.GET("/order/:userID", ex.handleGetOrders)
-	s.GET("/book/:market", ex.handleGetBook)
-	s.GET("/book/:market/bid", ex.handleGetBestBid)
-	s.GET("/book/:market/ask", ex.handleGetBestAsk)
+	s.POST("/order", ex.handlePlaceOrder, append([]echo.MiddlewareFunc{orderEntry}, capture...)...)
+
+	s.DELETE("/order/:id", ex.cancelOrder, append([]echo.MiddlewareFunc{cancels}, capture...)...)
+	s.DELETE("/order/client/:userID/:clientOrderID", ex.handleCancelClientOrder, append([]echo.MiddlewareFunc{cancels}, capture...)...)
+	s.DELETE("/orders", ex.handleCancelAll, append([]echo.MiddlewareFunc{cancels}, capture...)...)
+	s.POST("/groups", ex.handlePlaceGroup, append([]echo.MiddlewareFunc{orderEntry}, capture...)...)
+	s.DELETE("/groups/:id", ex.handleCancelGroup, append([]echo.MiddlewareFunc{cancels}, capture...)...)
+	s.GET("/groups/:id", ex.handleGetGroup, marketData)
+	s.POST("/cancel-after", ex.handleCancelAfter, cancels)
+
+	s.GET("/trades/:market", ex.handleGetTrades, marketData)
+	s.GET("/fills/:userID", ex.handleGetFills, marketData)
+	s.GET("/fees/:userID", ex.handleGetFees, marketData)
+	s.GET("/users/:id/stats", ex.handleGetUserStats, marketData)
+	s.GET("/markets/:market/status", ex.handleGetMarketStatus, marketData)
+	s.GET("/auction/:market", ex.handleGetAuction, marketData)
+
+	admin := s.Group("/admin", ex.requireAdmin)
+	admin.GET("/risk/:userID", ex.handleGetRiskLimits)
+	admin.PUT("/risk/:userID", ex.handleSetRiskLimits)
+	admin.DELETE("/risk/:userID", ex.handleClearRiskLimits)
+	admin.POST("/markets/:market/halt", ex.handleHaltMarket)
+	admin.POST("/markets/:market/resume", ex.handleResumeMarket)
+	s.GET("/order/:userID", ex.handleGetOrders, marketData)
+	s.GET("/orders", ex.handleGetOrderHistory, marketData)
+	s.GET("/orders/:id", ex.handleGetOrder, marketData)
+	s.GET("/orders/client/:userID/:clientOrderID", ex.handleGetClientOrder, marketData)
+	s.GET("/book/:market", ex.handleGetBook, marketData)
+	s.GET("/book/:market/bid", ex.handleGetBestBid, marketData)
+	s.GET("/book/:market/ask", ex.handleGetBestAsk, marketData)
+	s.GET("/book/:market/hash", ex.handleGetBookHash, marketData)
+	s.GET("/depth/:market", ex.handleGetDepth, marketData)
+	s.GET("/candles/:market", ex.handleGetCandles, marketData)
+	s.GET("/ticker/:market", ex.handleGetTicker, marketData)
+	s.GET("/tickers", ex.handleGetTickers, marketData)
+	s.GET("/stream/:market", ex.handleStream, marketData)
+	s.GET("/private/stream", ex.handlePrivateSession, cancels)
 
 
 	s.Start(":3000")
@@ -141,50 +253,467 @@ type Exchange struct {
 	Orders 		map[int64][]*orderbook.Order
 	PrivateKey 	*ecdsa.PrivateKey
 	orderbooks 	map[Market]*orderbook.Orderbook
+	engines 	map[Market]*MarketEngine
+	candles 	map[Market]*marketdata.CandleAggregator
+	tickers 	map[Market]*marketdata.TickerStats
+	stream 		*Hub
+	clientOrders *clientOrderIDs
+	settlementIDs *idgen.Generator
+	conditionalIDs *idgen.Generator
+	stops 		*stopOrders
+	groups 		*orderGroups
+	deadMan 	*deadMansSwitch
+	fees 		*feeEngine
+	feeLedger 	*feeLedger
+	// transfer sends the amount from the account of the key to the address.
+	transfer 	func(from *ecdsa.PrivateKey, to common.Address, amount *big.Int) error
+	stats 		*userStatsTracker
+	risk 		*riskEngine
+	adminKeys 	map[string]bool
+	states 		*marketStates
+	limiter 	*RateLimiter
+	store 		store.Store
+	journaled 	bool
+}
+
+type ExchangeConfig struct {
+	PrivateKey 	string
+	Client 		*ethclient.Client
+	Store 		store.Store
+	// JournalDir holds the command journal and snapshots of every market.
+	// When it is set the orderbooks are rebuilt from their latest snapshot
+	// and the journal tail, otherwise they are rebuilt from the open orders
+	// in the Store.
+	JournalDir 	string
+	// SnapshotInterval is how often journaled orderbooks are snapshotted.
+	// Zero disables snapshots.
+	SnapshotInterval time.Duration
+	// APIKeys maps an API key to the user it authenticates.
+	APIKeys 	map[string]int64
+	// Fees defaults to DefaultFeeConfig when it has no tiers.
+	Fees 		FeeConfig
+	// RiskRules default to DefaultRiskRules, RiskLimits to
+	// DefaultRiskLimits.
+	RiskRules 	[]RiskRule
+	RiskLimits 	*RiskLimits
+	// AdminKeys are the keys accepted by the admin endpoints.
+	AdminKeys 	[]string
+	// CircuitBreaker defaults to DefaultCircuitBreakerConfig.
+	CircuitBreaker *CircuitBreakerConfig
+	// OpeningAuction is the call period of the auction each market opens
+	// with. Zero opens the markets for continuous trading right away.
+	OpeningAuction time.Duration
+	// Allocations are the allocation policies of the markets, FIFO for
+	// markets without one.
+	Allocations map[Market]orderbook.Allocation
+	// TickSizes are the tick sizes post-only orders slide by, DefaultTickSize
+	// for markets without one.
+	TickSizes map[Market]float64
+}
+
+// parseAPIKeys parses a comma separated list of key:userID pairs.
+func parseAPIKeys(s string) (map[string]int64, error) {
+	keys := make(map[string]int64)
+	for _, pair := range strings.Split(s, ",") {
+		if pair == "" {
+			continue
+		}
+		key, userIDStr, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid API key entry: %s", pair)
+		}
+		userID, err := strconv.ParseInt(userIDStr, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid user of API key %s: %w", key, err)
+		}
+		keys[key] = userID
+	}
+
+	return keys, nil
 }
 
-func NewExchange(privateKey string, client *ethclient.Client, ctx context.Context) (*Exchange, error) {
+func journalDir(dir string, market Market) string {
+	return filepath.Join(dir, string(market), "journal")
+}
+
+func snapshotDir(dir string, market Market) string {
+	return filepath.Join(dir, string(market), "snapshots")
+}
+
+func NewExchange(cfg ExchangeConfig, ctx context.Context) (*Exchange, error) {
 	orderbooks := make(map[Market]*orderbook.Orderbook)
-	orderbooks[MarketETH] = orderbook.NewOrderBook()
+	for _, market := range []Market{MarketETH} {
+		if cfg.JournalDir == "" {
+			orderbooks[market] = orderbook.NewMarketOrderBook(marketIDs[market])
+			continue
+		}
 
-	pk, err := crypto.HexToECDSA(privateKey)
+		journal, err := orderbook.NewFileJournal(journalDir(cfg.JournalDir, market))
+		if err != nil {
+			return nil, err
+		}
+		snap, err := orderbook.LatestSnapshot(snapshotDir(cfg.JournalDir, market))
+		if err != nil {
+			return nil, err
+		}
+		ob, err := orderbook.NewJournaledOrderBook(marketIDs[market], journal, snap)
+		if err != nil {
+			return nil, err
+		}
+		orderbooks[market] = ob
+
+		if cfg.SnapshotInterval > 0 {
+			orderbook.NewSnapshotScheduler(ob, journal, snapshotDir(cfg.JournalDir, market), cfg.SnapshotInterval).Start()
+		}
+	}
+
+	pk, err := crypto.HexToECDSA(cfg.PrivateKey)
 	if err != nil{
 		return nil, err
 	}
 
-	return &Exchange{
+	rateLimits := DefaultRateLimitConfig()
+	for key, userID := range cfg.APIKeys {
+		rateLimits.APIKeys[key] = userID
+	}
+
+	ex := &Exchange{
 		Ctx: 		ctx,
-		Client: 	client,
+		Client: 	cfg.Client,
 		Users: 		make(map[int64]*User),
 		Orders: 	make(map[int64][]*orderbook.Order),
 		PrivateKey: pk,
 		orderbooks:	orderbooks,
-	}, nil
+		limiter: 	NewRateLimiter(rateLimits),
+		store: 		cfg.Store,
+		journaled: 	cfg.JournalDir != "",
+	}
+
+	ex.engines = make(map[Market]*MarketEngine)
+	ex.candles = make(map[Market]*marketdata.CandleAggregator)
+	ex.tickers = make(map[Market]*marketdata.TickerStats)
+	ex.stream = NewHub()
+	ex.clientOrders = newClientOrderIDs(DefaultClientOrderIDWindow)
+	ex.deadMan = newDeadMansSwitch(ex.cancelUserOrders)
+	if ex.feeLedger, err = newFeeLedger(cfg.Store); err != nil {
+		return nil, err
+	}
+	ex.transfer = func(from *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
+		return transferETH(ex.Ctx, ex.Client, from, to, amount)
+	}
+
+	ex.settlementIDs = idgen.New(settlementNode)
+	settlements, err := cfg.Store.Settlements()
+	if err != nil {
+		return nil, err
+	}
+	for _, settlement := range settlements {
+		ex.settlementIDs.Observe(settlement.BatchID)
+	}
+
+	ex.conditionalIDs = idgen.New(conditionalNode)
+	ex.stops = newStopOrders()
+	ex.groups = newOrderGroups()
+	if err := ex.restoreGroups(); err != nil {
+		return nil, err
+	}
+
+	feeConfig := cfg.Fees
+	if len(feeConfig.Tiers) == 0 {
+		feeConfig = DefaultFeeConfig()
+	}
+	if ex.stats, err = ex.newUserStatsTracker(); err != nil {
+		return nil, err
+	}
+	ex.stats.start()
+	ex.fees = newFeeEngine(feeConfig, ex.stats.volume)
+
+	riskRules := cfg.RiskRules
+	if riskRules == nil {
+		riskRules = DefaultRiskRules()
+	}
+	riskLimits := DefaultRiskLimits()
+	if cfg.RiskLimits != nil {
+		riskLimits = *cfg.RiskLimits
+	}
+	ex.risk = newRiskEngine(riskRules, riskLimits)
+	if err := ex.restoreRiskOverrides(); err != nil {
+		return nil, err
+	}
+
+	ex.adminKeys = make(map[string]bool)
+	for _, key := range cfg.AdminKeys {
+		ex.adminKeys[key] = true
+	}
+
+	breaker := DefaultCircuitBreakerConfig()
+	if cfg.CircuitBreaker != nil {
+		breaker = *cfg.CircuitBreaker
+	}
+	markets := make([]Market, 0, len(orderbooks))
+	for market := range orderbooks {
+		markets = append(markets, market)
+	}
+	ex.states = newMarketStates(breaker, markets, ex.marketStateChanged)
+	saved, err := ex.store.MarketStates()
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[Market]store.MarketStateRecord, len(saved))
+	for _, state := range saved {
+		states[Market(state.Market)] = state
+	}
+
+	for market, ob := range orderbooks {
+		market := market
+		if err := ex.restore(market); err != nil {
+			return nil, err
+		}
+		records, err := ex.store.Orders(string(market))
+		if err != nil {
+			return nil, err
+		}
+		ex.restoreStops(market, records)
+		ob.SetFeeSchedule(ex.fees.schedule(market))
+		if err := ob.SetAllocation(cfg.Allocations[market]); err != nil {
+			return nil, fmt.Errorf("market %s: %w", market, err)
+		}
+		tick, ok := cfg.TickSizes[market]
+		if !ok {
+			tick = DefaultTickSize
+		}
+		if err := ob.SetTickSize(tick); err != nil {
+			return nil, fmt.Errorf("market %s: %w", market, err)
+		}
+
+		candles, err := ex.newCandleAggregator(market)
+		if err != nil {
+			return nil, err
+		}
+		ex.candles[market] = candles
+
+		tickerStats, err := ex.newTickerStats(market)
+		if err != nil {
+			return nil, err
+		}
+		ex.tickers[market] = tickerStats
+
+		engine := NewMarketEngine(market, ob, DefaultEngineQueueSize)
+		engine.OnTrades(func(trades []*orderbook.Trade) {
+			for _, trade := range trades {
+				candles.AddTrade(trade)
+				tickerStats.AddTrade(trade)
+			}
+			ex.stats.addTrades(market, trades)
+			ex.enforceReduceOnly(ob, market, trades)
+			if reason, ok := ex.states.observe(market, trades); ok {
+				ex.haltMarket(ob, market, reason, ex.states.cfg.Cooldown)
+			}
+			ex.openUncrossed(ob, market)
+			ex.groupsOnTrades(ob, market, trades)
+			ex.triggerStops(ob, market, trades)
+		})
+		engine.OnCommand(ex.pegRepricer(ob, market))
+		engine.OnView(ex.tickerPublisher(market))
+		engine.OnView(ex.auctionPublisher(market))
+		// a halted market stays halted, a book journaled in its call period
+		// finishes its auction
+		if state, ok := states[market]; ok && MarketStatus(state.Status) != MarketOpen {
+			ex.restoreMarketState(ob, market, state)
+		} else if ob.InAuction() || cfg.OpeningAuction > 0 {
+			period := cfg.OpeningAuction
+			if period <= 0 {
+				period = breaker.ReopeningAuction
+			}
+			ex.startAuction(ob, market, period)
+		}
+		engine.Start()
+		ex.engines[market] = engine
+	}
+
+	return ex, nil
+}
+
+// newCandleAggregator loads the persisted candles of the market and
+// backfills the candles after them from the stored trade history.
+func (ex *Exchange) newCandleAggregator(market Market) (*marketdata.CandleAggregator, error) {
+	candles := marketdata.NewCandleAggregator(marketdata.DefaultIntervals, func(candle marketdata.Candle) {
+		if err := ex.store.SaveCandle(string(market), candle); err != nil {
+			sugar.Error(err)
+		}
+	})
+
+	closed, err := ex.store.Candles(string(market))
+	if err != nil {
+		return nil, err
+	}
+	candles.Load(closed)
+
+	trades, err := ex.store.Trades(string(market))
+	if err != nil {
+		return nil, err
+	}
+	for _, trade := range trades {
+		candles.AddTrade(trade)
+	}
+
+	return candles, nil
+}
+
+// Close stops the matching engines of every market.
+func (ex *Exchange) Close() {
+	ex.deadMan.stop()
+	ex.states.stop()
+	for _, engine := range ex.engines {
+		engine.Stop()
+	}
+	ex.stats.stop()
+}
+
+// restore rebuilds the orderbook of the market from the store. Open orders
+// are placed back oldest first so they keep their price-time priority.
+// Journaled orderbooks are already rebuilt, only the user orders are
+// tracked again.
+func (ex *Exchange) restore(market Market) error {
+	ob := ex.orderbooks[market]
+
+	if ex.journaled {
+		orders := orderbook.Orders{}
+		for _, order := range ob.Orders {
+			orders = append(orders, order)
+		}
+		sort.Sort(orders)
+		for _, order := range orders {
+			ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+		}
+
+		return nil
+	}
+
+	records, err := ex.store.Orders(string(market))
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		ob.ObserveOrderID(record.ID)
+		if !record.Status.IsOpen() {
+			continue
+		}
+
+		order := &orderbook.Order{
+			ID: 		record.ID,
+			UserID: 	record.UserID,
+			Size: 		record.Size,
+			Bid: 		record.Bid,
+			Timestamp: 	record.Timestamp,
+			ClientOrderID: record.ClientOrderID,
+			ReduceOnly: record.ReduceOnly,
+		}
+		// the order was passive when it was placed
+		ob.PlaceLimitOrder(record.Price, order)
+		order.PostOnly = record.PostOnly
+		order.Peg = record.Peg
+		order.Status = record.Status
+		order.FilledSize = record.FilledSize
+		order.AvgPrice = record.AvgPrice
+		order.UpdatedAt = record.UpdatedAt
+		ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+	}
+
+	trades, err := ex.store.Trades(string(market))
+	if err != nil {
+		return err
+	}
+	ob.LoadTrades(trades)
+
+	sugar.Infow("restored orderbook",
+		"market", 		market,
+		"orders", 		len(ob.Orders),
+		"trades", 		len(ob.Trades),
+	)
+
+	return nil
+}
+
+func (ex *Exchange) saveOrder(market Market, price float64, order *orderbook.Order) error {
+	return ex.store.SaveOrder(ex.orderRecord(market, price, order))
+}
+
+func (ex *Exchange) orderRecord(market Market, price float64, order *orderbook.Order) store.OrderRecord {
+	return store.OrderRecord{
+		ID: 		order.ID,
+		UserID: 	order.UserID,
+		Market: 	string(market),
+		Bid: 		order.Bid,
+		Price: 		price,
+		Size: 		order.Size,
+		FilledSize: order.FilledSize,
+		AvgPrice: 	order.AvgPrice,
+		Timestamp: 	order.Timestamp,
+		UpdatedAt: 	order.UpdatedAt,
+		Status: 	order.Status,
+		ClientOrderID: order.ClientOrderID,
+		PostOnly: 	order.PostOnly,
+		ReduceOnly: order.ReduceOnly,
+		GroupID: 	ex.groups.groupOf(order.ID),
+		Peg: 		order.Peg,
+	}
 }
 
 type GetOrdersResponse struct {
 	Asks []Order
 	Bids []Order
+	// Stops are the pending stop orders of the user, Groups its working
+	// order groups.
+	Stops 	[]StopOrderView
+	Groups 	[]store.OrderGroupRecord
 }
 
 func (ex *Exchange) registerUser(pk string, userID int64) {
 	user := NewUser(pk, userID)
+	ex.mu.Lock()
 	ex.Users[userID] = user
+	ex.mu.Unlock()
 
 	sugar.Infow("new exchange User",
 		"id", 		userID,
 	)
 }
 
-func (ex *Exchange) handleGetTrades(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+func (ex *Exchange) user(userID int64) (*User, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
 
-	if !ok {
-		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	user, ok := ex.Users[userID]
+	return user, ok
+}
+
+func (ex *Exchange) engine(market Market) (*MarketEngine, bool) {
+	engine, ok := ex.engines[market]
+	return engine, ok
+}
+
+// markets returns every market of the exchange in name order.
+func (ex *Exchange) markets() []Market {
+	markets := make([]Market, 0, len(ex.engines))
+	for market := range ex.engines {
+		markets = append(markets, market)
 	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i] < markets[j] })
 
-	return c.JSON(http.StatusOK, ob.Trades)
+	return markets
+}
+
+// engineError writes the response for commands rejected by the engine.
+func engineError(c echo.Context, err error) error {
+	if err == ErrEngineBusy || err == ErrEngineStopped {
+		return c.JSON(http.StatusServiceUnavailable, APIError{err.Error()})
+	}
+	if errors.Is(err, ErrCommandFailed) {
+		return c.JSON(http.StatusInternalServerError, APIError{ErrCommandFailed.Error()})
+	}
+
+	return c.JSON(http.StatusBadRequest, APIError{err.Error()})
 }
 
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
@@ -193,138 +722,271 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 	if err != nil{
 		return err
 	}
+	if ok, err := ex.authorize(c, int64(userID)); !ok {
+		return err
+	}
 
-	ex.mu.RLock()
-	orderbookOrders := ex.Orders[int64(userID)] 
 	ordersResp := &GetOrdersResponse{
 		Asks: []Order{},
 		Bids: []Order{},
+		Stops: ex.userStops(int64(userID)),
+		Groups: ex.groups.user(int64(userID)),
 	}
 
-	for i := 0; i < len(orderbookOrders); i++ {
-		// it could be that the order is getting filled even though itss inclueded in this
-		// response. We must double check if the limit is not NIL
-		if orderbookOrders[i].Limit == nil {
-			fmt.Printf("the limit of the order is NIL %+v\n", orderbookOrders[i])
-			continue
-		}
-		order := Order{
-			ID: 		orderbookOrders[i].ID,
-			UserID: 	orderbookOrders[i].UserID,
-			Price: 		orderbookOrders[i].Limit.Price,
-			Size: 		orderbookOrders[i].Size,
-			Timestamp: 	orderbookOrders[i].Timestamp,
-			Bid: 		orderbookOrders[i].Bid,
+	for _, engine := range ex.engines {
+		view := engine.View()
+		for _, levels := range [][]LevelView{view.Asks, view.Bids} {
+			for _, level := range levels {
+				for _, o := range level.Orders {
+					if o.UserID != int64(userID) {
+						continue
+					}
+					order := Order{
+						ID: 		o.ID,
+						UserID: 	o.UserID,
+						Price: 		level.Price,
+						Size: 		o.Size,
+						Timestamp: 	o.Timestamp,
+						Bid: 		o.Bid,
+					}
+
+					if order.Bid {
+						ordersResp.Bids = append(ordersResp.Bids, order)
+					} else {
+						ordersResp.Asks = append(ordersResp.Asks, order)
+					}
+				}
+			}
 		}
+	}
 
-		if order.Bid {
-			ordersResp.Bids = append(ordersResp.Bids, order)
-		} else {
-			ordersResp.Asks = append(ordersResp.Asks, order)
+	return c.JSON(http.StatusOK, ordersResp)
+}
+
+// newOrders lists the orders of the levels, only the orders of userID keep
+// their user ID.
+func newOrders(levels []LevelView, userID int64) []*Order {
+	orders := []*Order{}
+	for _, level := range levels {
+		for _, order := range level.Orders {
+			var owner int64
+			if order.UserID == userID {
+				owner = userID
+			}
+			orders = append(orders, &Order{
+				UserID: 	owner,
+				ID: 		order.ID,
+				Price: 		level.Price,
+				Size: 		order.Size,
+				Bid: 		order.Bid,
+				Timestamp: 	order.Timestamp,
+			})
 		}
 	}
-	ex.mu.RUnlock()
 
-	return c.JSON(http.StatusOK, ordersResp)
+	return orders
 }
 
+// handleGetBook returns every resting order of the book (L3). It requires an
+// API key, and the user IDs of orders that do not belong to the caller are
+// omitted. Use the depth endpoint for the aggregated book.
 func (ex *Exchange) handleGetBook(c echo.Context) error{
+	userID, ok := ex.limiter.Authenticate(c)
+	if !ok {
+		return c.JSON(http.StatusUnauthorized, APIError{"valid API key required"})
+	}
+
 	market := Market(c.Param("market"))
-	ob, ok := ex.orderbooks[market]
+	engine, ok := ex.engine(market)
 
 	if !ok {
 		return c.JSON(http.StatusBadRequest, map[string]interface{}{"msg":"market not found"})
 	}
 
+	view := engine.View()
 	orderbookData := OrderbookData{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
-		Asks: 			[]*Order{},
-		Bids: 			[]*Order{},
-	}
-	for _, limit := range ob.Asks() {
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID: 	order.UserID,
-				ID: 		order.ID,
-				Price: 		order.Limit.Price,
-				Size: 		order.Size,
-				Bid: 		order.Bid,
-				Timestamp: 	order.Timestamp,
-			}
-			orderbookData.Asks = append(orderbookData.Asks, &o)
-		}	
-	}
-	for _, limit := range ob.Bids() {
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID: 	order.UserID,
-				ID: 		order.ID,
-				Price: 		order.Limit.Price,
-				Size: 		order.Size,
-				Bid: 		order.Bid,
-				Timestamp: 	order.Timestamp,
-			}
-			orderbookData.Bids = append(orderbookData.Bids, &o)
-		}	
+		Seq: 			view.Seq,
+		TotalBidVolume: view.TotalBidVolume,
+		TotalAskVolume: view.TotalAskVolume,
+		Asks: 			newOrders(view.Asks, userID),
+		Bids: 			newOrders(view.Bids, userID),
 	}
 
 	return c.JSON(http.StatusOK, orderbookData)
 }
 
+type BookHashResponse struct {
+	Seq 	int64
+	Hash 	string
+}
+
+func (ex *Exchange) handleGetBookHash(c echo.Context) error {
+	market := Market(c.Param("market"))
+	engine, ok := ex.engine(market)
+
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	resp, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		seq, hash := ob.Hash()
+		return BookHashResponse{seq, hash}, nil
+	})
+	if err != nil {
+		return engineError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
 type PriceResponse struct {
 	Price float64
 }
 
-func (ex *Exchange) handleGetBestBid(c echo.Context) error {
-	market := Market(c.Param("market"))
-	ob := ex.orderbooks[market]
+// bestOrder returns the best price of the levels. The user of the order at
+// that price is not public.
+func bestOrder(levels []LevelView) Order {
 	order := Order{}
-	if len(ob.Bids()) == 0 {
-		return c.JSON(http.StatusOK, order)
-	} 
-
-	bestLimit := ob.Bids()[0]
-	bestOrder := bestLimit.Orders[0]
+	if len(levels) == 0 {
+		return order
+	}
 
-	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
+	order.Price = levels[0].Price
 
-	return c.JSON(http.StatusOK, order)
+	return order
 }
 
-func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
+func (ex *Exchange) handleGetBestBid(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob := ex.orderbooks[market]
-	order := Order{}
-	if len(ob.Asks()) == 0 {
-		return c.JSON(http.StatusOK, order)
-	} 
+	engine, ok := ex.engine(market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
 
-	bestLimit := ob.Asks()[0]
-	bestOrder := bestLimit.Orders[0]
+	return c.JSON(http.StatusOK, bestOrder(engine.View().Bids))
+}
 
-	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
+func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
+	market := Market(c.Param("market"))
+	engine, ok := ex.engine(market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
 
-	return c.JSON(http.StatusOK, order)
+	return c.JSON(http.StatusOK, bestOrder(engine.View().Asks))
 }
 
 func (ex *Exchange) cancelOrder(c echo.Context) error {
 	idStr := c.Param("id")
 	id, _ := strconv.Atoi(idStr)
-	ob := ex.orderbooks[MarketETH]
-	order := ob.Orders[int64(id)]
-	ob.CancelOrder(order)
+
+	order, ok, err := ex.store.Order(int64(id))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{"order not found"})
+	}
+	if ok, err := ex.authorize(c, order.UserID); !ok {
+		return err
+	}
+
+	if err := ex.handleCancelOrder(MarketETH, int64(id)); err != nil {
+		return engineError(c, err)
+	}
 
 	log.Println("order canceled id => ", id)
 
 	return c.JSON(200, map[string]interface{}{"msg":"order deleted"})
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder){
-	ob := ex.orderbooks[market]
+func (ex *Exchange) handleCancelOrder(market Market, id int64) error {
+	engine, ok := ex.engine(market)
+	if !ok {
+		return fmt.Errorf("orderbook not found: %s", market)
+	}
+
+	_, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		order, ok := ex.workingOrder(ob, id)
+		if !ok {
+			return nil, fmt.Errorf("order not found: %d", id)
+		}
+		ex.stats.addCancel(order)
+
+		return nil, ex.cancelWorkingOrder(ob, market, order)
+	})
+
+	return err
+}
+
+// cancelWorkingOrder cancels an order resting in the book or a pending stop
+// order together with its order group. It runs on the matching goroutine of
+// the market.
+func (ex *Exchange) cancelWorkingOrder(ob *orderbook.Orderbook, market Market, order *orderbook.Order) error {
+	var err error
+	if stop, ok := ex.stops.remove(order.ID); ok {
+		order.Status = orderbook.StatusCanceled
+		order.UpdatedAt = time.Now().UnixNano()
+		err = ex.saveStop(stop)
+	} else {
+		price := order.Limit.Price
+		ob.CancelOrder(order)
+		ex.removeUserOrder(order)
+		err = ex.saveOrder(market, price, order)
+	}
+	ex.orderCanceled(ob, market, order)
+
+	return err
+}
+
+type marketOrderResult struct {
+	matches 		[]orderbook.Match
+	matchedOrders 	[]*MatchedOrder
+}
+
+func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder, error){
+	engine, ok := ex.engine(market)
+	if !ok {
+		return nil, nil, fmt.Errorf("orderbook not found: %s", market)
+	}
+
+	result, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		return ex.placeMarketOrder(ob, market, order)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := result.(marketOrderResult)
+
+	return res.matches, res.matchedOrders, nil
+}
+
+// placeMarketOrder fills the order against the book of the market. It runs
+// on the matching goroutine of the market.
+func (ex *Exchange) placeMarketOrder(ob *orderbook.Orderbook, market Market, order *orderbook.Order) (marketOrderResult, error) {
+	// halts and auctions stop matching, orders can still rest and be
+	// canceled
+	switch state, _ := ex.states.status(market); state.Status {
+	case MarketHalted:
+		return marketOrderResult{}, ErrMarketHalted
+	case MarketAuction:
+		return marketOrderResult{}, ErrMarketInAuction
+	}
+	if err := ex.checkRisk(ob, market, MarketOrder, 0, order); err != nil {
+		return marketOrderResult{}, err
+	}
+	if err := ex.checkReduceOnly(ob, market, order); err != nil {
+		return marketOrderResult{}, err
+	}
 	matches := ob.PlaceMarketOrder(order)
+	ex.stats.addOrder(order)
+	if order.Status == orderbook.StatusRejected {
+		if err := ex.saveOrder(market, 0, order); err != nil {
+			sugar.Error(err)
+		}
+		return marketOrderResult{}, fmt.Errorf("market order %d rejected: not enough volume for size %.2f", order.ID, order.Size)
+	}
 	matchedOrders := make([]*MatchedOrder, len(matches))
 	isBid := false
 	if order.Bid {isBid = true}
@@ -349,44 +1011,120 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 
 	avgPrice := sumPrice / float64(len(matches))
 
+	if err := ex.persistMatches(market, ob, order, matches); err != nil {
+		sugar.Error(err)
+	}
+
 	sugar.Infow("filled market order",
 		"avgPrice", 	avgPrice,
 		"type", 		order.Type(),
 		"size",			totalSizeFilled,
 	)
 
-	newOrderMap := make(map[int64][]*orderbook.Order)
+	for _, match := range matches {
+		if match.Ask.IsFilled() {
+			ex.removeUserOrder(match.Ask)
+		}
+		if match.Bid.IsFilled() {
+			ex.removeUserOrder(match.Bid)
+		}
+	}
+
+	return marketOrderResult{matches, matchedOrders}, nil
+}
+
+// removeUserOrder stops tracking a closed order of a user.
+func (ex *Exchange) removeUserOrder(order *orderbook.Order) {
 	ex.mu.Lock()
-	for userID, orderbookOrders := range ex.Orders {
-		for i := 0; i < len(orderbookOrders); i++ {
-			// if the order is not field we place it in the map copy.
-			// this means that the size of the order = 0
-			if !orderbookOrders[i].IsFilled() {
-				newOrderMap[userID] = append(newOrderMap[userID], orderbookOrders[i])
-			}
+	defer ex.mu.Unlock()
+
+	orders := ex.Orders[order.UserID]
+	for i := 0; i < len(orders); i++ {
+		if orders[i] == order {
+			ex.Orders[order.UserID] = append(orders[:i], orders[i+1:]...)
+			break
 		}
 	}
+}
 
-	ex.Orders = newOrderMap
-	ex.mu.Unlock()
+// persistMatches records the state of every order involved in the matches
+// of a market order together with the resulting trades.
+func (ex *Exchange) persistMatches(market Market, ob *orderbook.Orderbook, order *orderbook.Order, matches []orderbook.Match) error {
+	if err := ex.saveOrder(market, 0, order); err != nil {
+		return err
+	}
 
-	return matches, matchedOrders
+	for _, match := range matches {
+		maker := match.Ask
+		if !order.Bid {
+			maker = match.Bid
+		}
+		if err := ex.saveOrder(market, match.Price, maker); err != nil {
+			return err
+		}
+	}
+
+	for _, trade := range ob.Trades[len(ob.Trades)-len(matches):] {
+		if err := ex.store.SaveTrade(string(market), trade); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error{
-	ob := ex.orderbooks[market]
+	engine, ok := ex.engine(market)
+	if !ok {
+		return fmt.Errorf("orderbook not found: %s", market)
+	}
+
+	_, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+		return nil, ex.placeLimitOrder(ob, market, price, order)
+	})
+
+	return err
+}
+
+// placeLimitOrder rests the order in the book of the market. It runs on the
+// matching goroutine of the market.
+func (ex *Exchange) placeLimitOrder(ob *orderbook.Orderbook, market Market, price float64, order *orderbook.Order) error {
+	if order.Peg != nil {
+		pegged, ok := ob.PegPrice(order)
+		switch {
+		case ok:
+			price = pegged
+		case price <= 0:
+			return ErrNoPegReference
+		}
+	}
+	if err := ex.checkRisk(ob, market, LimitOrder, price, order); err != nil {
+		return err
+	}
+	if err := ex.checkReduceOnly(ob, market, order); err != nil {
+		return err
+	}
 	ob.PlaceLimitOrder(price, order)
+	ex.stats.addOrder(order)
+	if order.Status == orderbook.StatusRejected {
+		if err := ex.saveOrder(market, price, order); err != nil {
+			sugar.Error(err)
+		}
+		return ErrPostOnly
+	}
 
 	// keep track of the user orders
 	ex.mu.Lock()
 	ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
 	ex.mu.Unlock()
-	
-	return nil
+
+	// post-only orders may have slid to another price
+	return ex.saveOrder(market, order.Limit.Price, order)
 }
 
 type PlaceOrderResponse struct {
-	OrderID int64
+	OrderID 		int64
+	ClientOrderID 	string `json:",omitempty"`
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
@@ -395,59 +1133,181 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 	if err := json.NewDecoder(c.Request().Body).Decode(&placeOrderData); err != nil{
 		return err
 	}
+	if ok, err := ex.authorize(c, placeOrderData.UserID); !ok {
+		return err
+	}
+
+	if placeOrderData.ClientOrderID == "" {
+		return ex.placeOrder(c, placeOrderData)
+	}
+	if len(placeOrderData.ClientOrderID) > maxClientOrderIDLength {
+		return c.JSON(http.StatusBadRequest, APIError{"client order ID too long"})
+	}
+
+	key := clientOrderKey{placeOrderData.UserID, placeOrderData.ClientOrderID}
+	entry, owner := ex.clientOrders.reserve(key)
+	if !owner {
+		// a retry of an order that is placed or still being placed
+		<-entry.done
+		return c.JSON(entry.code, entry.body)
+	}
+
+	// the order may have been placed before a restart
+	record, ok, err := ex.store.OrderByClientID(key.userID, key.clientOrderID)
+	if err != nil {
+		ex.clientOrders.finish(key, entry, http.StatusInternalServerError, APIError{err.Error()})
+		return err
+	}
+	if ok && ex.clientOrders.recent(record.Timestamp) {
+		resp := &PlaceOrderResponse{record.ID, record.ClientOrderID}
+		ex.clientOrders.finish(key, entry, http.StatusOK, resp)
+		return c.JSON(http.StatusOK, resp)
+	}
+
+	rec := &captureWriter{ResponseWriter: c.Response().Writer}
+	c.Response().Writer = rec
+	err = ex.placeOrder(c, placeOrderData)
+	if !c.Response().Committed {
+		ex.clientOrders.finish(key, entry, http.StatusInternalServerError, APIError{"order could not be placed"})
+		return err
+	}
+	ex.clientOrders.finish(key, entry, c.Response().Status, json.RawMessage(bytes.TrimSpace(rec.body.Bytes())))
+
+	return err
+}
 
+// placeOrder places the order of the request and writes the response.
+func (ex *Exchange) placeOrder(c echo.Context, placeOrderData PlaceOrderRequest) error {
 	market := Market(placeOrderData.Market)
+	if !validPostOnly(placeOrderData.PostOnly) || (placeOrderData.PostOnly != "" && placeOrderData.Type != LimitOrder) {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid post-only behavior"})
+	}
+	if err := validatePeg(placeOrderData); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{err.Error()})
+	}
+	if err := validateTrail(placeOrderData); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{err.Error()})
+	}
+
 	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	order.ClientOrderID = placeOrderData.ClientOrderID
+	order.PostOnly = placeOrderData.PostOnly
+	order.ReduceOnly = placeOrderData.ReduceOnly
+	order.Peg = placeOrderData.Peg
+
+	// stop orders
+	if placeOrderData.StopPrice > 0 || placeOrderData.trailing() {
+		engine, ok := ex.engine(market)
+		if !ok {
+			return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+		}
+		_, err := engine.Execute(func(ob *orderbook.Orderbook) (any, error) {
+			return ex.placeRequest(ob, market, placeOrderData, order)
+		})
+		if err != nil {
+			return engineError(c, err)
+		}
+
+		return c.JSON(200, &PlaceOrderResponse{order.ID, order.ClientOrderID})
+	}
 
 	// limit orders
 	if placeOrderData.Type == LimitOrder {
 		if err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order); err != nil{
-			return err
+			return engineError(c, err)
 		}
 	}
 
 	// market orders
 	if placeOrderData.Type == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
+		matches, _, err := ex.handlePlaceMarketOrder(market, order)
+		if err != nil {
+			return engineError(c, err)
+		}
 
-		if err := ex.handleMatches(matches); err != nil{
+		if err := ex.handleMatches(market, matches); err != nil{
 			return err
 		}
 	}
 
-	resp := &PlaceOrderResponse{order.ID}
+	resp := &PlaceOrderResponse{order.ID, order.ClientOrderID}
 
 	return c.JSON(200, resp)
 }
 
-func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
+// handleMatches settles the matches of an order. The transfers of the order
+// are recorded as one settlement batch.
+func (ex *Exchange) handleMatches(market Market, matches []orderbook.Match) error {
+	batchID := ex.settlementIDs.Next(time.Now().UnixNano())
 	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
+		fromUser, ok := ex.user(match.Ask.UserID)
 		if !ok {
 			return fmt.Errorf("user not found: %d", match.Ask.UserID)
 		}
 
-		toUser, ok := ex.Users[match.Bid.UserID]
+		toUser, ok := ex.user(match.Bid.UserID)
 		if !ok {
 			return fmt.Errorf("user not found: %d", match.Bid.UserID)
 		}
 
-		toAddress := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
+		ex.limiter.RecordTrade(fromUser.ID)
+		ex.limiter.RecordTrade(toUser.ID)
 
-		// this is only used for the fees
-		// exchangePK := ex.PrivateKey.Public()
-		// publicKeyECDSA, ok := exchangePK.(*ecdsa.PublicKey)
-		// if !ok {
-		// 	return fmt.Errorf("error casting public key to ECDSA")
-		// }
+		toAddress := crypto.PubkeyToAddress(toUser.PrivateKey.PublicKey)
 
 		amount := big.NewInt(int64(match.SizeFilled))
-		transferETH(ex.Ctx, ex.Client, fromUser.PrivateKey, toAddress, amount)
+		settlement := store.SettlementRecord{
+			Market: 	string(market),
+			TradeID: 	match.TradeID,
+			BatchID: 	batchID,
+			FromUserID: fromUser.ID,
+			ToUserID: 	toUser.ID,
+			Amount: 	match.SizeFilled,
+			FromUserFee: match.AskFee,
+			ToUserFee: 	match.BidFee,
+			Timestamp: 	time.Now().UnixNano(),
+		}
+		if err := ex.transfer(fromUser.PrivateKey, toAddress, amount); err != nil {
+			settlement.Error = err.Error()
+		}
+		if settlement.Error == "" {
+			if err := ex.collectFee(fromUser, match.AskFee); err != nil {
+				settlement.Error = fmt.Sprintf("fee transfer: %v", err)
+			} else if err := ex.collectFee(toUser, match.BidFee); err != nil {
+				settlement.Error = fmt.Sprintf("fee transfer: %v", err)
+			}
+		}
+		if err := ex.store.SaveSettlement(settlement); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// collectFee charges the fee to the user and transfers the whole units the
+// user owes to the exchange, or pays whole units of rebates back to the
+// user. Fractions of a unit are collected with the next fees.
+func (ex *Exchange) collectFee(user *User, fee float64) error {
+	due, err := ex.feeLedger.charge(user.ID, fee)
+	if err != nil || due == 0 {
+		return err
+	}
+
+	if due < 0 {
+		err = ex.transfer(ex.PrivateKey, crypto.PubkeyToAddress(user.PrivateKey.PublicKey), big.NewInt(-due))
+	} else {
+		err = ex.transfer(user.PrivateKey, crypto.PubkeyToAddress(ex.PrivateKey.PublicKey), big.NewInt(due))
+	}
+	if err != nil {
+		if err := ex.feeLedger.unpaid(user.ID, due); err != nil {
+			sugar.Errorw("failed to save unpaid fees", "userID", user.ID, "due", due, "err", err)
+		}
+	}
+
+	return err
+}
+
 func transferETH(ctx context.Context, client *ethclient.Client, fromPK *ecdsa.PrivateKey, to common.Address, amount *big.Int) error {
 	publicKey := fromPK.Public()
 	publicKeyECDSA, ok := publicKey.(*ecdsa.PublicKey)
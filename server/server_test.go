@@ -0,0 +1,13 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
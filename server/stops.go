@@ -0,0 +1,373 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+)
+
+var ErrNoTrailReference = errors.New("no trade price to trail")
+
+type (
+	// StopOrderView is a pending stop order. Price is the limit price it
+	// enters the book at, zero for stop market orders. StopPrice is the
+	// current trigger level of trailing stops.
+	StopOrderView struct {
+		ID           int64
+		UserID       int64
+		Market       Market
+		Bid          bool
+		Size         float64
+		Price        float64
+		StopPrice    float64
+		TrailAmount  float64 `json:",omitempty"`
+		TrailPercent float64 `json:",omitempty"`
+		GroupID      int64   `json:",omitempty"`
+		Timestamp    int64
+	}
+)
+
+func (req PlaceOrderRequest) trailing() bool {
+	return req.TrailAmount != 0 || req.TrailPercent != 0
+}
+
+func validateTrail(req PlaceOrderRequest) error {
+	if !req.trailing() {
+		return nil
+	}
+	if req.TrailAmount != 0 && req.TrailPercent != 0 {
+		return fmt.Errorf("a trailing stop trails by an amount or a percentage")
+	}
+	if req.TrailAmount < 0 || req.TrailPercent < 0 || req.TrailPercent >= 100 {
+		return fmt.Errorf("invalid trailing distance")
+	}
+
+	return nil
+}
+
+// stopOrder is an order held by the exchange until a trade of its market
+// reaches stopPrice: at or above it for buy stops, at or below it for sell
+// stops. It then enters the book as a limit order at price, or as a market
+// order when price is zero.
+//
+// The stop price of a trailing stop follows the trades by trailAmount, or by
+// trailPercent of the trade price: it ratchets up as the price of a sell
+// stop's market rises and down as the price of a buy stop's market falls,
+// and never moves back. The limit price of a trailing stop limit order keeps
+// its distance to the stop price.
+type stopOrder struct {
+	order        *orderbook.Order
+	market       Market
+	price        float64
+	stopPrice    float64
+	trailAmount  float64
+	trailPercent float64
+}
+
+func (s *stopOrder) triggers(price float64) bool {
+	if s.order.Bid {
+		return price >= s.stopPrice
+	}
+
+	return price <= s.stopPrice
+}
+
+func (s *stopOrder) trailing() bool {
+	return s.trailAmount > 0 || s.trailPercent > 0
+}
+
+// trailedPrice returns the stop price trailing the trade price.
+func (s *stopOrder) trailedPrice(price float64) float64 {
+	distance := s.trailAmount
+	if s.trailPercent > 0 {
+		distance = price * s.trailPercent / 100
+	}
+	if s.order.Bid {
+		return price + distance
+	}
+
+	return price - distance
+}
+
+// ratchet moves the stop price of a trailing stop after a trade at the
+// price and reports whether it moved.
+func (s *stopOrder) ratchet(price float64) bool {
+	if !s.trailing() {
+		return false
+	}
+
+	stopPrice := s.trailedPrice(price)
+	if (s.order.Bid && stopPrice >= s.stopPrice) || (!s.order.Bid && stopPrice <= s.stopPrice) {
+		return false
+	}
+	if s.price > 0 {
+		s.price += stopPrice - s.stopPrice
+	}
+	s.stopPrice = stopPrice
+
+	return true
+}
+
+// stopOrders holds the pending stop orders of every market.
+type stopOrders struct {
+	mu     sync.Mutex
+	orders map[int64]*stopOrder
+}
+
+func newStopOrders() *stopOrders {
+	return &stopOrders{orders: make(map[int64]*stopOrder)}
+}
+
+func (s *stopOrders) add(stop *stopOrder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orders[stop.order.ID] = stop
+}
+
+func (s *stopOrders) get(id int64) (*stopOrder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stop, ok := s.orders[id]
+	return stop, ok
+}
+
+func (s *stopOrders) remove(id int64) (*stopOrder, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stop, ok := s.orders[id]
+	delete(s.orders, id)
+	return stop, ok
+}
+
+// views lists the stop orders matching fn oldest first. Trailing stops move
+// on the matching goroutines, so they are only read with the lock held.
+func (s *stopOrders) views(fn func(*stopOrder) bool) []StopOrderView {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	views := []StopOrderView{}
+	for _, stop := range s.orders {
+		if fn(stop) {
+			views = append(views, stop.view())
+		}
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].ID < views[j].ID })
+
+	return views
+}
+
+// filter returns the stop orders matching fn oldest first.
+func (s *stopOrders) filter(fn func(*stopOrder) bool) []*stopOrder {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stops := []*stopOrder{}
+	for _, stop := range s.orders {
+		if fn(stop) {
+			stops = append(stops, stop)
+		}
+	}
+	sort.Slice(stops, func(i, j int) bool { return stops[i].order.ID < stops[j].order.ID })
+
+	return stops
+}
+
+// trade ratchets the trailing stops of the market after a trade at the
+// price, then removes the stop orders the trade triggers. It returns the
+// trailing stops that moved and the triggered stops oldest first.
+func (s *stopOrders) trade(market Market, price float64) (moved, triggered []*stopOrder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, stop := range s.orders {
+		if stop.market != market {
+			continue
+		}
+		if stop.ratchet(price) {
+			moved = append(moved, stop)
+		}
+		if stop.triggers(price) {
+			triggered = append(triggered, stop)
+		}
+	}
+	for _, stop := range triggered {
+		delete(s.orders, stop.order.ID)
+	}
+	sort.Slice(moved, func(i, j int) bool { return moved[i].order.ID < moved[j].order.ID })
+	sort.Slice(triggered, func(i, j int) bool { return triggered[i].order.ID < triggered[j].order.ID })
+
+	return moved, triggered
+}
+
+func (s *stopOrder) view() StopOrderView {
+	return StopOrderView{
+		ID:           s.order.ID,
+		UserID:       s.order.UserID,
+		Market:       s.market,
+		Bid:          s.order.Bid,
+		Size:         s.order.Size,
+		Price:        s.price,
+		StopPrice:    s.stopPrice,
+		TrailAmount:  s.trailAmount,
+		TrailPercent: s.trailPercent,
+		Timestamp:    s.order.Timestamp,
+	}
+}
+
+// userStops lists the pending stop orders of the user with the groups they
+// belong to.
+func (ex *Exchange) userStops(userID int64) []StopOrderView {
+	views := ex.stops.views(func(s *stopOrder) bool { return s.order.UserID == userID })
+	for i := range views {
+		views[i].GroupID = ex.groups.groupOf(views[i].ID)
+	}
+
+	return views
+}
+
+// placeStopOrder holds the order of the stop until its stop price trades.
+// A trailing stop without a stop price starts trailing the last trade of
+// the market. It runs on the matching goroutine of the market.
+func (ex *Exchange) placeStopOrder(ob *orderbook.Orderbook, stop *stopOrder) error {
+	if stop.trailing() && stop.stopPrice == 0 {
+		if len(ob.Trades) == 0 {
+			return ErrNoTrailReference
+		}
+		stop.stopPrice = stop.trailedPrice(ob.Trades[len(ob.Trades)-1].Price)
+		if stop.stopPrice <= 0 {
+			return fmt.Errorf("invalid trailing distance for last price %.2f", ob.Trades[len(ob.Trades)-1].Price)
+		}
+	}
+
+	typ := LimitOrder
+	if stop.price == 0 {
+		typ = MarketOrder
+	}
+	order := stop.order
+	if err := ex.checkRisk(ob, stop.market, typ, stop.price, order); err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	if order.ID == 0 {
+		order.ID = ex.conditionalIDs.Next(now)
+	}
+	order.Timestamp = now
+	order.UpdatedAt = now
+	order.Status = orderbook.StatusPending
+	ex.stops.add(stop)
+
+	return ex.saveStop(stop)
+}
+
+func (ex *Exchange) saveStop(stop *stopOrder) error {
+	record := ex.orderRecord(stop.market, stop.price, stop.order)
+	record.StopPrice = stop.stopPrice
+	record.TrailAmount = stop.trailAmount
+	record.TrailPercent = stop.trailPercent
+
+	return ex.store.SaveOrder(record)
+}
+
+// triggerStops passes the trades of the market to the pending stop orders
+// one by one: trailing stops move first, then the stop orders the trade
+// triggered are placed. Stops wait while the market is halted or in an
+// auction. It runs on the matching goroutine of the market.
+func (ex *Exchange) triggerStops(ob *orderbook.Orderbook, market Market, trades []*orderbook.Trade) {
+	if state, _ := ex.states.status(market); state.Status != MarketOpen {
+		return
+	}
+
+	triggered := []*stopOrder{}
+	for _, trade := range trades {
+		moved, stops := ex.stops.trade(market, trade.Price)
+		for _, stop := range moved {
+			stop.order.UpdatedAt = trade.Timestamp
+			if err := ex.saveStop(stop); err != nil {
+				sugar.Error(err)
+			}
+		}
+		triggered = append(triggered, stops...)
+	}
+
+	for _, stop := range triggered {
+		order := stop.order
+		sugar.Infow("triggered stop order",
+			"id", order.ID,
+			"stopPrice", stop.stopPrice,
+			"price", stop.price,
+		)
+		ex.orderExecuted(ob, market, order.ID)
+
+		// the order takes its time priority from the trigger
+		order.Timestamp = 0
+		var err error
+		if stop.price > 0 {
+			err = ex.placeLimitOrder(ob, market, stop.price, order)
+		} else {
+			var result marketOrderResult
+			result, err = ex.placeMarketOrder(ob, market, order)
+			if err == nil {
+				go ex.settle(market, result.matches)
+			}
+		}
+		if err == nil {
+			continue
+		}
+
+		sugar.Errorw("failed to place triggered stop order", "id", order.ID, "err", err)
+		// orders the book rejected are already saved
+		if order.Status == orderbook.StatusPending {
+			order.Status = orderbook.StatusRejected
+			order.UpdatedAt = time.Now().UnixNano()
+			if err := ex.saveStop(stop); err != nil {
+				sugar.Error(err)
+			}
+		}
+	}
+}
+
+// settle settles matches made outside of a request, e.g. by triggered stop
+// orders.
+func (ex *Exchange) settle(market Market, matches []orderbook.Match) {
+	if err := ex.handleMatches(market, matches); err != nil {
+		sugar.Errorw("failed to settle matches", "market", market, "err", err)
+	}
+}
+
+// restoreStops loads the pending stop orders of the market.
+func (ex *Exchange) restoreStops(market Market, records []store.OrderRecord) {
+	for _, record := range records {
+		ex.conditionalIDs.Observe(record.ID)
+		if record.Status != orderbook.StatusPending {
+			continue
+		}
+
+		ex.stops.add(&stopOrder{
+			order: &orderbook.Order{
+				ID:            record.ID,
+				UserID:        record.UserID,
+				Size:          record.Size,
+				Bid:           record.Bid,
+				Timestamp:     record.Timestamp,
+				ClientOrderID: record.ClientOrderID,
+				ReduceOnly:    record.ReduceOnly,
+				Status:        record.Status,
+				UpdatedAt:     record.UpdatedAt,
+			},
+			market:       market,
+			price:        record.Price,
+			stopPrice:    record.StopPrice,
+			trailAmount:  record.TrailAmount,
+			trailPercent: record.TrailPercent,
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	StreamTicker StreamMessageType = "TICKER"
+
+	streamBufferSize = 256
+	streamWriteWait  = 5 * time.Second
+)
+
+type (
+	StreamMessageType string
+	// StreamMessage is a market data event pushed to the subscribers of a
+	// market.
+	StreamMessage struct {
+		Type   StreamMessageType
+		Market Market
+		Data   any
+	}
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type subscriber struct {
+	sendch chan StreamMessage
+}
+
+// Hub fans out the market data events of every market to its websocket
+// subscribers. Subscribers that cannot keep up are disconnected instead of
+// slowing down the publisher.
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[Market]map[*subscriber]struct{}
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[Market]map[*subscriber]struct{}),
+	}
+}
+
+func (h *Hub) subscribe(market Market) *subscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &subscriber{sendch: make(chan StreamMessage, streamBufferSize)}
+	if h.subscribers[market] == nil {
+		h.subscribers[market] = make(map[*subscriber]struct{})
+	}
+	h.subscribers[market][sub] = struct{}{}
+
+	return sub
+}
+
+func (h *Hub) unsubscribe(market Market, sub *subscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.subscribers[market][sub]; ok {
+		delete(h.subscribers[market], sub)
+		close(sub.sendch)
+	}
+}
+
+func (h *Hub) Publish(msg StreamMessage) {
+	h.mu.RLock()
+	slow := []*subscriber{}
+	for sub := range h.subscribers[msg.Market] {
+		select {
+		case sub.sendch <- msg:
+		default:
+			slow = append(slow, sub)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, sub := range slow {
+		h.unsubscribe(msg.Market, sub)
+	}
+}
+
+// handleStream streams the market data events of a market over a websocket.
+func (ex *Exchange) handleStream(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.engine(market); !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	sub := ex.stream.subscribe(market)
+	defer ex.stream.unsubscribe(market, sub)
+
+	// the client does not send anything, reading only detects the close
+	closech := make(chan struct{})
+	go func() {
+		defer close(closech)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg, ok := <-sub.sendch:
+			if !ok {
+				return nil
+			}
+			conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if err := conn.WriteJSON(msg); err != nil {
+				return nil
+			}
+		case <-closech:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/highxshell/crypto-exchange/marketdata"
+	"github.com/labstack/echo/v4"
+)
+
+// newTickerStats backfills the rolling statistics of the market from the
+// stored trade history.
+func (ex *Exchange) newTickerStats(market Market) (*marketdata.TickerStats, error) {
+	stats := marketdata.NewTickerStats(marketdata.TickerWindow)
+
+	trades, err := ex.store.Trades(string(market))
+	if err != nil {
+		return nil, err
+	}
+	for _, trade := range trades {
+		stats.AddTrade(trade)
+	}
+
+	return stats, nil
+}
+
+func newTicker(market Market, stats *marketdata.TickerStats, view *BookView) marketdata.Ticker {
+	ticker := stats.Ticker(string(market))
+	if len(view.Bids) > 0 {
+		ticker.BestBid = view.Bids[0].Price
+		ticker.BestBidSize = view.Bids[0].Volume
+	}
+	if len(view.Asks) > 0 {
+		ticker.BestAsk = view.Asks[0].Price
+		ticker.BestAskSize = view.Asks[0].Volume
+	}
+
+	return ticker
+}
+
+// tickerPublisher pushes the ticker of the market to the stream whenever a
+// command traded or changed the top of the book.
+func (ex *Exchange) tickerPublisher(market Market) func(view *BookView) {
+	var (
+		lastTrades int
+		lastTop    [4]float64
+	)
+
+	return func(view *BookView) {
+		ticker := newTicker(market, ex.tickers[market], view)
+		top := [4]float64{ticker.BestBid, ticker.BestBidSize, ticker.BestAsk, ticker.BestAskSize}
+		if len(view.Trades) == lastTrades && top == lastTop {
+			return
+		}
+		lastTrades = len(view.Trades)
+		lastTop = top
+
+		ex.stream.Publish(StreamMessage{
+			Type:   StreamTicker,
+			Market: market,
+			Data:   ticker,
+		})
+	}
+}
+
+func (ex *Exchange) handleGetTicker(c echo.Context) error {
+	market := Market(c.Param("market"))
+	engine, ok := ex.engine(market)
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	return c.JSON(http.StatusOK, newTicker(market, ex.tickers[market], engine.View()))
+}
+
+func (ex *Exchange) handleGetTickers(c echo.Context) error {
+	tickers := []marketdata.Ticker{}
+	for market, engine := range ex.engines {
+		tickers = append(tickers, newTicker(market, ex.tickers[market], engine.View()))
+	}
+	sort.Slice(tickers, func(i, j int) bool { return tickers[i].Market < tickers[j].Market })
+
+	return c.JSON(http.StatusOK, tickers)
+}
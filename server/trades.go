@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultTradesLimit = 100
+	maxTradesLimit     = 1000
+
+	RoleMaker FillRole = "MAKER"
+	RoleTaker FillRole = "TAKER"
+)
+
+type (
+	// PublicTrade is a trade without the users, orders and fees of the
+	// trade. Bid is the side of the aggressor.
+	PublicTrade struct {
+		ID        int64
+		Price     float64
+		Size      float64
+		Bid       bool
+		Timestamp int64
+	}
+	TradesResponse struct {
+		Trades []PublicTrade
+		// NextCursor is the cursor to request the next page with, zero when
+		// there are no more trades.
+		NextCursor int64
+	}
+
+	FillRole string
+	// Fill is a trade from the point of view of one of its users. Bid is
+	// the side of the user. Fee is in the base asset, negative for rebates.
+	Fill struct {
+		Market     Market
+		TradeID    int64
+		OrderID    int64
+		Bid        bool
+		Role       FillRole
+		Price      float64
+		Size       float64
+		Fee        float64
+		Settlement store.SettlementStatus
+		Timestamp  int64
+	}
+	FillsResponse struct {
+		Fills []Fill
+		// NextCursor is the cursor to request the next page with, empty when
+		// there are no more fills.
+		NextCursor string
+	}
+)
+
+// tradeQuery holds the time range and page requested by a trade history
+// endpoint. Timestamps are inclusive.
+type tradeQuery struct {
+	from  int64
+	to    int64
+	limit int
+}
+
+func parseTradeQuery(c echo.Context) (tradeQuery, error) {
+	from, err := queryInt64(c, "from", 0)
+	if err != nil {
+		return tradeQuery{}, fmt.Errorf("invalid from")
+	}
+	to, err := queryInt64(c, "to", math.MaxInt64)
+	if err != nil {
+		return tradeQuery{}, fmt.Errorf("invalid to")
+	}
+	limit, err := queryInt64(c, "limit", defaultTradesLimit)
+	if err != nil || limit <= 0 {
+		return tradeQuery{}, fmt.Errorf("invalid limit")
+	}
+	if limit > maxTradesLimit {
+		limit = maxTradesLimit
+	}
+
+	return tradeQuery{from, to, int(limit)}, nil
+}
+
+func (q tradeQuery) contains(timestamp int64) bool {
+	return timestamp >= q.from && timestamp <= q.to
+}
+
+// handleGetTrades returns the trades of a market oldest first. The cursor is
+// the ID of the last trade of the previous page.
+func (ex *Exchange) handleGetTrades(c echo.Context) error {
+	market := Market(c.Param("market"))
+	engine, ok := ex.engine(market)
+
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{"orderbook not found"})
+	}
+
+	query, err := parseTradeQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{err.Error()})
+	}
+	cursor, err := queryInt64(c, "cursor", 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid cursor"})
+	}
+
+	// trades are recorded in ID order
+	trades := engine.View().Trades
+	start := sort.Search(len(trades), func(i int) bool { return trades[i].ID > cursor })
+
+	resp := TradesResponse{Trades: []PublicTrade{}}
+	for _, trade := range trades[start:] {
+		if !query.contains(trade.Timestamp) {
+			continue
+		}
+		if len(resp.Trades) == query.limit {
+			resp.NextCursor = resp.Trades[len(resp.Trades)-1].ID
+			break
+		}
+		resp.Trades = append(resp.Trades, newPublicTrade(trade))
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+func newPublicTrade(trade *orderbook.Trade) PublicTrade {
+	return PublicTrade{
+		ID:        trade.ID,
+		Price:     trade.Price,
+		Size:      trade.Size,
+		Bid:       trade.Bid,
+		Timestamp: trade.Timestamp,
+	}
+}
+
+func fillCursor(fill Fill) string {
+	return fmt.Sprintf("%s:%d", fill.Market, fill.TradeID)
+}
+
+// userFills returns the fills of a user in every market ordered by time.
+func (ex *Exchange) userFills(userID int64) ([]Fill, error) {
+	settlements, err := ex.store.Settlements()
+	if err != nil {
+		return nil, err
+	}
+	settled := make(map[string]store.SettlementStatus)
+	for _, settlement := range settlements {
+		settled[fmt.Sprintf("%s:%d", settlement.Market, settlement.TradeID)] = settlement.Status()
+	}
+
+	fills := []Fill{}
+	for market := range ex.engines {
+		trades, err := ex.store.Trades(string(market))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, trade := range trades {
+			fill := Fill{
+				Market:    market,
+				TradeID:   trade.ID,
+				Price:     trade.Price,
+				Size:      trade.Size,
+				Timestamp: trade.Timestamp,
+			}
+			switch userID {
+			case trade.TakerUserID:
+				fill.OrderID = trade.TakerOrderID
+				fill.Bid = trade.Bid
+				fill.Role = RoleTaker
+				fill.Fee = trade.TakerFee
+			case trade.MakerUserID:
+				fill.OrderID = trade.MakerOrderID
+				fill.Bid = !trade.Bid
+				fill.Role = RoleMaker
+				fill.Fee = trade.MakerFee
+			default:
+				continue
+			}
+
+			fill.Settlement = store.SettlementPending
+			if status, ok := settled[fillCursor(fill)]; ok {
+				fill.Settlement = status
+			}
+			fills = append(fills, fill)
+		}
+	}
+
+	sort.SliceStable(fills, func(i, j int) bool {
+		if fills[i].Timestamp != fills[j].Timestamp {
+			return fills[i].Timestamp < fills[j].Timestamp
+		}
+		if fills[i].Market != fills[j].Market {
+			return fills[i].Market < fills[j].Market
+		}
+		return fills[i].TradeID < fills[j].TradeID
+	})
+
+	return fills, nil
+}
+
+// handleGetFills returns the fills of a user oldest first. The cursor is the
+// NextCursor of the previous page. Only the user can read its fills.
+func (ex *Exchange) handleGetFills(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("userID"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+	if ok, err := ex.authorize(c, userID); !ok {
+		return err
+	}
+
+	query, err := parseTradeQuery(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{err.Error()})
+	}
+
+	fills, err := ex.userFills(userID)
+	if err != nil {
+		return err
+	}
+
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		i := 0
+		for ; i < len(fills) && fillCursor(fills[i]) != cursor; i++ {
+		}
+		if i == len(fills) {
+			return c.JSON(http.StatusBadRequest, APIError{"invalid cursor"})
+		}
+		fills = fills[i+1:]
+	}
+
+	resp := FillsResponse{Fills: []Fill{}}
+	for _, fill := range fills {
+		if !query.contains(fill.Timestamp) {
+			continue
+		}
+		if len(resp.Fills) == query.limit {
+			resp.NextCursor = fillCursor(resp.Fills[len(resp.Fills)-1])
+			break
+		}
+		resp.Fills = append(resp.Fills, fill)
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/labstack/echo/v4"
+)
+
+func doGet(t *testing.T, handler echo.HandlerFunc, target, param, value string, resp any) int {
+	t.Helper()
+
+	return doGetTarget(t, handler, target, []string{param}, []string{value}, resp)
+}
+
+func doGetTarget(t *testing.T, handler echo.HandlerFunc, target string, params, values []string, resp any) int {
+	t.Helper()
+
+	return doRequest(t, handler, httptest.NewRequest(http.MethodGet, target, nil), params, values, resp)
+}
+
+// doGetAuth sends the request with the API key of a user.
+func doGetAuth(t *testing.T, handler echo.HandlerFunc, target, apiKey, param, value string, resp any) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set(HeaderAPIKey, apiKey)
+	return doRequest(t, handler, req, []string{param}, []string{value}, resp)
+}
+
+func doRequest(t *testing.T, handler echo.HandlerFunc, req *http.Request, params, values []string, resp any) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.SetParamNames(params...)
+	c.SetParamValues(values...)
+	if err := handler(c); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal(rec.Body.Bytes(), resp)
+
+	return rec.Code
+}
+
+func TestTradeHistoryPagination(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+	ex.limiter.cfg.APIKeys["maker"] = 1
+	ex.limiter.cfg.APIKeys["taker"] = 2
+
+	for i := 0; i < 5; i++ {
+		ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 1, 1))
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 1, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine, _ := ex.engine(MarketETH)
+	trades := engine.View().Trades
+	assert(t, len(trades), 5)
+
+	resp := TradesResponse{}
+	doGet(t, ex.handleGetTrades, "/trades/ETH?limit=2", "market", "ETH", &resp)
+	assert(t, len(resp.Trades), 2)
+	assert(t, resp.Trades[0], PublicTrade{
+		ID:        trades[0].ID,
+		Price:     1_000,
+		Size:      1,
+		Bid:       true,
+		Timestamp: trades[0].Timestamp,
+	})
+	assert(t, resp.NextCursor, trades[1].ID)
+
+	resp = TradesResponse{}
+	doGet(t, ex.handleGetTrades, fmt.Sprintf("/trades/ETH?limit=2&cursor=%d", trades[3].ID), "market", "ETH", &resp)
+	assert(t, len(resp.Trades), 1)
+	assert(t, resp.Trades[0].ID, trades[4].ID)
+	assert(t, resp.NextCursor, int64(0))
+
+	// the fills are private to their user
+	fills := FillsResponse{}
+	assert(t, doGet(t, ex.handleGetFills, "/fills/1", "userID", "1", &fills), http.StatusUnauthorized)
+	assert(t, doGetAuth(t, ex.handleGetFills, "/fills/1", "taker", "userID", "1", &fills), http.StatusForbidden)
+
+	doGetAuth(t, ex.handleGetFills, "/fills/1?limit=3", "maker", "userID", "1", &fills)
+	assert(t, len(fills.Fills), 3)
+	cursor := fmt.Sprintf("ETH:%d", trades[2].ID)
+	assert(t, fills.NextCursor, cursor)
+	assert(t, fills.Fills[0].Role, RoleMaker)
+	assert(t, fills.Fills[0].Bid, false)
+	assert(t, fills.Fills[0].Settlement, store.SettlementPending)
+
+	db.SaveSettlement(store.SettlementRecord{Market: "ETH", TradeID: trades[3].ID, Error: "no funds"})
+	db.SaveSettlement(store.SettlementRecord{Market: "ETH", TradeID: trades[4].ID})
+	fills = FillsResponse{}
+	doGetAuth(t, ex.handleGetFills, "/fills/2?cursor="+cursor, "taker", "userID", "2", &fills)
+	assert(t, len(fills.Fills), 2)
+	assert(t, fills.Fills[0].Role, RoleTaker)
+	assert(t, fills.Fills[0].Bid, true)
+	assert(t, fills.Fills[0].Settlement, store.SettlementFailed)
+	assert(t, fills.Fills[1].Settlement, store.SettlementSettled)
+	assert(t, fills.NextCursor, "")
+}
@@ -0,0 +1,240 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/highxshell/crypto-exchange/userstats"
+	"github.com/labstack/echo/v4"
+)
+
+// userStatsFlushInterval is how often the statistics updated since the last
+// flush are persisted.
+const userStatsFlushInterval = 1 * time.Second
+
+// userStatsTracker keeps the rolling statistics of every user up to date.
+// Updates run on the matching goroutines, so the statistics are persisted in
+// the background: a user updated many times between two flushes is saved
+// once. Fills since the last flush are added again from the persisted
+// trades on restore, so positions and PnL survive a crash. Order and cancel
+// counts since the last flush are lost.
+type userStatsTracker struct {
+	mu     sync.Mutex
+	store  store.Store
+	users  map[int64]*userstats.Stats
+	dirty  map[int64]bool
+	quitch chan struct{}
+	wg     sync.WaitGroup
+}
+
+// newUserStatsTracker loads the persisted statistics and adds the fills of
+// the trades after the last trade of each user.
+func (ex *Exchange) newUserStatsTracker() (*userStatsTracker, error) {
+	t := &userStatsTracker{
+		store:  ex.store,
+		users:  make(map[int64]*userstats.Stats),
+		dirty:  make(map[int64]bool),
+		quitch: make(chan struct{}),
+	}
+
+	saved, err := ex.store.UserStats()
+	if err != nil {
+		return nil, err
+	}
+	for _, stats := range saved {
+		t.users[stats.UserID] = stats
+	}
+
+	for market := range ex.orderbooks {
+		trades, err := ex.store.Trades(string(market))
+		if err != nil {
+			return nil, err
+		}
+		for _, trade := range trades {
+			maker := trade.ID > t.lastTrade(trade.MakerUserID, market)
+			taker := trade.ID > t.lastTrade(trade.TakerUserID, market)
+			t.addFills(market, trade, maker, taker)
+		}
+	}
+
+	return t, nil
+}
+
+func (t *userStatsTracker) start() {
+	t.wg.Add(1)
+	go t.loop()
+}
+
+// stop persists the statistics updated since the last flush.
+func (t *userStatsTracker) stop() {
+	close(t.quitch)
+	t.wg.Wait()
+	t.flush()
+}
+
+func (t *userStatsTracker) loop() {
+	defer t.wg.Done()
+
+	ticker := time.NewTicker(userStatsFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.flush()
+		case <-t.quitch:
+			return
+		}
+	}
+}
+
+// flush persists copies of the statistics updated since the last flush, the
+// updates are not held up while they are written.
+func (t *userStatsTracker) flush() {
+	t.mu.Lock()
+	updated := make([]*userstats.Stats, 0, len(t.dirty))
+	for userID := range t.dirty {
+		updated = append(updated, t.users[userID].Clone())
+	}
+	t.dirty = make(map[int64]bool)
+	t.mu.Unlock()
+
+	for _, stats := range updated {
+		if err := t.store.SaveUserStats(stats); err != nil {
+			sugar.Errorw("failed to save user stats", "userID", stats.UserID, "err", err)
+			// try again with the next flush
+			t.mu.Lock()
+			t.dirty[stats.UserID] = true
+			t.mu.Unlock()
+		}
+	}
+}
+
+// update applies fn to the statistics of the user, they are persisted with
+// the next flush.
+func (t *userStatsTracker) update(userID int64, fn func(stats *userstats.Stats)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.users[userID]
+	if !ok {
+		stats = userstats.New(userID)
+		t.users[userID] = stats
+	}
+	fn(stats)
+	t.dirty[userID] = true
+}
+
+func (t *userStatsTracker) addOrder(order *orderbook.Order) {
+	t.update(order.UserID, func(stats *userstats.Stats) {
+		stats.AddOrder(order.Timestamp)
+	})
+}
+
+func (t *userStatsTracker) addCancel(order *orderbook.Order) {
+	t.update(order.UserID, func(stats *userstats.Stats) {
+		stats.AddCancel(order.UpdatedAt)
+	})
+}
+
+func (t *userStatsTracker) addTrades(market Market, trades []*orderbook.Trade) {
+	for _, trade := range trades {
+		t.addFills(market, trade, true, true)
+	}
+}
+
+// addFills adds the fill of the maker and of the taker of the trade.
+func (t *userStatsTracker) addFills(market Market, trade *orderbook.Trade, maker, taker bool) {
+	if maker {
+		t.update(trade.MakerUserID, func(stats *userstats.Stats) {
+			stats.AddFill(string(market), !trade.Bid, true, trade.Price, trade.Size, trade.MakerFee, trade.Timestamp)
+			setLastTrade(stats, market, trade.ID)
+		})
+	}
+	if taker {
+		t.update(trade.TakerUserID, func(stats *userstats.Stats) {
+			stats.AddFill(string(market), trade.Bid, false, trade.Price, trade.Size, trade.TakerFee, trade.Timestamp)
+			setLastTrade(stats, market, trade.ID)
+		})
+	}
+}
+
+func setLastTrade(stats *userstats.Stats, market Market, tradeID int64) {
+	if stats.LastTrades == nil {
+		stats.LastTrades = make(map[string]int64)
+	}
+	stats.LastTrades[string(market)] = tradeID
+}
+
+// lastTrade returns the ID of the last trade of the market in the
+// statistics of the user.
+func (t *userStatsTracker) lastTrade(userID int64, market Market) int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.users[userID]
+	if !ok {
+		return 0
+	}
+
+	return stats.LastTrades[string(market)]
+}
+
+func (t *userStatsTracker) volume(userID int64, now int64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.users[userID]
+	if !ok {
+		return 0
+	}
+
+	return stats.Volume(now)
+}
+
+// risk returns the position of the user in the market and its realized PnL
+// of the day.
+func (t *userStatsTracker) risk(userID int64, market Market, now int64) (float64, float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.users[userID]
+	if !ok {
+		return 0, 0
+	}
+
+	position := 0.0
+	if pos, ok := stats.Positions[string(market)]; ok {
+		position = pos.Size
+	}
+
+	return position, stats.DailyPnL(now)
+}
+
+func (t *userStatsTracker) summary(userID int64, now int64) userstats.Summary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats, ok := t.users[userID]
+	if !ok {
+		stats = userstats.New(userID)
+	}
+
+	return stats.Summary(now)
+}
+
+func (ex *Exchange) handleGetUserStats(c echo.Context) error {
+	userID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{"invalid user ID"})
+	}
+	if ok, err := ex.authorize(c, userID); !ok {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ex.stats.summary(userID, time.Now().UnixNano()))
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/store"
+	"github.com/highxshell/crypto-exchange/userstats"
+)
+
+func TestUserStats(t *testing.T) {
+	db := store.NewMemoryStore()
+	ex := newTestExchange(t, db)
+
+	ask := orderbook.NewOrder(false, 2, 1)
+	canceled := orderbook.NewOrder(false, 1, 1)
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, ask)
+	ex.handlePlaceLimitOrder(MarketETH, 1_100, canceled)
+	if err := ex.handleCancelOrder(MarketETH, canceled.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 2, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	maker := userstats.Summary{}
+	assert(t, doGet(t, ex.handleGetUserStats, "/users/1/stats", "id", "1", &maker), http.StatusUnauthorized)
+	doGetAuth(t, ex.handleGetUserStats, "/users/1/stats", userKey(ex, 1), "id", "1", &maker)
+	assert(t, maker.Orders, int64(2))
+	assert(t, maker.Cancels, int64(1))
+	assert(t, maker.CancelRatio, 0.5)
+	assert(t, maker.MakerVolume, 2_000.0)
+	assert(t, maker.MakerRatio, 1.0)
+	assert(t, maker.Positions["ETH"], userstats.Position{Size: -2, AvgPrice: 1_000})
+
+	taker := userstats.Summary{}
+	doGetAuth(t, ex.handleGetUserStats, "/users/2/stats", userKey(ex, 2), "id", "2", &taker)
+	assert(t, taker.TakerVolume, 2_000.0)
+	assert(t, taker.Positions["ETH"], userstats.Position{Size: 2, AvgPrice: 1_000})
+	// the fee is the only realized PnL of an open position
+	assert(t, taker.RealizedPnL["ETH"], -ex.engines[MarketETH].View().Trades[0].TakerFee*1_000)
+
+	// the statistics survive a restart
+	ex.Close()
+	ex = newTestExchange(t, db)
+	restored := userstats.Summary{}
+	doGetAuth(t, ex.handleGetUserStats, "/users/1/stats", userKey(ex, 1), "id", "1", &restored)
+	assert(t, restored, maker)
+}
+
+type countingStore struct {
+	*store.MemoryStore
+	saves int
+}
+
+func (s *countingStore) SaveUserStats(stats *userstats.Stats) error {
+	s.saves++
+	return s.MemoryStore.SaveUserStats(stats)
+}
+
+func TestUserStatsAreFlushedInBatches(t *testing.T) {
+	db := &countingStore{MemoryStore: store.NewMemoryStore()}
+	ex := newTestExchange(t, db)
+	ex.Close()
+
+	tracker := ex.stats
+	tracker.store = db
+	db.saves = 0
+	now := time.Now().UnixNano()
+	for i := 0; i < 100; i++ {
+		order := orderbook.NewOrder(true, 1, 1)
+		order.Timestamp = now
+		tracker.addOrder(order)
+	}
+	assert(t, db.saves, 0)
+
+	tracker.flush()
+	assert(t, db.saves, 1)
+	saved, _ := db.UserStats()
+	assert(t, saved[0].Summary(now).Orders, int64(100))
+
+	tracker.flush()
+	assert(t, db.saves, 1)
+}
+
+// lossyStore drops the statistics it saves once lose is set, like a crash
+// before they are flushed.
+type lossyStore struct {
+	*store.MemoryStore
+	lose atomic.Bool
+}
+
+func (s *lossyStore) SaveUserStats(stats *userstats.Stats) error {
+	if s.lose.Load() {
+		return nil
+	}
+	return s.MemoryStore.SaveUserStats(stats)
+}
+
+func TestUserStatsPositionsSurviveACrash(t *testing.T) {
+	db := &lossyStore{MemoryStore: store.NewMemoryStore()}
+	ex := newTestExchange(t, db)
+
+	ex.handlePlaceLimitOrder(MarketETH, 1_000, orderbook.NewOrder(false, 3, 1))
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	ex.stats.flush()
+
+	db.lose.Store(true)
+	if _, _, err := ex.handlePlaceMarketOrder(MarketETH, orderbook.NewOrder(true, 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	ex.Close()
+
+	// the fills after the last flush come back from the trades, the ones
+	// before it are not added twice
+	ex = newTestExchange(t, db.MemoryStore)
+	defer ex.Close()
+	now := time.Now().UnixNano()
+	maker := ex.stats.summary(1, now)
+	assert(t, maker.Positions["ETH"], userstats.Position{Size: -2, AvgPrice: 1_000})
+	assert(t, maker.MakerVolume, 2_000.0)
+	position, _ := ex.stats.risk(2, MarketETH, now)
+	assert(t, position, 2.0)
+}
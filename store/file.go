@@ -0,0 +1,297 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/highxshell/crypto-exchange/marketdata"
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/userstats"
+)
+
+const (
+	kindOrder        entryKind = "ORDER"
+	kindTrade        entryKind = "TRADE"
+	kindSettlement   entryKind = "SETTLEMENT"
+	kindCandle       entryKind = "CANDLE"
+	kindUserStats    entryKind = "USER_STATS"
+	kindOrderGroup   entryKind = "ORDER_GROUP"
+	kindFeeBalance   entryKind = "FEE_BALANCE"
+	kindMarketState  entryKind = "MARKET_STATE"
+	kindRiskOverride entryKind = "RISK_OVERRIDE"
+)
+
+type (
+	entryKind string
+	entry     struct {
+		Kind         entryKind
+		Order        *OrderRecord        `json:",omitempty"`
+		Trade        *TradeRecord        `json:",omitempty"`
+		Settlement   *SettlementRecord   `json:",omitempty"`
+		Candle       *CandleRecord       `json:",omitempty"`
+		UserStats    *userstats.Stats    `json:",omitempty"`
+		OrderGroup   *OrderGroupRecord   `json:",omitempty"`
+		FeeBalance   *FeeBalanceRecord   `json:",omitempty"`
+		MarketState  *MarketStateRecord  `json:",omitempty"`
+		RiskOverride *RiskOverrideRecord `json:",omitempty"`
+	}
+	CandleRecord struct {
+		Market string
+		Candle marketdata.Candle
+	}
+)
+
+// FileStore is an embedded Store backed by an append-only log file. Every
+// record is synced to disk before the write returns. On open the log is
+// replayed into an in-memory index.
+type FileStore struct {
+	mu sync.Mutex
+	f  logFile
+	// offset is the end of the last complete record in the log
+	offset int64
+	// err is set when a failed write could not be undone, the log is torn
+	// and no more records are appended after it
+	err   error
+	index *MemoryStore
+}
+
+// logFile is the file the log is written to, tests replace it to fail
+// writes.
+type logFile interface {
+	io.ReadWriteSeeker
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		f:     f,
+		index: NewMemoryStore(),
+	}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// load replays the log into the index. A torn record at the end of the log,
+// left behind by a crash in the middle of a write, is truncated. Records are
+// written with their newline in one write, so only the last record can be
+// missing it. Any other corrupt record fails the load instead of discarding
+// the history after it.
+func (s *FileStore) load() error {
+	var (
+		reader = bufio.NewReader(s.f)
+		offset int64
+	)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var e entry
+		if err := json.Unmarshal(bytes.TrimSpace(line), &e); err != nil {
+			return fmt.Errorf("corrupt store record at offset %d: %w", offset, err)
+		}
+		if err := s.apply(e); err != nil {
+			return err
+		}
+		offset += int64(len(line))
+	}
+
+	s.offset = offset
+
+	return s.truncate()
+}
+
+// truncate cuts the log back to the end of its last complete record.
+func (s *FileStore) truncate() error {
+	if err := s.f.Truncate(s.offset); err != nil {
+		return err
+	}
+	_, err := s.f.Seek(s.offset, io.SeekStart)
+
+	return err
+}
+
+func (s *FileStore) apply(e entry) error {
+	switch e.Kind {
+	case kindOrder:
+		return s.index.SaveOrder(*e.Order)
+	case kindTrade:
+		return s.index.SaveTrade(e.Trade.Market, e.Trade.Trade)
+	case kindSettlement:
+		return s.index.SaveSettlement(*e.Settlement)
+	case kindCandle:
+		return s.index.SaveCandle(e.Candle.Market, e.Candle.Candle)
+	case kindUserStats:
+		return s.index.SaveUserStats(e.UserStats)
+	case kindOrderGroup:
+		return s.index.SaveOrderGroup(*e.OrderGroup)
+	case kindFeeBalance:
+		return s.index.SaveFeeBalance(*e.FeeBalance)
+	case kindMarketState:
+		return s.index.SaveMarketState(*e.MarketState)
+	case kindRiskOverride:
+		return s.index.SaveRiskOverride(*e.RiskOverride)
+	}
+
+	return fmt.Errorf("unknown store entry kind: %s", e.Kind)
+}
+
+func (s *FileStore) append(e entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	if err := s.write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	return s.apply(e)
+}
+
+// write appends a record to the log and syncs it. A failed write or sync
+// can leave part of the record in the log, it is truncated so the next
+// record does not follow a torn one. When that fails too the store refuses
+// further writes rather than corrupting the middle of the log.
+func (s *FileStore) write(record []byte) error {
+	n, err := s.f.Write(record)
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if err == nil {
+		s.offset += int64(n)
+		return nil
+	}
+
+	if terr := s.truncate(); terr != nil {
+		s.err = fmt.Errorf("store log is torn at offset %d: %w", s.offset, terr)
+	}
+
+	return err
+}
+
+func (s *FileStore) SaveOrder(o OrderRecord) error {
+	return s.append(entry{Kind: kindOrder, Order: &o})
+}
+
+func (s *FileStore) SaveTrade(market string, trade *orderbook.Trade) error {
+	return s.append(entry{Kind: kindTrade, Trade: &TradeRecord{market, trade}})
+}
+
+func (s *FileStore) SaveSettlement(settlement SettlementRecord) error {
+	return s.append(entry{Kind: kindSettlement, Settlement: &settlement})
+}
+
+func (s *FileStore) SaveCandle(market string, candle marketdata.Candle) error {
+	return s.append(entry{Kind: kindCandle, Candle: &CandleRecord{market, candle}})
+}
+
+func (s *FileStore) SaveUserStats(stats *userstats.Stats) error {
+	return s.append(entry{Kind: kindUserStats, UserStats: stats})
+}
+
+func (s *FileStore) SaveOrderGroup(g OrderGroupRecord) error {
+	return s.append(entry{Kind: kindOrderGroup, OrderGroup: &g})
+}
+
+func (s *FileStore) SaveFeeBalance(b FeeBalanceRecord) error {
+	return s.append(entry{Kind: kindFeeBalance, FeeBalance: &b})
+}
+
+func (s *FileStore) SaveMarketState(state MarketStateRecord) error {
+	return s.append(entry{Kind: kindMarketState, MarketState: &state})
+}
+
+func (s *FileStore) SaveRiskOverride(o RiskOverrideRecord) error {
+	return s.append(entry{Kind: kindRiskOverride, RiskOverride: &o})
+}
+
+func (s *FileStore) Orders(market string) ([]OrderRecord, error) {
+	return s.index.Orders(market)
+}
+
+func (s *FileStore) Order(id int64) (OrderRecord, bool, error) {
+	return s.index.Order(id)
+}
+
+func (s *FileStore) OrderByClientID(userID int64, clientOrderID string) (OrderRecord, bool, error) {
+	return s.index.OrderByClientID(userID, clientOrderID)
+}
+
+func (s *FileStore) UserOrders(userID int64, status orderbook.OrderStatus) ([]OrderRecord, error) {
+	return s.index.UserOrders(userID, status)
+}
+
+func (s *FileStore) Trades(market string) ([]*orderbook.Trade, error) {
+	return s.index.Trades(market)
+}
+
+func (s *FileStore) Settlements() ([]SettlementRecord, error) {
+	return s.index.Settlements()
+}
+
+func (s *FileStore) Candles(market string) ([]marketdata.Candle, error) {
+	return s.index.Candles(market)
+}
+
+func (s *FileStore) UserStats() ([]*userstats.Stats, error) {
+	return s.index.UserStats()
+}
+
+func (s *FileStore) OrderGroups() ([]OrderGroupRecord, error) {
+	return s.index.OrderGroups()
+}
+
+func (s *FileStore) OrderGroup(id int64) (OrderGroupRecord, bool, error) {
+	return s.index.OrderGroup(id)
+}
+
+func (s *FileStore) FeeBalances() ([]FeeBalanceRecord, error) {
+	return s.index.FeeBalances()
+}
+
+func (s *FileStore) MarketStates() ([]MarketStateRecord, error) {
+	return s.index.MarketStates()
+}
+
+func (s *FileStore) RiskOverrides() ([]RiskOverrideRecord, error) {
+	return s.index.RiskOverrides()
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.f.Close()
+}
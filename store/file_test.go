@@ -0,0 +1,185 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/userstats"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exchange.log")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := OrderRecord{ID: 1, UserID: 1, Market: "ETH", Price: 10, Size: 5, Timestamp: 1, Status: orderbook.StatusNew}
+	s.SaveOrder(order)
+	order.Size = 2
+	s.SaveOrder(order)
+	s.SaveOrder(OrderRecord{ID: 2, UserID: 1, Market: "ETH", Price: 10, Size: 5, Timestamp: 2, Status: orderbook.StatusNew})
+	s.SaveTrade("ETH", &orderbook.Trade{Price: 10, Size: 3, Timestamp: 3})
+	s.SaveSettlement(SettlementRecord{FromUserID: 1, ToUserID: 2, Amount: 3})
+	stats := userstats.New(1)
+	stats.AddFill("ETH", true, true, 10, 3, 0, 3)
+	s.SaveUserStats(stats)
+	stats.AddOrder(4)
+	s.SaveUserStats(stats)
+	group := OrderGroupRecord{ID: 5, UserID: 1, Market: "ETH", Type: GroupOCO, Status: GroupActive, OrderIDs: []int64{1, 2}, Timestamp: 5}
+	s.SaveOrderGroup(group)
+	group.Status = GroupCanceled
+	s.SaveOrderGroup(group)
+	s.SaveFeeBalance(FeeBalanceRecord{UserID: 1, Owed: 0.5})
+	s.SaveFeeBalance(FeeBalanceRecord{UserID: 1, Owed: -0.25})
+	s.SaveMarketState(MarketStateRecord{Market: "ETH", Status: "HALTED", Reason: "maintenance", Since: 1})
+	s.SaveMarketState(MarketStateRecord{Market: "ETH", Status: "AUCTION", Since: 2, ResumeAt: 3})
+	s.SaveRiskOverride(RiskOverrideRecord{UserID: 1, MaxOrderSize: 5})
+	s.SaveRiskOverride(RiskOverrideRecord{UserID: 2, MaxPosition: 3})
+	s.SaveRiskOverride(RiskOverrideRecord{UserID: 1, Cleared: true})
+	s.Close()
+
+	// simulate a crash in the middle of a write
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"Kind":"ORDER","Order":{"ID":3`)
+	f.Close()
+
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	orders, _ := s.Orders("ETH")
+	assert(t, len(orders), 2)
+	assert(t, orders[0], order)
+	trades, _ := s.Trades("ETH")
+	assert(t, len(trades), 1)
+	assert(t, trades[0].Size, 3.0)
+	settlements, _ := s.Settlements()
+	assert(t, len(settlements), 1)
+	userStats, _ := s.UserStats()
+	assert(t, len(userStats), 1)
+	assert(t, userStats[0], stats)
+	groups, _ := s.OrderGroups()
+	assert(t, groups, []OrderGroupRecord{group})
+	balances, _ := s.FeeBalances()
+	assert(t, balances, []FeeBalanceRecord{{UserID: 1, Owed: -0.25}})
+	states, _ := s.MarketStates()
+	assert(t, states, []MarketStateRecord{{Market: "ETH", Status: "AUCTION", Since: 2, ResumeAt: 3}})
+	overrides, _ := s.RiskOverrides()
+	assert(t, overrides, []RiskOverrideRecord{{UserID: 2, MaxPosition: 3}})
+
+	// the torn record is truncated so new records are appended cleanly
+	s.SaveOrder(OrderRecord{ID: 3, Market: "ETH", Timestamp: 3, Status: orderbook.StatusNew})
+	orders, _ = s.Orders("ETH")
+	assert(t, len(orders), 3)
+	// closed orders stay in the history
+	order.Status = orderbook.StatusFilled
+	s.SaveOrder(order)
+	open, _ := s.UserOrders(1, orderbook.StatusNew)
+	assert(t, len(open), 1)
+	assert(t, open[0].ID, int64(2))
+	all, _ := s.UserOrders(1, "")
+	assert(t, len(all), 2)
+	got, ok, _ := s.Order(1)
+	assert(t, ok, true)
+	assert(t, got.Status, orderbook.StatusFilled)
+}
+
+func TestFileStoreRejectsCorruptRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exchange.log")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SaveOrder(OrderRecord{ID: 1, Market: "ETH", Timestamp: 1, Status: orderbook.StatusNew})
+	s.Close()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("{\"Kind\":\"ORDER\",\"Order\":{\"ID\":2\n")
+	f.WriteString(`{"Kind":"ORDER","Order":{"ID":3,"Market":"ETH","Timestamp":3,"Status":"NEW"}}` + "\n")
+	f.Close()
+	info, _ := os.Stat(path)
+
+	// a corrupt record with history after it is not a torn write
+	if _, err := NewFileStore(path); err == nil {
+		t.Fatal("expected the corrupt record to fail the load")
+	}
+	after, _ := os.Stat(path)
+	assert(t, after.Size(), info.Size())
+}
+
+// failingFile writes half of every record and fails, and fails truncating
+// the log when truncate is set.
+type failingFile struct {
+	logFile
+	truncate bool
+}
+
+func (f *failingFile) Write(b []byte) (int, error) {
+	n, _ := f.logFile.Write(b[:len(b)/2])
+	return n, errors.New("disk full")
+}
+
+func (f *failingFile) Truncate(size int64) error {
+	if f.truncate {
+		return errors.New("read-only file system")
+	}
+	return f.logFile.Truncate(size)
+}
+
+func TestFileStoreUndoesFailedWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exchange.log")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SaveOrder(OrderRecord{ID: 1, Market: "ETH", Timestamp: 1, Status: orderbook.StatusNew})
+
+	f := s.f
+	s.f = &failingFile{logFile: f}
+	if err := s.SaveOrder(OrderRecord{ID: 2, Market: "ETH", Timestamp: 2, Status: orderbook.StatusNew}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	// the half written record is truncated before the next one is appended
+	s.f = f
+	assert(t, s.SaveOrder(OrderRecord{ID: 3, Market: "ETH", Timestamp: 3, Status: orderbook.StatusNew}), nil)
+
+	s.f = &failingFile{logFile: f, truncate: true}
+	if err := s.SaveOrder(OrderRecord{ID: 4, Market: "ETH", Timestamp: 4, Status: orderbook.StatusNew}); err == nil {
+		t.Fatal("expected the write to fail")
+	}
+	// a torn record that cannot be truncated stops the store
+	s.f = f
+	if err := s.SaveOrder(OrderRecord{ID: 5, Market: "ETH", Timestamp: 5, Status: orderbook.StatusNew}); err == nil {
+		t.Fatal("expected the store to refuse writes after a torn record")
+	}
+	s.Close()
+
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	orders, _ := s.Orders("ETH")
+	assert(t, len(orders), 2)
+	assert(t, orders[1].ID, int64(3))
+}
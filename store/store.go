@@ -0,0 +1,478 @@
+package store
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/highxshell/crypto-exchange/marketdata"
+	"github.com/highxshell/crypto-exchange/orderbook"
+	"github.com/highxshell/crypto-exchange/userstats"
+)
+
+const (
+	SettlementPending SettlementStatus = "PENDING"
+	SettlementSettled SettlementStatus = "SETTLED"
+	SettlementFailed  SettlementStatus = "FAILED"
+
+	// GroupOCO is a pair of orders where a fill of one cancels the other.
+	GroupOCO OrderGroupType = "OCO"
+	// GroupBracket is an entry order followed by an OCO pair of a
+	// take-profit and a stop-loss order once the entry is filled.
+	GroupBracket OrderGroupType = "BRACKET"
+
+	// GroupPending is a bracket waiting for its entry to fill.
+	GroupPending OrderGroupStatus = "PENDING"
+	// GroupActive is a group whose OCO pair is working.
+	GroupActive OrderGroupStatus = "ACTIVE"
+	// GroupCompleted is a group one order of the OCO pair executed in.
+	GroupCompleted OrderGroupStatus = "COMPLETED"
+	GroupCanceled  OrderGroupStatus = "CANCELED"
+)
+
+type (
+	SettlementStatus string
+	OrderGroupType   string
+	OrderGroupStatus string
+
+	// OrderRecord is the state of an order after a state transition. Size is
+	// the remaining size of the order, Price is zero for market orders.
+	OrderRecord struct {
+		ID         int64
+		UserID     int64
+		Market     string
+		Bid        bool
+		Price      float64
+		Size       float64
+		FilledSize float64
+		AvgPrice   float64
+		Timestamp  int64
+		UpdatedAt  int64
+		Status     orderbook.OrderStatus
+		// ClientOrderID is the optional ID given to the order by its user.
+		ClientOrderID string             `json:",omitempty"`
+		PostOnly      orderbook.PostOnly `json:",omitempty"`
+		ReduceOnly    bool               `json:",omitempty"`
+		// StopPrice is the trigger price of a stop order. Price is its
+		// limit price once triggered, zero for stop market orders.
+		StopPrice float64 `json:",omitempty"`
+		// TrailAmount and TrailPercent are the distance StopPrice trails
+		// the trades at for trailing stops.
+		TrailAmount  float64 `json:",omitempty"`
+		TrailPercent float64 `json:",omitempty"`
+		// GroupID is the order group the order belongs to.
+		GroupID int64 `json:",omitempty"`
+		// Peg is the pricing of a pegged order, Price its latest price.
+		Peg *orderbook.Peg `json:",omitempty"`
+	}
+	// OrderGroupRecord is the latest state of a group of linked orders.
+	// OrderIDs lists the orders of the group, starting with the entry
+	// order of a bracket.
+	OrderGroupRecord struct {
+		ID       int64
+		UserID   int64
+		Market   string
+		Type     OrderGroupType
+		Status   OrderGroupStatus
+		OrderIDs []int64
+		// EntryID, Size, TakeProfitPrice and StopLossPrice describe a
+		// bracket: once its entry order of Size is filled, a take-profit
+		// limit and a stop-loss stop order close the position.
+		EntryID         int64   `json:",omitempty"`
+		Size            float64 `json:",omitempty"`
+		TakeProfitPrice float64 `json:",omitempty"`
+		StopLossPrice   float64 `json:",omitempty"`
+		Timestamp       int64
+		UpdatedAt       int64
+	}
+	TradeRecord struct {
+		Market string
+		Trade  *orderbook.Trade
+	}
+	// SettlementRecord is a transfer between two users for a match. Error
+	// holds the reason if the transfer could not be sent.
+	SettlementRecord struct {
+		Market  string
+		TradeID int64
+		// BatchID groups the transfers settling the same order.
+		BatchID    int64
+		FromUserID int64
+		ToUserID   int64
+		Amount     float64
+		// FromUserFee and ToUserFee are the fees the users paid to the
+		// exchange, negative for rebates the exchange paid to them.
+		FromUserFee float64
+		ToUserFee   float64
+		Timestamp   int64
+		Error       string
+	}
+	// FeeBalanceRecord is the fraction of a unit of fees a user owes the
+	// exchange, negative when rebates are owed to the user.
+	FeeBalanceRecord struct {
+		UserID int64
+		Owed   float64
+	}
+	// MarketStateRecord is the latest trading status of a market, a halt or
+	// an auction ends at ResumeAt unless it is zero.
+	MarketStateRecord struct {
+		Market   string
+		Status   string
+		Reason   string `json:",omitempty"`
+		Since    int64
+		ResumeAt int64 `json:",omitempty"`
+	}
+	// RiskOverrideRecord is the pre-trade limits an admin set for a user.
+	// Cleared puts the user back on the default limits.
+	RiskOverrideRecord struct {
+		UserID           int64
+		MaxOrderSize     float64
+		MaxOrderNotional float64
+		MaxOpenOrders    int
+		MaxPosition      float64
+		PriceBandPercent float64
+		DailyLossLimit   float64
+		Cleared          bool `json:",omitempty"`
+	}
+)
+
+func (s SettlementRecord) Status() SettlementStatus {
+	if s.Error != "" {
+		return SettlementFailed
+	}
+
+	return SettlementSettled
+}
+
+// Store persists the state of the exchange so it can be rebuilt after a
+// restart.
+type Store interface {
+	// SaveOrder records a state transition of an order.
+	SaveOrder(OrderRecord) error
+	SaveTrade(market string, trade *orderbook.Trade) error
+	SaveSettlement(SettlementRecord) error
+	// SaveCandle records a closed candle.
+	SaveCandle(market string, candle marketdata.Candle) error
+	// SaveUserStats records the latest statistics of a user.
+	SaveUserStats(*userstats.Stats) error
+	// SaveOrderGroup records a state transition of an order group.
+	SaveOrderGroup(OrderGroupRecord) error
+	// SaveFeeBalance records the latest fee balance of a user.
+	SaveFeeBalance(FeeBalanceRecord) error
+	// SaveMarketState records a status change of a market.
+	SaveMarketState(MarketStateRecord) error
+	// SaveRiskOverride records a change to the risk limits of a user.
+	SaveRiskOverride(RiskOverrideRecord) error
+
+	// Orders returns the latest state of every order in price-time priority
+	// (oldest first).
+	Orders(market string) ([]OrderRecord, error)
+	// Order returns the latest state of an order, open or closed.
+	Order(id int64) (OrderRecord, bool, error)
+	// OrderByClientID returns the latest order of a user placed with the
+	// client order ID.
+	OrderByClientID(userID int64, clientOrderID string) (OrderRecord, bool, error)
+	// UserOrders returns the orders of a user in every market oldest first,
+	// filtered by status unless it is empty.
+	UserOrders(userID int64, status orderbook.OrderStatus) ([]OrderRecord, error)
+	Trades(market string) ([]*orderbook.Trade, error)
+	Settlements() ([]SettlementRecord, error)
+	// Candles returns the closed candles of every interval in the order
+	// they were saved.
+	Candles(market string) ([]marketdata.Candle, error)
+	// UserStats returns the latest statistics of every user.
+	UserStats() ([]*userstats.Stats, error)
+	// OrderGroups returns the latest state of every order group oldest
+	// first.
+	OrderGroups() ([]OrderGroupRecord, error)
+	OrderGroup(id int64) (OrderGroupRecord, bool, error)
+	// FeeBalances returns the latest fee balance of every user.
+	FeeBalances() ([]FeeBalanceRecord, error)
+	// MarketStates returns the latest status of every market.
+	MarketStates() ([]MarketStateRecord, error)
+	// RiskOverrides returns the risk limits of every user with an override.
+	RiskOverrides() ([]RiskOverrideRecord, error)
+
+	Close() error
+}
+
+// MemoryStore is a Store that only lives in memory. It is used by the
+// FileStore as its index and by tests.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	orders      map[int64]OrderRecord
+	clientIDs   map[clientOrderKey]int64
+	trades      map[string][]*orderbook.Trade
+	settlements []SettlementRecord
+	candles     map[string][]marketdata.Candle
+	userStats   map[int64]*userstats.Stats
+	groups      map[int64]OrderGroupRecord
+	feeBalances map[int64]float64
+	states      map[string]MarketStateRecord
+	overrides   map[int64]RiskOverrideRecord
+}
+
+type clientOrderKey struct {
+	userID        int64
+	clientOrderID string
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		orders:      make(map[int64]OrderRecord),
+		clientIDs:   make(map[clientOrderKey]int64),
+		trades:      make(map[string][]*orderbook.Trade),
+		candles:     make(map[string][]marketdata.Candle),
+		userStats:   make(map[int64]*userstats.Stats),
+		groups:      make(map[int64]OrderGroupRecord),
+		feeBalances: make(map[int64]float64),
+		states:      make(map[string]MarketStateRecord),
+		overrides:   make(map[int64]RiskOverrideRecord),
+	}
+}
+
+func (s *MemoryStore) SaveOrder(o OrderRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orders[o.ID] = o
+	if o.ClientOrderID != "" {
+		s.clientIDs[clientOrderKey{o.UserID, o.ClientOrderID}] = o.ID
+	}
+	return nil
+}
+
+func (s *MemoryStore) SaveTrade(market string, trade *orderbook.Trade) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trades[market] = append(s.trades[market], trade)
+	return nil
+}
+
+func (s *MemoryStore) SaveSettlement(settlement SettlementRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.settlements = append(s.settlements, settlement)
+	return nil
+}
+
+func (s *MemoryStore) SaveCandle(market string, candle marketdata.Candle) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.candles[market] = append(s.candles[market], candle)
+	return nil
+}
+
+func (s *MemoryStore) SaveUserStats(stats *userstats.Stats) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.userStats[stats.UserID] = stats.Clone()
+	return nil
+}
+
+func (s *MemoryStore) SaveOrderGroup(g OrderGroupRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	g.OrderIDs = append([]int64{}, g.OrderIDs...)
+	s.groups[g.ID] = g
+	return nil
+}
+
+func (s *MemoryStore) SaveFeeBalance(b FeeBalanceRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.feeBalances[b.UserID] = b.Owed
+	return nil
+}
+
+func (s *MemoryStore) SaveMarketState(state MarketStateRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[state.Market] = state
+	return nil
+}
+
+func (s *MemoryStore) SaveRiskOverride(o RiskOverrideRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if o.Cleared {
+		delete(s.overrides, o.UserID)
+		return nil
+	}
+	s.overrides[o.UserID] = o
+	return nil
+}
+
+func (s *MemoryStore) Orders(market string) ([]OrderRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterOrders(func(o OrderRecord) bool {
+		return o.Market == market
+	}), nil
+}
+
+func (s *MemoryStore) Order(id int64) (OrderRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	o, ok := s.orders[id]
+	return o, ok, nil
+}
+
+func (s *MemoryStore) OrderByClientID(userID int64, clientOrderID string) (OrderRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	id, ok := s.clientIDs[clientOrderKey{userID, clientOrderID}]
+	if !ok {
+		return OrderRecord{}, false, nil
+	}
+	o, ok := s.orders[id]
+	return o, ok, nil
+}
+
+func (s *MemoryStore) UserOrders(userID int64, status orderbook.OrderStatus) ([]OrderRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.filterOrders(func(o OrderRecord) bool {
+		return o.UserID == userID && (status == "" || o.Status == status)
+	}), nil
+}
+
+// filterOrders returns the orders matching fn oldest first.
+func (s *MemoryStore) filterOrders(fn func(OrderRecord) bool) []OrderRecord {
+	orders := []OrderRecord{}
+	for _, o := range s.orders {
+		if fn(o) {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if orders[i].Timestamp == orders[j].Timestamp {
+			return orders[i].ID < orders[j].ID
+		}
+		return orders[i].Timestamp < orders[j].Timestamp
+	})
+
+	return orders
+}
+
+func (s *MemoryStore) Trades(market string) ([]*orderbook.Trade, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trades := make([]*orderbook.Trade, len(s.trades[market]))
+	copy(trades, s.trades[market])
+
+	return trades, nil
+}
+
+func (s *MemoryStore) Settlements() ([]SettlementRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	settlements := make([]SettlementRecord, len(s.settlements))
+	copy(settlements, s.settlements)
+
+	return settlements, nil
+}
+
+func (s *MemoryStore) Candles(market string) ([]marketdata.Candle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	candles := make([]marketdata.Candle, len(s.candles[market]))
+	copy(candles, s.candles[market])
+
+	return candles, nil
+}
+
+func (s *MemoryStore) UserStats() ([]*userstats.Stats, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := make([]*userstats.Stats, 0, len(s.userStats))
+	for _, userStats := range s.userStats {
+		stats = append(stats, userStats.Clone())
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].UserID < stats[j].UserID })
+
+	return stats, nil
+}
+
+func (s *MemoryStore) OrderGroups() ([]OrderGroupRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	groups := make([]OrderGroupRecord, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Timestamp == groups[j].Timestamp {
+			return groups[i].ID < groups[j].ID
+		}
+		return groups[i].Timestamp < groups[j].Timestamp
+	})
+
+	return groups, nil
+}
+
+func (s *MemoryStore) OrderGroup(id int64) (OrderGroupRecord, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	g, ok := s.groups[id]
+	return g, ok, nil
+}
+
+func (s *MemoryStore) FeeBalances() ([]FeeBalanceRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	balances := make([]FeeBalanceRecord, 0, len(s.feeBalances))
+	for userID, owed := range s.feeBalances {
+		balances = append(balances, FeeBalanceRecord{userID, owed})
+	}
+	sort.Slice(balances, func(i, j int) bool { return balances[i].UserID < balances[j].UserID })
+
+	return balances, nil
+}
+
+func (s *MemoryStore) MarketStates() ([]MarketStateRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	states := make([]MarketStateRecord, 0, len(s.states))
+	for _, state := range s.states {
+		states = append(states, state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Market < states[j].Market })
+
+	return states, nil
+}
+
+func (s *MemoryStore) RiskOverrides() ([]RiskOverrideRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	overrides := make([]RiskOverrideRecord, 0, len(s.overrides))
+	for _, o := range s.overrides {
+		overrides = append(overrides, o)
+	}
+	sort.Slice(overrides, func(i, j int) bool { return overrides[i].UserID < overrides[j].UserID })
+
+	return overrides, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,252 @@
+// Package userstats keeps rolling trading statistics of a user, such as the
+// traded volume used to pick fee tiers.
+package userstats
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	Window = 30 * 24 * time.Hour
+
+	dayNanos = int64(24 * time.Hour)
+)
+
+type (
+	// Day holds the statistics of a user for one UTC day. Volumes are in
+	// quote currency.
+	Day struct {
+		Day         int64
+		MakerVolume float64
+		TakerVolume float64
+		Orders      int64
+		Cancels     int64
+		RealizedPnL map[string]float64 `json:",omitempty"`
+	}
+	// Position is the net position of a user in a market, negative when
+	// short. AvgPrice is the average entry price of the open position.
+	Position struct {
+		Size     float64
+		AvgPrice float64
+	}
+	// Stats holds the statistics of a user in daily buckets, oldest first.
+	// Days older than Window are dropped as new activity is added. Stats is
+	// not safe for concurrent use.
+	Stats struct {
+		UserID    int64
+		Days      []*Day
+		Positions map[string]*Position
+		// LastTrades is the ID of the last trade of each market whose
+		// fills are in the statistics.
+		LastTrades map[string]int64 `json:",omitempty"`
+	}
+	// Summary is the statistics of a user over the rolling window.
+	Summary struct {
+		UserID      int64
+		Volume      float64
+		MakerVolume float64
+		TakerVolume float64
+		// MakerRatio is the share of the volume traded as maker.
+		MakerRatio float64
+		Orders     int64
+		Cancels    int64
+		// CancelRatio is the number of canceled orders per placed order.
+		CancelRatio float64
+		// RealizedPnL is in quote currency per market, net of fees.
+		RealizedPnL map[string]float64
+		Positions   map[string]Position
+	}
+)
+
+func New(userID int64) *Stats {
+	return &Stats{
+		UserID:    userID,
+		Days:      []*Day{},
+		Positions: make(map[string]*Position),
+	}
+}
+
+// day returns the bucket of the timestamp, creating it if needed. Buckets
+// that left the window are dropped.
+func (s *Stats) day(timestamp int64) *Day {
+	day := timestamp / dayNanos
+	oldest := (timestamp - int64(Window)) / dayNanos
+
+	i := 0
+	for ; i < len(s.Days) && s.Days[i].Day < oldest; i++ {
+	}
+	s.Days = s.Days[i:]
+
+	i = sort.Search(len(s.Days), func(i int) bool { return s.Days[i].Day >= day })
+	if i < len(s.Days) && s.Days[i].Day == day {
+		return s.Days[i]
+	}
+
+	d := &Day{Day: day}
+	s.Days = append(s.Days, nil)
+	copy(s.Days[i+1:], s.Days[i:])
+	s.Days[i] = d
+
+	return d
+}
+
+func (s *Stats) AddOrder(timestamp int64) {
+	s.day(timestamp).Orders++
+}
+
+func (s *Stats) AddCancel(timestamp int64) {
+	s.day(timestamp).Cancels++
+}
+
+// AddFill records a fill of the user. Bid is the side of the user and fee
+// is charged in the base asset. Realized PnL is computed against the
+// average entry price of the position.
+func (s *Stats) AddFill(market string, bid, maker bool, price, size, fee float64, timestamp int64) {
+	d := s.day(timestamp)
+	if maker {
+		d.MakerVolume += price * size
+	} else {
+		d.TakerVolume += price * size
+	}
+
+	pos, ok := s.Positions[market]
+	if !ok {
+		pos = &Position{}
+		s.Positions[market] = pos
+	}
+
+	qty := size
+	if !bid {
+		qty = -size
+	}
+
+	pnl := -fee * price
+	switch {
+	case pos.Size == 0 || (pos.Size > 0) == (qty > 0):
+		pos.AvgPrice = (pos.AvgPrice*math.Abs(pos.Size) + price*size) / (math.Abs(pos.Size) + size)
+		pos.Size += qty
+	default:
+		closed := math.Min(size, math.Abs(pos.Size))
+		if pos.Size > 0 {
+			pnl += closed * (price - pos.AvgPrice)
+		} else {
+			pnl += closed * (pos.AvgPrice - price)
+		}
+
+		flipped := size > math.Abs(pos.Size)
+		pos.Size += qty
+		switch {
+		case flipped:
+			pos.AvgPrice = price
+		case pos.Size == 0:
+			pos.AvgPrice = 0
+		}
+	}
+
+	if pnl != 0 {
+		if d.RealizedPnL == nil {
+			d.RealizedPnL = make(map[string]float64)
+		}
+		d.RealizedPnL[market] += pnl
+	}
+}
+
+// Volume returns the volume of the window ending now.
+func (s *Stats) Volume(now int64) float64 {
+	oldest := (now - int64(Window)) / dayNanos
+
+	volume := 0.0
+	for _, d := range s.Days {
+		if d.Day >= oldest {
+			volume += d.MakerVolume + d.TakerVolume
+		}
+	}
+
+	return volume
+}
+
+// DailyPnL returns the realized PnL of the UTC day of now in every market.
+func (s *Stats) DailyPnL(now int64) float64 {
+	day := now / dayNanos
+
+	pnl := 0.0
+	for _, d := range s.Days {
+		if d.Day == day {
+			for _, marketPnL := range d.RealizedPnL {
+				pnl += marketPnL
+			}
+		}
+	}
+
+	return pnl
+}
+
+// Summary returns the statistics of the window ending now.
+func (s *Stats) Summary(now int64) Summary {
+	oldest := (now - int64(Window)) / dayNanos
+
+	summary := Summary{
+		UserID:      s.UserID,
+		RealizedPnL: make(map[string]float64),
+		Positions:   make(map[string]Position),
+	}
+	for _, d := range s.Days {
+		if d.Day < oldest {
+			continue
+		}
+		summary.MakerVolume += d.MakerVolume
+		summary.TakerVolume += d.TakerVolume
+		summary.Orders += d.Orders
+		summary.Cancels += d.Cancels
+		for market, pnl := range d.RealizedPnL {
+			summary.RealizedPnL[market] += pnl
+		}
+	}
+	summary.Volume = summary.MakerVolume + summary.TakerVolume
+	if summary.Volume > 0 {
+		summary.MakerRatio = summary.MakerVolume / summary.Volume
+	}
+	if summary.Orders > 0 {
+		summary.CancelRatio = float64(summary.Cancels) / float64(summary.Orders)
+	}
+	for market, pos := range s.Positions {
+		if pos.Size != 0 {
+			summary.Positions[market] = *pos
+		}
+	}
+
+	return summary
+}
+
+// Clone returns a deep copy of the statistics.
+func (s *Stats) Clone() *Stats {
+	clone := &Stats{
+		UserID:    s.UserID,
+		Days:      make([]*Day, len(s.Days)),
+		Positions: make(map[string]*Position, len(s.Positions)),
+	}
+	for i, d := range s.Days {
+		day := *d
+		if d.RealizedPnL != nil {
+			day.RealizedPnL = make(map[string]float64, len(d.RealizedPnL))
+			for market, pnl := range d.RealizedPnL {
+				day.RealizedPnL[market] = pnl
+			}
+		}
+		clone.Days[i] = &day
+	}
+	for market, pos := range s.Positions {
+		p := *pos
+		clone.Positions[market] = &p
+	}
+	if s.LastTrades != nil {
+		clone.LastTrades = make(map[string]int64, len(s.LastTrades))
+		for market, id := range s.LastTrades {
+			clone.LastTrades[market] = id
+		}
+	}
+
+	return clone
+}
@@ -0,0 +1,76 @@
+package userstats
+
+import (
+	"reflect"
+	"testing"
+)
+
+func assert(t *testing.T, a, b any) {
+	t.Helper()
+	if !reflect.DeepEqual(a, b) {
+		t.Errorf("%+v != %+v", a, b)
+	}
+}
+
+func TestRealizedPnL(t *testing.T) {
+	s := New(1)
+
+	s.AddFill("ETH", true, true, 100, 2, 0, 0)
+	s.AddFill("ETH", true, false, 200, 2, 0, 0)
+	assert(t, *s.Positions["ETH"], Position{Size: 4, AvgPrice: 150})
+
+	// sell more than the position, the rest opens a short at the fill price
+	s.AddFill("ETH", false, false, 250, 6, 0.01, 0)
+	assert(t, *s.Positions["ETH"], Position{Size: -2, AvgPrice: 250})
+
+	summary := s.Summary(0)
+	assert(t, summary.RealizedPnL["ETH"], 4*(250-150)-0.01*250)
+	assert(t, summary.MakerVolume, 200.0)
+	assert(t, summary.TakerVolume, 400.0+1500.0)
+	assert(t, summary.MakerRatio, 200.0/2100.0)
+
+	s.AddFill("ETH", true, true, 200, 2, 0, 0)
+	assert(t, *s.Positions["ETH"], Position{})
+	assert(t, s.Summary(0).RealizedPnL["ETH"], 4*(250-150)-0.01*250+2*50.0)
+}
+
+func TestRollingWindow(t *testing.T) {
+	s := New(1)
+
+	s.AddOrder(0)
+	s.AddOrder(0)
+	s.AddCancel(0)
+	s.AddFill("ETH", true, true, 10, 1, 0, 0)
+
+	summary := s.Summary(0)
+	assert(t, summary.Orders, int64(2))
+	assert(t, summary.CancelRatio, 0.5)
+	assert(t, s.Volume(0), 10.0)
+
+	later := int64(Window) + 2*dayNanos
+	assert(t, s.Volume(later), 0.0)
+
+	s.AddOrder(later)
+	assert(t, len(s.Days), 1)
+	assert(t, s.Summary(later).Orders, int64(1))
+	assert(t, s.Summary(later).Positions["ETH"], Position{Size: 1, AvgPrice: 10})
+
+	clone := s.Clone()
+	clone.AddOrder(later)
+	clone.Positions["ETH"].Size = 5
+	assert(t, s.Summary(later).Orders, int64(1))
+	assert(t, s.Positions["ETH"].Size, 1.0)
+}
+
+func TestDailyPnL(t *testing.T) {
+	s := New(1)
+
+	s.AddFill("ETH", true, false, 100, 1, 0, 0)
+	s.AddFill("ETH", false, false, 90, 1, 0, 0)
+	assert(t, s.DailyPnL(0), -10.0)
+
+	s.AddFill("BTC", true, false, 100, 1, 0, dayNanos)
+	s.AddFill("BTC", false, false, 150, 1, 0, dayNanos)
+	assert(t, s.DailyPnL(dayNanos), 50.0)
+	assert(t, s.Summary(dayNanos).RealizedPnL, map[string]float64{"ETH": -10, "BTC": 50})
+}